@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"time"
+)
+
+// fileMetadata returns the metadata of the file at key, or a new record
+// for it if it has none yet.
+func (fs *FileSystem) fileMetadata(key string) (*FileMetadata, error) {
+	if _, err := fs.Backend.Stat(key); err != nil {
+		return nil, err
+	}
+
+	file, err := fs.db.GetFileMetadata(key)
+	if err != nil {
+		return nil, err
+	}
+	if file == nil {
+		file = &FileMetadata{Filename: key, Timestamp: time.Now().UTC()}
+	}
+	return file, nil
+}
+
+// Tags returns the tags of a file, sorted.
+func (fs *FileSystem) Tags(name string) ([]string, error) {
+	key, err := fs.Resolve("tags", name)
+	if err != nil {
+		return nil, err
+	}
+	if err := fs.access("tags", name, key, permRead); err != nil {
+		return nil, err
+	}
+	file, err := fs.fileMetadata(key)
+	if err != nil {
+		return nil, err
+	}
+	return file.Tags, nil
+}
+
+// Tag adds tags to a file.
+func (fs *FileSystem) Tag(name string, tags ...string) error {
+	return fs.updateMetadata("tag", name, func(file *FileMetadata) {
+		for _, tag := range tags {
+			if !hasTag(file.Tags, tag) {
+				file.Tags = append(file.Tags, tag)
+			}
+		}
+		sort.Strings(file.Tags)
+	})
+}
+
+// Untag removes tags from a file.
+func (fs *FileSystem) Untag(name string, tags ...string) error {
+	return fs.updateMetadata("untag", name, func(file *FileMetadata) {
+		var kept []string
+		for _, tag := range file.Tags {
+			if !hasTag(tags, tag) {
+				kept = append(kept, tag)
+			}
+		}
+		file.Tags = kept
+	})
+}
+
+// GetAttr returns the value of an attribute of a file.
+func (fs *FileSystem) GetAttr(name, attr string) (string, error) {
+	attrs, err := fs.Attrs(name)
+	if err != nil {
+		return "", err
+	}
+	value, ok := attrs[attr]
+	if !ok {
+		return "", &os.PathError{Op: "getattr", Path: name, Err: fmt.Errorf("no attribute '%s'", attr)}
+	}
+	return value, nil
+}
+
+// Attrs returns every attribute of a file.
+func (fs *FileSystem) Attrs(name string) (map[string]string, error) {
+	key, err := fs.Resolve("getattr", name)
+	if err != nil {
+		return nil, err
+	}
+	if err := fs.access("getattr", name, key, permRead); err != nil {
+		return nil, err
+	}
+	file, err := fs.fileMetadata(key)
+	if err != nil {
+		return nil, err
+	}
+	return file.Attributes, nil
+}
+
+// SetAttr sets an attribute of a file. An empty value removes it.
+func (fs *FileSystem) SetAttr(name, attr, value string) error {
+	return fs.updateMetadata("setattr", name, func(file *FileMetadata) {
+		if value == "" {
+			delete(file.Attributes, attr)
+			return
+		}
+		if file.Attributes == nil {
+			file.Attributes = make(map[string]string)
+		}
+		file.Attributes[attr] = value
+	})
+}
+
+func (fs *FileSystem) updateMetadata(op, name string, update func(file *FileMetadata)) error {
+	key, err := fs.Resolve(op, name)
+	if err != nil {
+		return err
+	}
+
+	unlock := fs.locks.Lock(key)
+	defer unlock()
+
+	if err := fs.access(op, name, key, permWrite); err != nil {
+		return err
+	}
+	file, err := fs.fileMetadata(key)
+	if err != nil {
+		return err
+	}
+	update(file)
+	return fs.db.PutFileMetadata(file)
+}
+
+// HasTag reports whether the file at key is tagged with tag.
+func (fs *FileSystem) HasTag(key, tag string) (bool, error) {
+	key, err := fs.contentKey(key)
+	if err != nil {
+		return false, err
+	}
+	file, err := fs.db.GetFileMetadata(key)
+	if err != nil || file == nil {
+		return false, err
+	}
+	return hasTag(file.Tags, tag), nil
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// commitVersion records a prepared version of key, along with the tags and
+// attributes the file has now, then brings the file's metadata, usage and
+// search index up to date with it. before is what storage held at key
+// before the version was written, nil if there was no file.
+func (fs *FileSystem) commitVersion(key string, version *Version, before *ObjectInfo) error {
+	file, err := fs.db.GetFileMetadata(key)
+	if err != nil {
+		return err
+	}
+	if file != nil {
+		version.Tags = file.Tags
+		version.Attributes = file.Attributes
+	}
+	if version.Checksum == "" {
+		// Versions rebuilt by Recover, or shared from one recorded before
+		// checksums were, don't carry one.
+		if data, err := fs.Backend.Get(key); err == nil && int64(len(data)) == version.Size {
+			version.Checksum = checksum(data)
+		}
+	}
+	if err := fs.Versioning.CommitVersion(key, version); err != nil {
+		return err
+	}
+
+	// The version is recorded, so failing to update what is derived from
+	// it is logged rather than returned.
+	delta := Usage{Bytes: version.Size, HistoryBytes: version.Len()}
+	if before == nil {
+		delta.Files = 1
+	} else {
+		delta.Bytes -= before.Size
+	}
+	if file == nil {
+		file = &FileMetadata{Filename: key}
+	}
+	if owner, err := fs.quotaOwner(key); err != nil {
+		log.Printf("Failed to update the usage of '%s': %v", key, err)
+	} else if err := fs.addUsage(owner, delta); err != nil {
+		log.Printf("Failed to update the usage of '%s': %v", key, err)
+	}
+	file.FileSize = version.Size
+	file.Checksum = version.Checksum
+	file.Timestamp = version.ModifiedTime
+	if err := fs.db.PutFileMetadata(file); err != nil {
+		log.Printf("Failed to update the metadata of '%s': %v", key, err)
+	}
+	fs.updateIndex(key)
+	return nil
+}
+
+// addVersionFrom records the contents read from r as a new version of key.
+// before is as for commitVersion.
+func (fs *FileSystem) addVersionFrom(key string, r io.Reader, before *ObjectInfo) error {
+	version, err := fs.Versioning.PrepareVersion(r)
+	if err != nil {
+		return err
+	}
+
+	if err := fs.commitVersion(key, version, before); err != nil {
+		fs.Versioning.AbortVersion(version)
+		return err
+	}
+	return nil
+}
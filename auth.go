@@ -3,13 +3,9 @@ package main
 import (
 	"fmt"
 	"log"
-	"os"
-	"path/filepath"
+	"strings"
 
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
 	"golang.org/x/crypto/bcrypt"
-	//"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 // User represents a user in the system.
@@ -17,20 +13,27 @@ type User struct {
 	Username string
 	Password string
 	Role     string
+	Groups   []string // groups besides the user's own, for file permissions
 }
 
 // AuthService provides authentication services.
 type AuthService struct {
-	dbClient *mongo.Client
+	store   MetadataStore
+	storage StorageBackend
 }
 
-// NewAuthService creates a new instance of AuthService.
-func NewAuthService(dbClient *mongo.Client) *AuthService {
-	return &AuthService{dbClient: dbClient}
+// NewAuthService creates a new instance of AuthService. Accounts are kept
+// in store and home directories are created in storage.
+func NewAuthService(store MetadataStore, storage StorageBackend) *AuthService {
+	return &AuthService{store: store, storage: storage}
 }
 
 // Signup creates a new user account.
 func (a *AuthService) Signup(username, password, role string) error {
+	if err := validateUsername(username); err != nil {
+		return err
+	}
+
 	// Check if the username is already taken
 	if a.isUsernameTaken(username) {
 		return fmt.Errorf("username '%s' is already taken", username)
@@ -49,21 +52,27 @@ func (a *AuthService) Signup(username, password, role string) error {
 		Role:     role,
 	}
 
+	// Create the home directory for the user, before the account can be
+	// logged into
+	if err := createHomeDirectory(a.storage, username); err != nil {
+		return fmt.Errorf("failed to create home directory: %v", err)
+	}
+
 	// Insert the user document into the database
 	if err := a.insertUser(user); err != nil {
+		a.storage.Delete(username)
 		return fmt.Errorf("failed to insert user: %v", err)
 	}
 
-	// Create the home directory for the user
-	if err := createHomeDirectory(username); err != nil {
-		return fmt.Errorf("failed to create home directory: %v", err)
-	}
-
 	return nil
 }
 
 // Login authenticates a user.
 func (a *AuthService) Login(username, password string) (bool, error) {
+	if validateUsername(username) != nil {
+		return false, nil
+	}
+
 	// Retrieve the user document from the database
 	user, err := a.findUserByUsername(username)
 	if err != nil {
@@ -79,15 +88,28 @@ func (a *AuthService) Login(username, password string) (bool, error) {
 	return true, nil // Authentication successful
 }
 
-// Helper function to check if a username is already taken
-func (a *AuthService) isUsernameTaken(username string) bool {
-	collection := a.dbClient.Database("myfilesdb").Collection("users")
+// GetUser returns the account of a user.
+func (a *AuthService) GetUser(username string) (*User, error) {
+	return a.findUserByUsername(username)
+}
 
-	filter := bson.M{"username": username}
+// validateUsername returns an error unless username can name a home
+// directory: it must not be empty, contain a slash or start with a dot,
+// which is kept for the trash and other reserved directories.
+func validateUsername(username string) error {
+	if username == "" {
+		return fmt.Errorf("username must not be empty")
+	}
+	if strings.ContainsAny(username, "/\\") || strings.HasPrefix(username, ".") {
+		return fmt.Errorf("invalid username '%s'", username)
+	}
+	return nil
+}
 
-	var result User
-	err := collection.FindOne(nil, filter).Decode(&result)
-	if err == mongo.ErrNoDocuments {
+// Helper function to check if a username is already taken
+func (a *AuthService) isUsernameTaken(username string) bool {
+	_, err := a.store.FindUser(username)
+	if err == ErrNotFound {
 		return false // Username is not taken
 	} else if err != nil {
 		log.Printf("Error checking username: %v", err)
@@ -99,48 +121,42 @@ func (a *AuthService) isUsernameTaken(username string) bool {
 
 // Helper function to insert a user document into the database
 func (a *AuthService) insertUser(user User) error {
-	collection := a.dbClient.Database("myfilesdb").Collection("users")
-
-	_, err := collection.InsertOne(nil, user)
-	if err != nil {
-		return err
-	}
-
-	return nil
+	return a.store.InsertUser(user)
 }
 
 // Helper function to find a user by username
 func (a *AuthService) findUserByUsername(username string) (*User, error) {
-	collection := a.dbClient.Database("myfilesdb").Collection("users")
-
-	filter := bson.M{"username": username}
-
-	var user User
-	err := collection.FindOne(nil, filter).Decode(&user)
-	if err != nil {
-		return nil, err
-	}
-
-	return &user, nil
+	return a.store.FindUser(username)
 }
 
 // Helper function to create the home directory for a user
-func createHomeDirectory(username string) error {
-	// Specify the base directory where the user directories will be created
-	baseDir := "./storageData"
-
-	// Create the user's home directory path
-	homeDir := filepath.Join(baseDir, username)
-
+func createHomeDirectory(storage StorageBackend, username string) error {
 	// Check if the home directory already exists
-	if _, err := os.Stat(homeDir); !os.IsNotExist(err) {
-		return fmt.Errorf("home directory '%s' already exists", homeDir)
+	if _, err := storage.Stat(username); err == nil {
+		return fmt.Errorf("home directory '%s' already exists", username)
 	}
 
 	// Create the user's home directory
-	if err := os.Mkdir(homeDir, 0700); err != nil {
+	if err := storage.Mkdir(username); err != nil {
 		return fmt.Errorf("failed to create home directory: %v", err)
 	}
 
 	return nil
 }
+
+// checkHomeDirectory returns an error unless username names a home
+// directory that exists, so a session is never left without one.
+func checkHomeDirectory(storage StorageBackend, username string) error {
+	home := cleanKey(username)
+	if home == "" || home != username {
+		return fmt.Errorf("invalid home directory '%s'", username)
+	}
+	info, err := storage.Stat(home)
+	if err != nil {
+		return fmt.Errorf("home directory '%s' is missing", username)
+	}
+	if !info.IsDir {
+		return fmt.Errorf("home directory '%s' is not a directory", username)
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestSignupRejectsInvalidUsernames(t *testing.T) {
+	store, err := OpenEmbeddedStore(filepath.Join(t.TempDir(), "metadata.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	backend := NewMemoryBackend()
+	auth := NewAuthService(store, backend)
+
+	for _, username := range []string{"", ".", "..", "al/..", "al/bo", `al\bo`, ".trash"} {
+		if err := auth.Signup(username, "secret", "USER"); err == nil {
+			t.Errorf("signup of %q succeeded", username)
+		}
+		if ok, _ := auth.Login(username, "secret"); ok {
+			t.Errorf("login of %q succeeded", username)
+		}
+		if _, err := store.FindUser(username); err != ErrNotFound {
+			t.Errorf("account %q was created", username)
+		}
+	}
+}
+
+func TestSignupCreatesHomeFirst(t *testing.T) {
+	store, err := OpenEmbeddedStore(filepath.Join(t.TempDir(), "metadata.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	backend := NewMemoryBackend()
+	auth := NewAuthService(store, backend)
+
+	// A directory of that name is already there; no account is created.
+	if err := backend.Mkdir("bo"); err != nil {
+		t.Fatal(err)
+	}
+	if err := auth.Signup("bo", "secret", "USER"); err == nil {
+		t.Error("signup over an existing directory succeeded")
+	}
+	if _, err := store.FindUser("bo"); err != ErrNotFound {
+		t.Error("account created without a home directory of its own")
+	}
+
+	if err := auth.Signup("al", "secret", "USER"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := auth.Login("al", "secret"); !ok || err != nil {
+		t.Fatalf("login failed: %v %v", ok, err)
+	}
+	if err := checkHomeDirectory(backend, "al"); err != nil {
+		t.Error(err)
+	}
+	if err := checkHomeDirectory(backend, ""); err == nil {
+		t.Error("empty home directory accepted")
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path"
+	"sync"
+)
+
+// blobPrefix is the backend directory blobs are stored under. It sits next
+// to the users' home directories, out of reach of their sandboxes.
+const blobPrefix = ".blobs"
+
+// blobRefs is the record collection holding the reference count per blob.
+const blobRefs = "blob_refs"
+
+// BlobStore stores contents addressed by their SHA-256 hash, so identical
+// contents are only stored once no matter how many versions, files or users
+// refer to them. Each reference is counted; a blob is deleted when its last
+// reference is released.
+type BlobStore struct {
+	// mutex keeps a release that drops a blob to zero references from
+	// racing with a put that reuses it.
+	mutex   sync.Mutex
+	backend StorageBackend
+	store   MetadataStore
+}
+
+func NewBlobStore(backend StorageBackend, store MetadataStore) *BlobStore {
+	return &BlobStore{backend: backend, store: store}
+}
+
+func blobKey(hash string) string {
+	return path.Join(blobPrefix, hash[:2], hash[2:])
+}
+
+// Put stores data and returns its hash. The caller owns one reference.
+func (s *BlobStore) Put(data []byte) (string, error) {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, err := s.backend.Stat(blobKey(hash)); os.IsNotExist(err) {
+		if err := s.backend.Put(blobKey(hash), data); err != nil {
+			return "", err
+		}
+	} else if err != nil {
+		return "", err
+	}
+
+	if _, err := s.store.Increment(blobRefs, hash, 1); err != nil {
+		return "", err
+	}
+	return hash, nil
+}
+
+// Get returns the contents of a blob.
+func (s *BlobStore) Get(hash string) ([]byte, error) {
+	r, err := s.Open(hash)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, r); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Open returns a reader for a blob.
+func (s *BlobStore) Open(hash string) (io.ReadCloser, error) {
+	return openBackendReader(s.backend, blobKey(hash))
+}
+
+// Repair stores data again as the blob hash, replacing contents that were
+// damaged. A blob no longer referenced is left alone.
+func (s *BlobStore) Repair(hash string, data []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	refs, err := s.RefCount(hash)
+	if err != nil || refs <= 0 {
+		return err
+	}
+	return s.backend.Put(blobKey(hash), data)
+}
+
+// Retain adds a reference to an existing blob.
+func (s *BlobStore) Retain(hash string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, err := s.backend.Stat(blobKey(hash)); err != nil {
+		return err
+	}
+	_, err := s.store.Increment(blobRefs, hash, 1)
+	return err
+}
+
+// Release drops a reference to a blob and deletes it once nothing refers
+// to it any more.
+func (s *BlobStore) Release(hash string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	refs, err := s.store.Increment(blobRefs, hash, -1)
+	if err != nil {
+		return err
+	}
+	if refs > 0 {
+		return nil
+	}
+
+	if err := s.backend.Delete(blobKey(hash)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return s.store.DeleteRecord(blobRefs, hash)
+}
+
+// RefCount returns the number of references to a blob.
+func (s *BlobStore) RefCount(hash string) (int64, error) {
+	var refs int64
+	err := s.store.GetRecord(blobRefs, hash, &refs)
+	if err == ErrNotFound {
+		return 0, nil
+	}
+	return refs, err
+}
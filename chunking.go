@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io"
+)
+
+// Versions are split into content-defined chunks with FastCDC: a gear
+// rolling hash picks cut points from the content itself, so an edit only
+// changes the chunks around it and every other chunk is shared with the
+// previous version in the blob store.
+const (
+	chunkMinSize = 16 * 1024
+	chunkAvgSize = 64 * 1024
+	chunkMaxSize = 256 * 1024
+
+	// Normalized chunking: cut points are harder to hit before the average
+	// size and easier after it, which narrows the spread of chunk sizes.
+	chunkMaskSmall = ((uint64(1) << 18) - 1) << (64 - 18)
+	chunkMaskLarge = ((uint64(1) << 14) - 1) << (64 - 14)
+)
+
+// gearTable maps each byte to a random 64-bit value. It is generated from a
+// fixed seed because cut points, and so deduplication across runs, depend
+// on it never changing.
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	state := uint64(0x9e3779b97f4a7c15)
+	for i := range table {
+		// splitmix64
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// chunkBoundary returns the length of the first chunk in data.
+func chunkBoundary(data []byte) int {
+	n := len(data)
+	if n <= chunkMinSize {
+		return n
+	}
+	if n > chunkMaxSize {
+		n = chunkMaxSize
+	}
+	normal := chunkAvgSize
+	if n < normal {
+		normal = n
+	}
+
+	var fp uint64
+	i := chunkMinSize
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gearTable[data[i]]
+		if fp&chunkMaskSmall == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gearTable[data[i]]
+		if fp&chunkMaskLarge == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// Chunker splits a stream into content-defined chunks. It never holds more
+// than two maximum-size chunks in memory.
+type Chunker struct {
+	r    io.Reader
+	buf  []byte
+	data []byte
+	eof  bool
+}
+
+func NewChunker(r io.Reader) *Chunker {
+	return &Chunker{r: r, buf: make([]byte, 2*chunkMaxSize)}
+}
+
+// Next returns the next chunk, or io.EOF after the last one. The chunk is
+// only valid until the following call.
+func (c *Chunker) Next() ([]byte, error) {
+	if len(c.data) < chunkMaxSize && !c.eof {
+		// Move what is left to the front and top the buffer up.
+		n := copy(c.buf, c.data)
+		for n < len(c.buf) && !c.eof {
+			m, err := c.r.Read(c.buf[n:])
+			n += m
+			if err == io.EOF {
+				c.eof = true
+			} else if err != nil {
+				return nil, err
+			}
+		}
+		c.data = c.buf[:n]
+	}
+
+	if len(c.data) == 0 {
+		return nil, io.EOF
+	}
+
+	cut := chunkBoundary(c.data)
+	chunk := c.data[:cut]
+	c.data = c.data[cut:]
+	return chunk, nil
+}
@@ -1,64 +1,59 @@
 package main
 
 import (
-	//"bytes"
+	"bytes"
 	"compress/gzip"
-	"os"
-	"path/filepath"
 
 	//"fmt"
 	"io"
 )
 
-func Compress(data []byte, filename string) error {
-	filePath := filepath.Join("storageData", filename)
+func Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
 
-	file, err := os.Create(filePath)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-
-	gzWriter := gzip.NewWriter(file)
+	gzWriter := gzip.NewWriter(&buf)
 	defer gzWriter.Close()
 
-	_, err = gzWriter.Write(data)
+	_, err := gzWriter.Write(data)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	err = gzWriter.Flush()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	err = gzWriter.Close()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	return buf.Bytes(), nil
 }
 
-func Decompress(filename string) ([]byte, error) {
-	filePath := filepath.Join("storageData", filename)
-
-	file, err := os.Open(filePath)
-	if err != nil {
-		return nil, err
-	}
-	defer file.Close()
-
-	gzReader, err := gzip.NewReader(file)
+func Decompress(data []byte) ([]byte, error) {
+	gzReader, err := gzip.NewReader(bytes.NewReader(data))
 	if err != nil {
 		return nil, err
 	}
 	defer gzReader.Close()
 
-	data, err := io.ReadAll(gzReader)
+	data, err = io.ReadAll(gzReader)
 	if err != nil {
 		return nil, err
 	}
 
 	return data, nil
 }
+
+// NewCompressWriter returns a writer that gzips everything written to it
+// into w. Closing it does not close w.
+func NewCompressWriter(w io.Writer) io.WriteCloser {
+	return gzip.NewWriter(w)
+}
+
+// NewDecompressReader returns a reader that gunzips r.
+func NewDecompressReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// Copy copies a file, or a directory with everything in it, to dst, which
+// must not exist. A symbolic link given as src is followed. Each copy
+// starts its history with a version sharing the contents of the source's
+// latest one, so no new blobs are stored, and records where it was copied
+// from.
+func (fs *FileSystem) Copy(src, dst string) error {
+	srcKey, err := fs.Resolve("copy", src)
+	if err != nil {
+		return err
+	}
+	dstKey, err := fs.Resolve("copy", dst)
+	if err != nil {
+		return err
+	}
+
+	if withinKey(dstKey, srcKey) {
+		return &os.PathError{Op: "copy", Path: dst, Err: fmt.Errorf("cannot copy a directory into itself")}
+	}
+	if _, err := fs.Backend.Stat(dstKey); err == nil {
+		return &os.PathError{Op: "copy", Path: dst, Err: os.ErrExist}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if err := fs.accessParent("copy", dst, dstKey); err != nil {
+		return err
+	}
+
+	return walkBackend(fs.Backend, srcKey, func(info ObjectInfo) error {
+		target := path.Join(dstKey, strings.TrimPrefix(strings.TrimPrefix(info.Name, srcKey), "/"))
+		if err := fs.access("copy", src, info.Name, permRead); err != nil {
+			return err
+		}
+		perm, err := fs.permissions(info.Name, info.IsDir)
+		if err != nil {
+			return err
+		}
+		if info.IsDir {
+			if err := fs.Backend.Mkdir(target); err != nil {
+				return err
+			}
+			return fs.setOwner(target, perm.Mode)
+		}
+
+		// Links inside a directory are copied as links; a hard link
+		// becomes a file of its own.
+		if link, ok, err := fs.readlinkKey(info.Name); err != nil {
+			return err
+		} else if ok {
+			return fs.symlinkKey(link, target)
+		}
+		key, err := fs.contentKey(info.Name)
+		if err != nil {
+			return err
+		}
+		if stat, err := fs.Backend.Stat(key); err != nil {
+			return err
+		} else if err := fs.checkWriteQuota("copy", dst, target, stat.Size); err != nil {
+			return err
+		}
+		if err := fs.copyFile(key, target); err != nil {
+			return err
+		}
+		return fs.setOwner(target, perm.Mode)
+	})
+}
+
+// copyFile copies the file at key src to key dst, along the lines of
+// writeFile.
+func (fs *FileSystem) copyFile(src, dst string) error {
+	unlock := fs.locks.LockAll([]string{src, dst})
+	defer unlock()
+
+	baseVersion, err := fs.Versioning.GetLatestVersion(dst)
+	if err != nil {
+		return err
+	}
+	before, err := fs.Backend.Stat(dst)
+	if os.IsNotExist(err) {
+		before = nil
+	} else if err != nil {
+		return err
+	}
+
+	version, from, err := fs.Versioning.ShareVersion(src)
+	if err != nil {
+		return err
+	}
+	if version == nil {
+		// The source has no history yet; store its contents.
+		r, err := openBackendReader(fs.Backend, src)
+		if err != nil {
+			return err
+		}
+		version, err = fs.Versioning.PrepareVersion(r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	intent := &Intent{
+		Op:          intentWrite,
+		Key:         dst,
+		BaseVersion: baseVersion,
+		Chunks:      version.Chunks,
+		Size:        version.Size,
+	}
+	if err := fs.intents.Begin(intent); err != nil {
+		fs.Versioning.AbortVersion(version)
+		return err
+	}
+
+	if err := copyBackend(fs.Backend, src, dst); err != nil {
+		fs.Versioning.AbortVersion(version)
+		fs.intents.Done(intent)
+		return err
+	}
+
+	if err := fs.commitVersion(dst, version, before); err != nil {
+		return fmt.Errorf("file copied but version not recorded: %v", err)
+	}
+	if from > 0 {
+		err := fs.Versioning.RecordEvent(dst, HistoryEvent{
+			Op:          "copy",
+			From:        src,
+			To:          dst,
+			FromVersion: from,
+			Version:     baseVersion,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return fs.intents.Done(intent)
+}
@@ -1,110 +1,70 @@
 package main
 
 import (
-	"context"
 	"time"
-
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
-	"go.mongodb.org/mongo-driver/mongo/readpref"
 )
 
 type Database struct {
-	client     *mongo.Client
-	collection *mongo.Collection
+	store MetadataStore
 }
 
-
 type FileMetadata struct {
 	Filename  string `bson:"filename,omitempty"`
 	FileSize  int64  `bson:"filesize,omitempty"`
 	Checksum  string `bson:"checksum,omitempty"`
 	Timestamp time.Time
-}
-
-func NewDatabase() *Database {
-	client, err := mongo.NewClient(options.Client().ApplyURI("mongodb://localhost:27017"))
-	if err != nil {
-		panic(err)
-	}
-
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	err = client.Connect(ctx)
-	if err != nil {
-		panic(err)
-	}
 
-	err = client.Ping(ctx, readpref.Primary())
-	if err != nil {
-		panic(err)
-	}
-
-	db := client.Database("myfilesdb")
-	collection := db.Collection("files")
-
-	return &Database{
-		client:     client,
-		collection: collection,
-	}
+	// Tags and Attributes are set by users.
+	Tags       []string          `bson:"tags,omitempty"`
+	Attributes map[string]string `bson:"attributes,omitempty"`
 }
 
-func (db *Database) Close() {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	db.client.Disconnect(ctx)
+func NewDatabase(store MetadataStore) *Database {
+	return &Database{store: store}
 }
 
 func (db *Database) SaveFileMetadata(file *FileMetadata) error {
-	_, err := db.collection.InsertOne(context.Background(), file)
-	if err != nil {
-		return err
-	}
-
-	return nil
+	return db.store.SaveFileMetadata(file)
 }
 
 func (db *Database) UpdateFileMetadata(file *FileMetadata) error {
-	filter := bson.M{"filename": file.Filename}
-	update := bson.M{"$set": bson.M{
-		"filesize": file.FileSize,
-		"checksum": file.Checksum,
-	}}
-	_, err := db.collection.UpdateOne(context.Background(), filter, update)
-	if err != nil {
-		return err
-	}
-
-	return nil
+	return db.store.UpdateFileMetadata(file)
 }
 
 func (db *Database) DeleteFileMetadata(filename string) error {
-	filter := bson.M{"filename": filename}
-	_, err := db.collection.DeleteOne(context.Background(), filter)
+	return db.store.DeleteFileMetadata(filename)
+}
+
+func (db *Database) GetFileMetadata(filename string) (*FileMetadata, error) {
+	return db.store.GetFileMetadata(filename)
+}
+
+func (db *Database) ListFileMetadata(prefix string) ([]FileMetadata, error) {
+	return db.store.ListFileMetadata(prefix)
+}
+
+// PutFileMetadata saves file, replacing any metadata already saved for it.
+func (db *Database) PutFileMetadata(file *FileMetadata) error {
+	existing, err := db.store.GetFileMetadata(file.Filename)
 	if err != nil {
 		return err
 	}
-
-	return nil
+	if existing == nil {
+		return db.store.SaveFileMetadata(file)
+	}
+	return db.store.UpdateFileMetadata(file)
 }
 
-func (db *Database) GetFileMetadata(filename string) (*FileMetadata, error) {
-	filter := bson.M{"filename": filename}
-	result := db.collection.FindOne(context.Background(), filter)
-	if result.Err() == mongo.ErrNoDocuments {
-		return nil, nil
-	} else if result.Err() != nil {
-		return nil, result.Err()
+// RenameFileMetadata moves the metadata of oldName, if any, to newName.
+func (db *Database) RenameFileMetadata(oldName, newName string) error {
+	file, err := db.store.GetFileMetadata(oldName)
+	if err != nil || file == nil {
+		return err
 	}
 
-	var file FileMetadata
-	err := result.Decode(&file)
-	if err != nil {
-		return nil, err
+	file.Filename = newName
+	if err := db.PutFileMetadata(file); err != nil {
+		return err
 	}
-
-	return &file, nil
+	return db.store.DeleteFileMetadata(oldName)
 }
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// FileInfo describes a file or directory of a FileSystem.
+type FileInfo struct {
+	Name    string // base name
+	Size    int64
+	ModTime time.Time
+	IsDir   bool
+
+	Link   string // target of a symbolic link
+	Links  int    // number of names of a file with hard links, 1 otherwise
+	Shared string // access level of an item another user shared
+
+	key string
+}
+
+// fileInfo describes object, under the given name. A symbolic link is
+// described as a link; a file with hard links gets the size of its
+// contents, and a directory has no size.
+func (fs *FileSystem) fileInfo(name string, object ObjectInfo) (*FileInfo, error) {
+	info := &FileInfo{
+		Name:    name,
+		Size:    object.Size,
+		ModTime: object.ModTime,
+		IsDir:   object.IsDir,
+		Links:   1,
+		key:     object.Name,
+	}
+	if object.IsDir {
+		// What a directory takes up on disk depends on the backend.
+		info.Size = 0
+		return info, nil
+	}
+
+	target, ok, err := fs.readlinkKey(object.Name)
+	if err != nil {
+		return nil, err
+	} else if ok {
+		info.Link = target
+		return info, nil
+	}
+
+	if info.Links, err = fs.LinkCount(object.Name); err != nil {
+		return nil, err
+	}
+	if info.Links > 1 {
+		key, err := fs.contentKey(object.Name)
+		if err != nil {
+			return nil, err
+		}
+		content, err := fs.Backend.Stat(key)
+		if err != nil {
+			return nil, err
+		}
+		info.Size = content.Size
+		info.ModTime = content.ModTime
+	}
+	return info, nil
+}
+
+// Stat describes the file or directory name, following symbolic links.
+func (fs *FileSystem) Stat(name string) (*FileInfo, error) {
+	key, err := fs.Resolve("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	if err := fs.access("stat", name, key, 0); err != nil {
+		return nil, err
+	}
+	if fs.isSharedRoot(key) {
+		return &FileInfo{Name: path.Base(key), IsDir: true, Links: 1, key: key}, nil
+	}
+
+	object, err := fs.Backend.Stat(key)
+	if err != nil {
+		return nil, err
+	}
+	return fs.fileInfo(path.Base(key), *object)
+}
+
+// ReadDir returns the entries of the directory name, sorted by name.
+// Symbolic links in it are not followed. The home directory also holds
+// the shared directory, if anything was shared with the user.
+func (fs *FileSystem) ReadDir(name string) ([]*FileInfo, error) {
+	key, err := fs.Resolve("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if err := fs.access("readdir", name, key, permRead); err != nil {
+		return nil, err
+	}
+	if fs.isSharedRoot(key) {
+		return fs.readSharedDir(key)
+	}
+
+	objects, err := fs.Backend.List(key)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]*FileInfo, 0, len(objects)+1)
+	for _, object := range objects {
+		entry, err := fs.fileInfo(path.Base(object.Name), object)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	if key == fs.home {
+		shared, err := fs.readSharedDir(path.Join(key, sharedDir))
+		if err != nil {
+			return nil, err
+		}
+		if len(shared) > 0 {
+			entries = append(entries, &FileInfo{Name: sharedDir, IsDir: true, Links: 1, key: path.Join(key, sharedDir)})
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries, nil
+}
+
+// readSharedDir lists the shared directory, which holds a directory per
+// user who shared something, or one of those directories.
+func (fs *FileSystem) readSharedDir(key string) ([]*FileInfo, error) {
+	items, err := fs.SharedWithMe()
+	if err != nil {
+		return nil, err
+	}
+
+	dir := strings.TrimPrefix(strings.TrimPrefix(key, fs.home), "/")
+	seen := make(map[string]bool)
+	var entries []*FileInfo
+	for _, item := range items {
+		if !strings.HasPrefix(item.Path, dir+"/") {
+			continue
+		}
+		rest := strings.TrimPrefix(item.Path, dir+"/")
+
+		if i := strings.Index(rest, "/"); i >= 0 {
+			// An owner's directory
+			owner := rest[:i]
+			if !seen[owner] {
+				seen[owner] = true
+				entries = append(entries, &FileInfo{Name: owner, IsDir: true, Links: 1, key: path.Join(key, owner)})
+			}
+			continue
+		}
+
+		object, err := fs.Backend.Stat(item.Key)
+		if err != nil {
+			continue
+		}
+		entry, err := fs.fileInfo(rest, *object)
+		if err != nil {
+			return nil, err
+		}
+		entry.Shared = item.Level
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// Walk calls fn for name and everything below it, parents before children,
+// with names joined to name. Symbolic links are not followed, and
+// directories the user cannot read are passed to fn but not entered. If
+// fn returns filepath.SkipDir for a directory, its entries are skipped.
+func (fs *FileSystem) Walk(name string, fn func(name string, info *FileInfo) error) error {
+	info, err := fs.Stat(name)
+	if err != nil {
+		return err
+	}
+	return fs.walk(name, info, fn)
+}
+
+func (fs *FileSystem) walk(name string, info *FileInfo, fn func(name string, info *FileInfo) error) error {
+	if err := fn(name, info); err == filepath.SkipDir {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !info.IsDir {
+		return nil
+	}
+
+	entries, err := fs.ReadDir(name)
+	if errors.Is(err, os.ErrPermission) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := fs.walk(path.Join(name, entry.Name), entry, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Mkdir creates the directory name. Its parent must exist.
+func (fs *FileSystem) Mkdir(name string) error {
+	key, err := fs.Resolve("mkdir", name)
+	if err != nil {
+		return err
+	}
+	return fs.mkdirKey("mkdir", name, key)
+}
+
+func (fs *FileSystem) mkdirKey(op, name, key string) error {
+	unlock := fs.locks.Lock(key)
+	defer unlock()
+
+	if err := fs.accessParent(op, name, key); err != nil {
+		return err
+	}
+	if err := fs.Backend.Mkdir(key); err != nil {
+		return err
+	}
+	return fs.setOwner(key, 0755)
+}
+
+// MkdirAll creates the directory name along with any directories above it
+// that do not exist yet. It does nothing if name is already a directory.
+func (fs *FileSystem) MkdirAll(name string) error {
+	key, err := fs.Resolve("mkdir", name)
+	if err != nil {
+		return err
+	}
+	if info, err := fs.Backend.Stat(key); err == nil {
+		if !info.IsDir {
+			return &os.PathError{Op: "mkdir", Path: name, Err: fmt.Errorf("not a directory")}
+		}
+		return nil
+	}
+
+	for _, dir := range missingDirs(fs.Backend, key) {
+		if err := fs.mkdirKey("mkdir", name, dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveAll permanently removes name and everything below it, along with
+// the version history and metadata of every file removed. A symbolic link
+// is removed, not what it points to. It does nothing if name does not
+// exist.
+func (fs *FileSystem) RemoveAll(name string) error {
+	key, err := fs.lresolve("remove", name)
+	if err != nil {
+		return err
+	}
+	if key == fs.home {
+		return &PermissionError{Op: "remove", Path: name, Reason: "cannot remove your home directory"}
+	}
+	if err := fs.accessParent("remove", name, key); err != nil {
+		return err
+	}
+
+	// Every directory emptied must be writable.
+	err = walkBackend(fs.Backend, key, func(info ObjectInfo) error {
+		if !info.IsDir {
+			return nil
+		}
+		rel := path.Join(name, strings.TrimPrefix(info.Name, key))
+		return fs.access("remove", rel, info.Name, permWrite|permExec)
+	})
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	files, err := fs.filesBelow(key)
+	if err != nil {
+		return err
+	}
+	intent := &Intent{Op: intentDelete, Key: key, Files: files}
+	if err := fs.intents.Begin(intent); err != nil {
+		return err
+	}
+	if err := fs.removeKey(key); err != nil {
+		return err
+	}
+	return fs.intents.Done(intent)
+}
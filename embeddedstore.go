@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EmbeddedStore is a MetadataStore that needs no database server. All
+// records are kept in memory and every change is appended as one JSON line
+// to a log file, which is replayed when the store is opened.
+type EmbeddedStore struct {
+	mutex    sync.RWMutex
+	path     string
+	log      *os.File
+	users    map[string]User
+	metadata map[string]FileMetadata
+	files    map[string]*VFileMetadata
+	records  map[string]map[string]json.RawMessage
+}
+
+// embeddedRecord is one line of the log.
+type embeddedRecord struct {
+	Op       string        `json:"op"`
+	Filename string        `json:"filename,omitempty"`
+	User     *User         `json:"user,omitempty"`
+	Metadata *FileMetadata `json:"metadata,omitempty"`
+	Version  *Version      `json:"version,omitempty"`
+	Number   int           `json:"number,omitempty"`
+	Target   string        `json:"target,omitempty"`
+
+	Collection string          `json:"collection,omitempty"`
+	Key        string          `json:"key,omitempty"`
+	Value      json.RawMessage `json:"value,omitempty"`
+	Delta      int64           `json:"delta,omitempty"`
+
+	// Values holds the records of a put_records, with null for those
+	// deleted.
+	Values map[string]json.RawMessage `json:"values,omitempty"`
+
+	Time time.Time `json:"time"`
+}
+
+// OpenEmbeddedStore opens the log at path, creating it if needed.
+func OpenEmbeddedStore(path string) (*EmbeddedStore, error) {
+	s := &EmbeddedStore{
+		path:     path,
+		users:    make(map[string]User),
+		metadata: make(map[string]FileMetadata),
+		files:    make(map[string]*VFileMetadata),
+		records:  make(map[string]map[string]json.RawMessage),
+	}
+
+	if err := s.replay(); err != nil {
+		return nil, err
+	}
+
+	log, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	s.log = log
+
+	return s, nil
+}
+
+// replay applies the records of the log. A torn final record, which is
+// what a crash mid-append leaves, is cut off so the next record starts on
+// a line of its own; an unreadable record anywhere else is an error.
+func (s *EmbeddedStore) replay() error {
+	file, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var good int64 // end of the last record applied
+	line := 0
+	var torn error
+	for {
+		data, err := reader.ReadBytes('\n')
+		if len(data) > 0 && torn != nil {
+			return fmt.Errorf("corrupt record at %s:%d: %v", s.path, line, torn)
+		}
+		if err == io.EOF {
+			if len(data) > 0 {
+				line++
+				torn = fmt.Errorf("incomplete line")
+			}
+			break
+		} else if err != nil {
+			return err
+		}
+
+		line++
+		var record embeddedRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			torn = err
+			continue
+		}
+		s.apply(record)
+		good += int64(len(data))
+	}
+
+	if torn != nil {
+		log.Printf("Discarding torn record at %s:%d: %v", s.path, line, torn)
+		return os.Truncate(s.path, good)
+	}
+	return nil
+}
+
+// apply updates the in-memory state. Callers must hold the write lock.
+func (s *EmbeddedStore) apply(record embeddedRecord) {
+	switch record.Op {
+	case "insert_user":
+		s.users[record.User.Username] = *record.User
+	case "save_metadata":
+		s.metadata[record.Metadata.Filename] = *record.Metadata
+	case "update_metadata":
+		if file, ok := s.metadata[record.Metadata.Filename]; ok {
+			file.FileSize = record.Metadata.FileSize
+			file.Checksum = record.Metadata.Checksum
+			file.Timestamp = record.Metadata.Timestamp
+			file.Tags = record.Metadata.Tags
+			file.Attributes = record.Metadata.Attributes
+			s.metadata[file.Filename] = file
+		}
+	case "delete_metadata":
+		delete(s.metadata, record.Filename)
+	case "append_version":
+		file, ok := s.files[record.Filename]
+		if !ok {
+			file = &VFileMetadata{Filename: record.Filename, CreatedAt: record.Time}
+			s.files[record.Filename] = file
+		}
+		// Keep versions sorted even when they were appended out of order.
+		i := len(file.Versions)
+		for i > 0 && file.Versions[i-1].Version > record.Version.Version {
+			i--
+		}
+		file.Versions = append(file.Versions, Version{})
+		copy(file.Versions[i+1:], file.Versions[i:])
+		file.Versions[i] = *record.Version
+		file.UpdatedAt = record.Time
+	case "remove_version":
+		if file, ok := s.files[record.Filename]; ok {
+			var versions []Version
+			for _, version := range file.Versions {
+				if version.Version != record.Number {
+					versions = append(versions, version)
+				}
+			}
+			file.Versions = versions
+			file.UpdatedAt = record.Time
+		}
+	case "rename_history":
+		if file, ok := s.files[record.Filename]; ok {
+			delete(s.files, record.Filename)
+			file.Filename = record.Target
+			file.UpdatedAt = record.Time
+			s.files[record.Target] = file
+		}
+	case "put_record":
+		s.collection(record.Collection)[record.Key] = record.Value
+	case "delete_record":
+		delete(s.collection(record.Collection), record.Key)
+	case "put_records":
+		records := s.collection(record.Collection)
+		for key, value := range record.Values {
+			if string(value) == "null" {
+				delete(records, key)
+			} else {
+				records[key] = value
+			}
+		}
+	case "increment":
+		records := s.collection(record.Collection)
+		var value int64
+		json.Unmarshal(records[record.Key], &value)
+		value += record.Delta
+		records[record.Key], _ = json.Marshal(value)
+	}
+}
+
+func (s *EmbeddedStore) collection(name string) map[string]json.RawMessage {
+	records, ok := s.records[name]
+	if !ok {
+		records = make(map[string]json.RawMessage)
+		s.records[name] = records
+	}
+	return records
+}
+
+// write appends record to the log and applies it. Callers must hold the
+// write lock.
+func (s *EmbeddedStore) write(record embeddedRecord) error {
+	record.Time = time.Now().UTC()
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err := s.log.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if err := s.log.Sync(); err != nil {
+		return err
+	}
+
+	s.apply(record)
+	return nil
+}
+
+func (s *EmbeddedStore) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.log.Close()
+}
+
+func (s *EmbeddedStore) InsertUser(user User) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.write(embeddedRecord{Op: "insert_user", User: &user})
+}
+
+func (s *EmbeddedStore) FindUser(username string) (*User, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	user, ok := s.users[username]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &user, nil
+}
+
+func (s *EmbeddedStore) ListUsers() ([]User, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	users := make([]User, 0, len(s.users))
+	for _, user := range s.users {
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	return users, nil
+}
+
+func (s *EmbeddedStore) SaveFileMetadata(file *FileMetadata) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.write(embeddedRecord{Op: "save_metadata", Metadata: file})
+}
+
+func (s *EmbeddedStore) UpdateFileMetadata(file *FileMetadata) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.write(embeddedRecord{Op: "update_metadata", Metadata: file})
+}
+
+func (s *EmbeddedStore) DeleteFileMetadata(filename string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.write(embeddedRecord{Op: "delete_metadata", Filename: filename})
+}
+
+func (s *EmbeddedStore) GetFileMetadata(filename string) (*FileMetadata, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	file, ok := s.metadata[filename]
+	if !ok {
+		return nil, nil
+	}
+	return &file, nil
+}
+
+func (s *EmbeddedStore) ListFileMetadata(prefix string) ([]FileMetadata, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var files []FileMetadata
+	for filename, file := range s.metadata {
+		if strings.HasPrefix(filename, prefix) {
+			files = append(files, file)
+		}
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].Filename < files[j].Filename })
+	return files, nil
+}
+
+func (s *EmbeddedStore) GetVersions(filename string) ([]Version, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	file, ok := s.files[filename]
+	if !ok {
+		return nil, nil
+	}
+	versions := make([]Version, len(file.Versions))
+	copy(versions, file.Versions)
+	return versions, nil
+}
+
+func (s *EmbeddedStore) LatestVersion(filename string) (int, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	file, ok := s.files[filename]
+	if !ok || len(file.Versions) == 0 {
+		return 0, nil
+	}
+	return file.Versions[len(file.Versions)-1].Version, nil
+}
+
+func (s *EmbeddedStore) AppendVersion(filename string, version Version) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.write(embeddedRecord{Op: "append_version", Filename: filename, Version: &version})
+}
+
+func (s *EmbeddedStore) RemoveVersion(filename string, version int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.write(embeddedRecord{Op: "remove_version", Filename: filename, Number: version})
+}
+
+func (s *EmbeddedStore) ListHistories(prefix string) ([]string, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var filenames []string
+	for filename, file := range s.files {
+		if strings.HasPrefix(filename, prefix) && len(file.Versions) > 0 {
+			filenames = append(filenames, filename)
+		}
+	}
+
+	sort.Strings(filenames)
+	return filenames, nil
+}
+
+func (s *EmbeddedStore) RenameHistory(oldName, newName string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.write(embeddedRecord{Op: "rename_history", Filename: oldName, Target: newName})
+}
+
+func (s *EmbeddedStore) PutRecord(collection, key string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.write(embeddedRecord{Op: "put_record", Collection: collection, Key: key, Value: data})
+}
+
+func (s *EmbeddedStore) GetRecord(collection, key string, value interface{}) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	data, ok := s.records[collection][key]
+	if !ok {
+		return ErrNotFound
+	}
+	return json.Unmarshal(data, value)
+}
+
+func (s *EmbeddedStore) DeleteRecord(collection, key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.records[collection][key]; !ok {
+		return nil
+	}
+	return s.write(embeddedRecord{Op: "delete_record", Collection: collection, Key: key})
+}
+
+func (s *EmbeddedStore) PutRecords(collection string, records map[string]interface{}) error {
+	if len(records) == 0 {
+		return nil
+	}
+	values := make(map[string]json.RawMessage, len(records))
+	for key, value := range records {
+		data, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		values[key] = data
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// One line, so the records change together.
+	return s.write(embeddedRecord{Op: "put_records", Collection: collection, Values: values})
+}
+
+func (s *EmbeddedStore) ListRecords(collection, prefix string) ([]string, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var keys []string
+	for key := range s.records[collection] {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (s *EmbeddedStore) Increment(collection, key string, delta int64) (int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.write(embeddedRecord{Op: "increment", Collection: collection, Key: key, Delta: delta}); err != nil {
+		return 0, err
+	}
+
+	var value int64
+	err := json.Unmarshal(s.records[collection][key], &value)
+	return value, err
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEmbeddedStoreTornTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metadata.log")
+	store, err := OpenEmbeddedStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.PutRecord("test", "a", 1); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	// A crash mid-append leaves part of a record.
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"op":"put_record","collec`)
+	file.Close()
+
+	store, err = OpenEmbeddedStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.PutRecord("test", "b", 2); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	store, err = OpenEmbeddedStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	for key, want := range map[string]int{"a": 1, "b": 2} {
+		var value int
+		if err := store.GetRecord("test", key, &value); err != nil || value != want {
+			t.Errorf("record %s: got %d, %v, want %d", key, value, err, want)
+		}
+	}
+}
+
+func TestEmbeddedStoreCorruptRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metadata.log")
+	store, err := OpenEmbeddedStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.PutRecord("test", "a", 1); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	// An unreadable record followed by a good one is not a torn tail.
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupt := append([]byte("garbage\n"), data...)
+	if err := os.WriteFile(path, append(data, corrupt...), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := OpenEmbeddedStore(path); err == nil {
+		t.Error("a corrupt record in the middle of the log was ignored")
+	}
+}
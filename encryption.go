@@ -5,12 +5,28 @@ import (
 	"crypto/cipher"
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/binary"
 	"fmt"
 	"io"
 )
 
 const encryptionKey = "mySecretKey12345"
 
+// Streams are encrypted in segments so that neither side has to hold the
+// whole file. A stream starts with a random nonce prefix; every segment is
+// a 4-byte length followed by the sealed segment, whose nonce is the prefix
+// plus the segment number. The last segment is sealed with different
+// additional data so a truncated stream is detected.
+const (
+	streamSegmentSize = 64 * 1024
+	streamPrefixSize  = 8
+)
+
+var (
+	segmentMore = []byte{0}
+	segmentLast = []byte{1}
+)
+
 func Encrypt(data []byte) ([]byte, error) {
 	block, err := aes.NewCipher([]byte(encryptionKey))
 	if err != nil {
@@ -63,3 +79,146 @@ func Base64Encode(data []byte) string {
 func Base64Decode(str string) ([]byte, error) {
 	return base64.StdEncoding.DecodeString(str)
 }
+
+func newStreamCipher() (cipher.AEAD, error) {
+	block, err := aes.NewCipher([]byte(encryptionKey))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func segmentNonce(prefix []byte, counter uint32) []byte {
+	nonce := make([]byte, streamPrefixSize+4)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[streamPrefixSize:], counter)
+	return nonce
+}
+
+type encryptWriter struct {
+	w       io.Writer
+	gcm     cipher.AEAD
+	prefix  []byte
+	counter uint32
+	buf     []byte
+}
+
+// NewEncryptWriter returns a writer that encrypts everything written to it
+// into w. It must be closed to write the final segment; closing it does not
+// close w.
+func NewEncryptWriter(w io.Writer) (io.WriteCloser, error) {
+	gcm, err := newStreamCipher()
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := make([]byte, streamPrefixSize)
+	if _, err := io.ReadFull(rand.Reader, prefix); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(prefix); err != nil {
+		return nil, err
+	}
+
+	return &encryptWriter{w: w, gcm: gcm, prefix: prefix}, nil
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	e.buf = append(e.buf, p...)
+	// Keep at least one full segment back: only Close knows which one is
+	// the last.
+	for len(e.buf) > streamSegmentSize {
+		if err := e.seal(e.buf[:streamSegmentSize], segmentMore); err != nil {
+			return 0, err
+		}
+		e.buf = e.buf[streamSegmentSize:]
+	}
+	return len(p), nil
+}
+
+func (e *encryptWriter) Close() error {
+	return e.seal(e.buf, segmentLast)
+}
+
+func (e *encryptWriter) seal(segment, additionalData []byte) error {
+	sealed := e.gcm.Seal(nil, segmentNonce(e.prefix, e.counter), segment, additionalData)
+	e.counter++
+
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(sealed)))
+	if _, err := e.w.Write(length[:]); err != nil {
+		return err
+	}
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+type decryptReader struct {
+	r       io.Reader
+	gcm     cipher.AEAD
+	prefix  []byte
+	counter uint32
+	buf     []byte
+	done    bool
+}
+
+// NewDecryptReader returns a reader that decrypts a stream written by
+// NewEncryptWriter.
+func NewDecryptReader(r io.Reader) (io.Reader, error) {
+	gcm, err := newStreamCipher()
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := make([]byte, streamPrefixSize)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, fmt.Errorf("invalid ciphertext")
+	}
+
+	return &decryptReader{r: r, gcm: gcm, prefix: prefix}, nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+func (d *decryptReader) open() error {
+	var length [4]byte
+	if _, err := io.ReadFull(d.r, length[:]); err != nil {
+		return fmt.Errorf("invalid ciphertext: truncated stream")
+	}
+
+	size := binary.BigEndian.Uint32(length[:])
+	if size > streamSegmentSize+uint32(d.gcm.Overhead()) {
+		return fmt.Errorf("invalid ciphertext: segment too large")
+	}
+	sealed := make([]byte, size)
+	if _, err := io.ReadFull(d.r, sealed); err != nil {
+		return fmt.Errorf("invalid ciphertext: truncated stream")
+	}
+
+	nonce := segmentNonce(d.prefix, d.counter)
+	plaintext, err := d.gcm.Open(nil, nonce, sealed, segmentMore)
+	if err != nil {
+		plaintext, err = d.gcm.Open(nil, nonce, sealed, segmentLast)
+		if err != nil {
+			return err
+		}
+		d.done = true
+	}
+	d.counter++
+
+	d.buf = plaintext
+	return nil
+}
@@ -1,54 +1,185 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sync"
+	"time"
 )
 
 type FileSystem struct {
-	BaseDir    string
+	BaseDir    string // Current directory, below the storage root
+	Backend    StorageBackend
 	Versioning *Versioning // Added Versioning field
+
+	// TrashRetention is how long deleted files stay in the trash,
+	// DefaultTrashRetention if zero.
+	TrashRetention time.Duration
+
+	// IndexHistory makes search index every version of a file, not only
+	// its current contents.
+	IndexHistory bool
+
+	root     string
+	home     string // backend key of the sandbox, "" for the whole backend
+	cwd      string // backend key of BaseDir
+	intents  *IntentLog
+	locks    *pathLocks
+	indexing *sync.Mutex // serializes changes to the search index
+	db       *Database
+	user     string   // user operations are checked against, "" for none
+	groups   []string // groups user is a member of
 }
 
-func NewFileSystem(baseDir string, versioning *Versioning) *FileSystem {
+// NewFileSystem creates a FileSystem rooted at baseDir. File contents are
+// read and written through backend, whose keys are relative to baseDir.
+//
+// File operations may be called from several goroutines: each one locks the
+// file it works on, for reading or for writing. The current and home
+// directories are per session and must not be changed concurrently.
+func NewFileSystem(baseDir string, backend StorageBackend, versioning *Versioning) *FileSystem {
 	return &FileSystem{
 		BaseDir:    baseDir,
+		Backend:    backend,
 		Versioning: versioning, // Set the provided versioning object
+		root:       baseDir,
+		intents:    NewIntentLog(versioning.store),
+		locks:      newPathLocks(),
+		indexing:   &sync.Mutex{},
+		db:         NewDatabase(versioning.store),
 	}
 }
 
-// UpdateBaseDir updates the base directory of the FileSystem.
-func (fs *FileSystem) UpdateBaseDir(newBaseDir string) {
-	fs.BaseDir = newBaseDir
+// SetHome confines the FileSystem to the directory home, relative to the
+// storage root, and makes it the current directory. An empty home lifts
+// the confinement.
+func (fs *FileSystem) SetHome(home string) {
+	fs.home = cleanKey(home)
+	fs.cwd = fs.home
+	fs.BaseDir = filepath.Join(fs.root, filepath.FromSlash(fs.cwd))
 }
 
-func (fs *FileSystem) CreateFile(filename string, data []byte) error {
-	filePath := filepath.Join(fs.BaseDir, filename)
-
-	// Check if the file already exists
-	if _, err := os.Stat(filePath); !os.IsNotExist(err) {
-		//return errors.New("file already exists")
+// Chdir changes the current directory. dir is resolved like any other name.
+// Directories shared by other users are entered through the shared
+// directory, which stays part of the current directory.
+func (fs *FileSystem) Chdir(dir string) error {
+	virtual, err := resolvePath(fs.Backend, "chdir", fs.home, fs.cwd, dir)
+	if err != nil {
+		return err
 	}
+	key, err := fs.Resolve("chdir", dir)
+	if err != nil {
+		return err
+	}
+	if fs.isSharedRoot(key) {
+		fs.setCwd(key)
+		return nil
+	}
+	if err := fs.access("chdir", dir, key, permExec); err != nil {
+		return err
+	}
+	if err := fs.chdirKey(key); err != nil {
+		return err
+	}
+	if !withinKey(key, fs.home) {
+		fs.setCwd(virtual)
+	}
+	return nil
+}
 
-	err := ioutil.WriteFile(filePath, data, 0644)
+// UpdateBaseDir updates the base directory of the FileSystem.
+func (fs *FileSystem) UpdateBaseDir(newBaseDir string) error {
+	rel, err := filepath.Rel(fs.root, newBaseDir)
 	if err != nil {
 		return err
 	}
+	key, err := resolvePath(fs.Backend, "chdir", fs.home, "", rel)
+	if err != nil {
+		return err
+	}
+	return fs.chdirKey(key)
+}
 
-	// Perform versioning operation
-	err = fs.Versioning.AddVersion(filename, data)
+func (fs *FileSystem) chdirKey(key string) error {
+	info, err := fs.Backend.Stat(key)
 	if err != nil {
-		fmt.Println("Error adding version:", err)
+		return err
+	}
+	if !info.IsDir {
+		return &os.PathError{Op: "chdir", Path: key, Err: fmt.Errorf("not a directory")}
 	}
 
+	fs.setCwd(key)
 	return nil
 }
 
+func (fs *FileSystem) setCwd(key string) {
+	fs.cwd = key
+	fs.BaseDir = filepath.Join(fs.root, filepath.FromSlash(key))
+}
+
+// Resolve returns the backend key for name. Relative names start at the
+// current directory and absolute names at the home directory; a
+// *PermissionError is returned for anything that would leave the home
+// directory. Version history is recorded under the same key.
+//
+// Symbolic links are followed, a file with hard links resolves to the key
+// its contents are kept under, and names in the shared directory resolve
+// to the items other users shared.
+func (fs *FileSystem) Resolve(op, name string) (string, error) {
+	key, err := resolvePath(fs.Backend, op, fs.home, fs.cwd, name)
+	if err != nil {
+		return "", err
+	}
+	if key, err = fs.resolveShared(op, name, key); err != nil {
+		return "", err
+	}
+	if key, err = fs.followSymlinks(op, name, key, true); err != nil {
+		return "", err
+	}
+	return fs.contentKey(key)
+}
+
+func (fs *FileSystem) CreateFile(filename string, data []byte) error {
+	key, err := fs.Resolve("create", filename)
+	if err != nil {
+		return err
+	}
+
+	unlock := fs.locks.Lock(key)
+	defer unlock()
+
+	if err := fs.accessWrite("create", filename, key); err != nil {
+		return err
+	}
+	if err := fs.checkWriteQuota("create", filename, key, int64(len(data))); err != nil {
+		return err
+	}
+
+	// Check if the file already exists
+	if _, err := fs.Backend.Stat(key); err == nil {
+		//return errors.New("file already exists")
+	}
+
+	_, err = fs.writeFile(key, data)
+	return err
+}
+
 func (fs *FileSystem) ReadFile(name string) ([]byte, error) {
-	path := filepath.Join(fs.BaseDir, name)
-	content, err := ioutil.ReadFile(path)
+	key, err := fs.Resolve("read", name)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := fs.access("read", name, key, permRead); err != nil {
+		return nil, err
+	}
+
+	unlock := fs.locks.RLock(key)
+	content, err := fs.Backend.Get(key)
+	unlock()
 	if err != nil {
 		return nil, err
 	}
@@ -57,21 +188,23 @@ func (fs *FileSystem) ReadFile(name string) ([]byte, error) {
 }
 
 func (fs *FileSystem) UpdateFile(name string, content []byte) error {
-
-	path := filepath.Join(fs.BaseDir, name)
-	err := ioutil.WriteFile(path, content, 0644)
+	key, err := fs.Resolve("update", name)
 	if err != nil {
 		return err
 	}
 
-	latestVersion, err := fs.Versioning.GetLatestVersion(name)
-	if err != nil {
+	unlock := fs.locks.Lock(key)
+	defer unlock()
+
+	if err := fs.accessWrite("update", name, key); err != nil {
+		return err
+	}
+	if err := fs.checkWriteQuota("update", name, key, int64(len(content))); err != nil {
 		return err
 	}
-	newVersion := latestVersion + 1
 
-	// Add the new version to the versioning system
-	err = fs.Versioning.AddVersion(name, content)
+	// Write the file and add the new version to the versioning system
+	newVersion, err := fs.writeFile(key, content)
 	if err != nil {
 		return err
 	}
@@ -80,12 +213,82 @@ func (fs *FileSystem) UpdateFile(name string, content []byte) error {
 	return nil
 }
 
+// DeleteFile moves a file, link or directory to the trash of the user
+// whose home directory it is in. A link is deleted, not what it points to.
 func (fs *FileSystem) DeleteFile(name string) error {
-	path := filepath.Join(fs.BaseDir, name)
-	err := os.Remove(path)
+	key, err := fs.lresolve("delete", name)
 	if err != nil {
 		return err
 	}
+	if err := fs.accessParent("delete", name, key); err != nil {
+		return err
+	}
+	if key == fs.home {
+		return &PermissionError{Op: "delete", Path: name, Reason: "cannot delete your home directory"}
+	}
+
+	if err := fs.trash(key); err != nil {
+		return err
+	}
+
 	fmt.Printf("Deleted file: %s\n", name)
 	return nil
 }
+
+// writeFile replaces the contents of key and records them as a new
+// version, whose number it returns. The contents go into the blob store
+// first and an intent naming them is recorded, so if the process dies
+// before both storage and history are updated, Recover can finish the job.
+// The caller must hold the write lock on key.
+func (fs *FileSystem) writeFile(key string, data []byte) (int, error) {
+	baseVersion, err := fs.Versioning.GetLatestVersion(key)
+	if err != nil {
+		return 0, err
+	}
+	before, err := fs.Backend.Stat(key)
+	created := os.IsNotExist(err)
+	if err != nil && !created {
+		return 0, err
+	}
+
+	version, err := fs.Versioning.PrepareVersion(bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+
+	intent := &Intent{
+		Op:          intentWrite,
+		Key:         key,
+		BaseVersion: baseVersion,
+		Chunks:      version.Chunks,
+		Size:        version.Size,
+	}
+	if err := fs.intents.Begin(intent); err != nil {
+		fs.Versioning.AbortVersion(version)
+		return 0, err
+	}
+
+	if err := fs.Backend.Put(key, data); err != nil {
+		fs.Versioning.AbortVersion(version)
+		fs.intents.Done(intent)
+		return 0, err
+	}
+
+	// From here on the intent is only removed once history has caught up
+	// with storage; if that fails, Recover will retry it.
+	if err := fs.commitVersion(key, version, before); err != nil {
+		return 0, fmt.Errorf("file written but version not recorded: %v", err)
+	}
+	if err := fs.intents.Done(intent); err != nil {
+		return 0, err
+	}
+
+	// The write is complete; a new file without an owner of its own
+	// belongs to whoever's home directory it is in.
+	if created {
+		if err := fs.setOwner(key, 0644); err != nil {
+			return 0, err
+		}
+	}
+	return version.Version, nil
+}
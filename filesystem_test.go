@@ -0,0 +1,196 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// newTestFileSystem returns a FileSystem on a MemoryBackend and an
+// EmbeddedStore, logged in as a user "al" with an empty home directory.
+func newTestFileSystem(t *testing.T) *FileSystem {
+	t.Helper()
+
+	store, err := OpenEmbeddedStore(filepath.Join(t.TempDir(), "metadata.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	backend := NewMemoryBackend()
+	versioning := NewVersioning(store, NewBlobStore(backend, store))
+	fs := NewFileSystem(t.TempDir(), backend, versioning)
+
+	if err := NewAuthService(store, backend).Signup("al", "secret", "USER"); err != nil {
+		t.Fatal(err)
+	}
+	fs.SetHome("al")
+	fs.SetUser("al", nil)
+	return fs
+}
+
+// checkVersions fails unless key has exactly one history, numbered 1 to n
+// without gaps or repeats.
+func checkVersions(t *testing.T, fs *FileSystem, key string, n int) {
+	t.Helper()
+
+	histories, err := fs.Versioning.ListHistories(path.Dir(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for _, history := range histories {
+		if history == key {
+			count++
+		}
+	}
+	if count != 1 {
+		t.Errorf("%s has %d histories, want 1", key, count)
+	}
+
+	versions, err := fs.Versioning.GetAllVersions(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != n {
+		t.Errorf("%s has %d versions, want %d", key, len(versions), n)
+	}
+	for i, version := range versions {
+		if version.Version != i+1 {
+			t.Errorf("%s: version %d is numbered %d", key, i+1, version.Version)
+		}
+	}
+}
+
+func TestConcurrentWritesToOneFile(t *testing.T) {
+	fs := newTestFileSystem(t)
+	const writers = 20
+
+	if err := fs.CreateFile("a.txt", []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			data := []byte(fmt.Sprintf("writer %d", i))
+			var err error
+			if i%2 == 0 {
+				err = fs.UpdateFile("a.txt", data)
+			} else {
+				err = fs.CreateFile("a.txt", data)
+			}
+			if err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	checkVersions(t, fs, "al/a.txt", writers+1)
+
+	// Only one of the deletes finds the file.
+	errs := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- fs.DeleteFile("a.txt")
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	deleted := 0
+	for err := range errs {
+		if err == nil {
+			deleted++
+		} else if !os.IsNotExist(err) {
+			t.Error(err)
+		}
+	}
+	if deleted != 1 {
+		t.Fatalf("file deleted %d times, want 1", deleted)
+	}
+
+	items, err := fs.TrashItems()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 {
+		t.Fatalf("trash has %d items, want 1", len(items))
+	}
+	checkVersions(t, fs, items[0].key(), writers+1)
+}
+
+func TestConcurrentWritesToManyFiles(t *testing.T) {
+	fs := newTestFileSystem(t)
+	const files, updates = 10, 5
+
+	var wg sync.WaitGroup
+	for i := 0; i < files; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprintf("file%d.txt", i)
+			if err := fs.CreateFile(name, []byte(name)); err != nil {
+				t.Error(err)
+				return
+			}
+			for j := 0; j < updates; j++ {
+				if err := fs.UpdateFile(name, []byte(fmt.Sprintf("%s %d", name, j))); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+			if i%2 == 1 {
+				if err := fs.DeleteFile(name); err != nil {
+					t.Error(err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < files; i += 2 {
+		checkVersions(t, fs, fmt.Sprintf("al/file%d.txt", i), updates+1)
+	}
+
+	items, err := fs.TrashItems()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != files/2 {
+		t.Fatalf("trash has %d items, want %d", len(items), files/2)
+	}
+	for _, item := range items {
+		checkVersions(t, fs, item.key(), updates+1)
+	}
+}
+
+func TestPermissionsWithoutUser(t *testing.T) {
+	fs := newTestFileSystem(t)
+	if err := fs.CreateFile("secret.txt", []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Chmod("secret.txt", 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	fs.SetHome("")
+	fs.SetUser("", nil)
+	if _, err := fs.ReadFile("al/secret.txt"); !errors.Is(err, os.ErrPermission) {
+		t.Errorf("read without a user: got %v, want permission denied", err)
+	}
+
+	fs.SetUser(MaintenanceUser, nil)
+	if data, err := fs.ReadFile("al/secret.txt"); err != nil || string(data) != "secret" {
+		t.Errorf("read as maintenance: got %q, %v", data, err)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"container/heap"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// Query selects files and directories for Find. Zero fields match
+// everything.
+type Query struct {
+	Root string // where to search, the current directory if empty
+
+	Name  string // shell pattern matched against the base name
+	Regex string // regular expression matched against the whole path
+	Type  string // "file", "dir" or "link"
+
+	MinSize int64 // in bytes, inclusive
+	MaxSize int64 // in bytes, inclusive; 0 for no limit
+
+	ModifiedAfter  time.Time
+	ModifiedBefore time.Time
+
+	Tag          string // files with this tag
+	VersionsOver int    // files with more than this many versions
+	Contains     string // files whose contents contain this text
+
+	SortBy  string // "name" (the default), "size", "time" or "versions"
+	Reverse bool
+	Limit   int // at most this many results, 0 for all
+}
+
+// FindResult is a file or directory that matched a Query.
+type FindResult struct {
+	Path     string // joined to the query's root
+	Info     *FileInfo
+	Versions int // only counted when filtering or sorting by versions
+}
+
+var errFindDone = errors.New("find: limit reached")
+
+// Find returns what matches query, below and including its root. Symbolic
+// links are not followed and directories the user cannot read are not
+// searched.
+//
+// Results in name order come in the order the tree is walked, so a limit
+// stops the walk early. Otherwise only the best Limit results are kept
+// while walking, so memory stays bounded on large trees.
+func (fs *FileSystem) Find(query Query) ([]FindResult, error) {
+	root := query.Root
+	if root == "" {
+		root = "."
+	}
+
+	var pattern *regexp.Regexp
+	if query.Regex != "" {
+		var err error
+		if pattern, err = regexp.Compile(query.Regex); err != nil {
+			return nil, fmt.Errorf("invalid regular expression: %v", err)
+		}
+	}
+	if _, err := path.Match(query.Name, ""); err != nil {
+		return nil, fmt.Errorf("invalid name pattern: %v", err)
+	}
+
+	var less func(a, b *FindResult) bool
+	switch query.SortBy {
+	case "", "name":
+	case "size":
+		less = func(a, b *FindResult) bool { return a.Info.Size < b.Info.Size }
+	case "time":
+		less = func(a, b *FindResult) bool { return a.Info.ModTime.Before(b.Info.ModTime) }
+	case "versions":
+		less = func(a, b *FindResult) bool { return a.Versions < b.Versions }
+	default:
+		return nil, fmt.Errorf("cannot sort by '%s'", query.SortBy)
+	}
+	countVersions := query.VersionsOver > 0 || query.SortBy == "versions"
+
+	results := &findResults{limit: query.Limit, reverse: query.Reverse, less: less}
+	err := fs.Walk(root, func(name string, info *FileInfo) error {
+		ok, versions, err := fs.matches(&query, pattern, name, info, countVersions)
+		if err != nil || !ok {
+			return err
+		}
+		if results.add(FindResult{Path: name, Info: info, Versions: versions}) {
+			return errFindDone
+		}
+		return nil
+	})
+	if err != nil && err != errFindDone {
+		return nil, err
+	}
+	return results.sorted(), nil
+}
+
+// matches reports whether info matches query, along with the number of
+// versions of the file if countVersions is set. Cheap checks go first.
+func (fs *FileSystem) matches(query *Query, pattern *regexp.Regexp, name string, info *FileInfo, countVersions bool) (bool, int, error) {
+	switch query.Type {
+	case "file":
+		if info.IsDir || info.Link != "" {
+			return false, 0, nil
+		}
+	case "dir":
+		if !info.IsDir {
+			return false, 0, nil
+		}
+	case "link":
+		if info.Link == "" {
+			return false, 0, nil
+		}
+	}
+
+	if query.Name != "" {
+		if ok, _ := path.Match(query.Name, info.Name); !ok {
+			return false, 0, nil
+		}
+	}
+	if pattern != nil && !pattern.MatchString(name) {
+		return false, 0, nil
+	}
+	if info.Size < query.MinSize || query.MaxSize > 0 && info.Size > query.MaxSize {
+		return false, 0, nil
+	}
+	if !query.ModifiedAfter.IsZero() && !info.ModTime.After(query.ModifiedAfter) {
+		return false, 0, nil
+	}
+	if !query.ModifiedBefore.IsZero() && !info.ModTime.Before(query.ModifiedBefore) {
+		return false, 0, nil
+	}
+
+	// The rest only applies to files, and needs the metadata store.
+	needsFile := query.Tag != "" || query.VersionsOver > 0 || query.Contains != ""
+	if info.IsDir || info.Link != "" {
+		return !needsFile, 0, nil
+	}
+	key, err := fs.contentKey(info.key)
+	if err != nil {
+		return false, 0, err
+	}
+
+	if query.Tag != "" {
+		if ok, err := fs.HasTag(key, query.Tag); err != nil || !ok {
+			return false, 0, err
+		}
+	}
+
+	versions := 0
+	if countVersions {
+		all, err := fs.Versioning.GetAllVersions(key)
+		if err != nil {
+			return false, 0, err
+		}
+		versions = len(all)
+		if versions <= query.VersionsOver {
+			return false, 0, nil
+		}
+	}
+
+	if query.Contains != "" {
+		if fs.access("find", name, key, permRead) != nil {
+			return false, 0, nil
+		}
+		unlock := fs.locks.RLock(key)
+		data, err := fs.Backend.Get(key)
+		unlock()
+		if err != nil {
+			return false, 0, err
+		}
+		if !bytes.Contains(data, []byte(query.Contains)) {
+			return false, 0, nil
+		}
+	}
+	return true, versions, nil
+}
+
+// findResults collects results. Without an order, results are kept as
+// they come; with one and a limit, a heap holds the best results so far
+// with the worst on top.
+type findResults struct {
+	results []FindResult
+	limit   int
+	reverse bool
+	less    func(a, b *FindResult) bool
+}
+
+// add adds a result and reports whether no more are needed.
+func (r *findResults) add(result FindResult) bool {
+	if r.less == nil {
+		r.results = append(r.results, result)
+		if r.limit > 0 && len(r.results) > r.limit {
+			// In reverse the last results are wanted.
+			r.results = r.results[1:]
+		}
+		return r.limit > 0 && len(r.results) >= r.limit && !r.reverse
+	}
+	if r.limit <= 0 {
+		r.results = append(r.results, result)
+		return false
+	}
+
+	heap.Push(r, result)
+	if r.Len() > r.limit {
+		heap.Pop(r)
+	}
+	return false
+}
+
+// better reports whether a comes before b in the requested order. Ties go
+// by path.
+func (r *findResults) better(a, b *FindResult) bool {
+	if r.less(a, b) {
+		return !r.reverse
+	}
+	if r.less(b, a) {
+		return r.reverse
+	}
+	return a.Path < b.Path
+}
+
+func (r *findResults) sorted() []FindResult {
+	if r.less == nil {
+		if r.reverse {
+			for i, j := 0, len(r.results)-1; i < j; i, j = i+1, j-1 {
+				r.results[i], r.results[j] = r.results[j], r.results[i]
+			}
+		}
+		return r.results
+	}
+	sort.Slice(r.results, func(i, j int) bool { return r.better(&r.results[i], &r.results[j]) })
+	return r.results
+}
+
+// heap.Interface, with the worst result on top.
+func (r *findResults) Len() int           { return len(r.results) }
+func (r *findResults) Less(i, j int) bool { return r.better(&r.results[j], &r.results[i]) }
+func (r *findResults) Swap(i, j int)      { r.results[i], r.results[j] = r.results[j], r.results[i] }
+func (r *findResults) Push(x interface{}) { r.results = append(r.results, x.(FindResult)) }
+func (r *findResults) Pop() interface{} {
+	last := r.results[len(r.results)-1]
+	r.results = r.results[:len(r.results)-1]
+	return last
+}
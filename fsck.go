@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"time"
+)
+
+// Categories of inconsistency Fsck reports.
+const (
+	FsckMissingFile       = "missing-file"       // a history, but nothing in storage
+	FsckContentMismatch   = "content-mismatch"   // storage differs from the latest version
+	FsckUnreadableVersion = "unreadable-version" // the latest version's contents are gone
+	FsckNoHistory         = "no-history"         // a file with metadata but no versions
+	FsckOrphan            = "orphan"             // a file with neither versions nor metadata
+	FsckMissingMetadata   = "missing-metadata"
+	FsckMetadataMismatch  = "metadata-mismatch" // size or checksum differ from storage
+	FsckStaleMetadata     = "stale-metadata"    // metadata of a file that does not exist
+	FsckUsageMismatch     = "usage-mismatch"    // a user's usage counters differ from what they keep
+)
+
+// errIntentPending is why Fsck does not fix a file an interrupted
+// operation is pending on.
+var errIntentPending = errors.New("an interrupted operation is pending, recover it first")
+
+// quarantinePrefix holds what Fsck moved out of the way, below a directory
+// per run.
+const quarantinePrefix = ".quarantine"
+
+// FsckIssue is one inconsistency Fsck found.
+type FsckIssue struct {
+	Category string
+	Key      string
+	Detail   string
+	Fixed    bool
+	FixError error // why fixing it failed, if it was tried
+}
+
+// FsckReport is what Fsck found.
+type FsckReport struct {
+	Files      int // files checked
+	Issues     []FsckIssue
+	Quarantine string // where files were quarantined, if any were
+}
+
+// Fixed returns how many issues were fixed.
+func (r *FsckReport) Fixed() int {
+	fixed := 0
+	for _, issue := range r.Issues {
+		if issue.Fixed {
+			fixed++
+		}
+	}
+	return fixed
+}
+
+// fsck is one run of Fsck.
+type fsck struct {
+	fs         *FileSystem
+	fix        bool
+	report     *FsckReport
+	quarantine string
+	pending    bool // an interrupted operation is pending on the key checked
+}
+
+// Fsck checks every file in storage, in the metadata store and in version
+// history against the others, for every user. With fix set it also
+// repairs what it can:
+//
+//   - a missing file is recreated from its latest version;
+//   - a file that differs from its latest version is restored from it,
+//     after its contents are copied to the quarantine;
+//   - a file with metadata but no history gets its contents recorded as
+//     its first version;
+//   - an orphan, with neither, is moved to the quarantine;
+//   - metadata that is missing or wrong is recomputed from storage, and
+//     metadata of files that no longer exist is removed;
+//   - usage counters that differ from what a user keeps are recounted.
+//
+// Interrupted operations should be recovered first, or they are reported
+// too; the files they touch are not fixed, since their storage may be ahead
+// of their history.
+func (fs *FileSystem) Fsck(fix bool) (*FsckReport, error) {
+	check := &fsck{
+		fs:         fs,
+		fix:        fix,
+		report:     &FsckReport{},
+		quarantine: path.Join(quarantinePrefix, time.Now().UTC().Format("20060102-150405")),
+	}
+
+	keys := make(map[string]bool)
+	top, err := fs.Backend.List("")
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range top {
+		if entry.Name == blobPrefix || entry.Name == quarantinePrefix {
+			continue
+		}
+		err := walkBackend(fs.Backend, entry.Name, func(info ObjectInfo) error {
+			if !info.IsDir {
+				keys[info.Name] = true
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	histories, err := fs.Versioning.ListHistories("")
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range histories {
+		keys[key] = true
+	}
+	files, err := fs.db.ListFileMetadata("")
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		keys[file.Filename] = true
+	}
+
+	sorted := make([]string, 0, len(keys))
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+	for _, key := range sorted {
+		if err := check.key(key); err != nil {
+			return check.report, fmt.Errorf("checking %s: %v", key, err)
+		}
+	}
+
+	// Usage goes last, to count what the fixes left.
+	for _, entry := range top {
+		if !entry.IsDir || isReservedKey(entry.Name) {
+			continue
+		}
+		if err := check.checkUsage(entry.Name); err != nil {
+			return check.report, fmt.Errorf("checking the usage of %s: %v", entry.Name, err)
+		}
+	}
+	return check.report, nil
+}
+
+// add records an issue and, if fixing, tries to fix it with fn.
+func (c *fsck) add(category, key, detail string, fn func() error) {
+	issue := FsckIssue{Category: category, Key: key, Detail: detail}
+	if c.fix && fn != nil && c.pending {
+		issue.FixError = errIntentPending
+	} else if c.fix && fn != nil {
+		issue.FixError = fn()
+		issue.Fixed = issue.FixError == nil
+	}
+	c.report.Issues = append(c.report.Issues, issue)
+}
+
+func (c *fsck) key(key string) error {
+	fs := c.fs
+	// Symbolic links and the other names of hard linked files have no
+	// contents of their own.
+	if _, ok, err := fs.readlinkKey(key); err != nil || ok {
+		return err
+	}
+	if content, err := fs.contentKey(key); err != nil || content != key {
+		return err
+	}
+
+	unlock := fs.locks.Lock(key)
+	defer unlock()
+
+	pending, err := fs.intents.PendingOn(key)
+	if err != nil {
+		return err
+	}
+	c.pending = pending
+	defer func() { c.pending = false }()
+
+	info, err := fs.Backend.Stat(key)
+	if err == nil && info.IsDir {
+		// Directories can have tags and attributes, but nothing to check.
+		return nil
+	} else if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	exists := err == nil
+	if exists {
+		c.report.Files++
+	}
+
+	versions, err := fs.Versioning.GetAllVersions(key)
+	if err != nil {
+		return err
+	}
+	if len(versions) > 0 {
+		if exists, err = c.checkContents(key, exists, &versions[len(versions)-1]); err != nil {
+			return err
+		}
+	} else if exists {
+		if exists, err = c.checkNoHistory(key); err != nil {
+			return err
+		}
+	}
+	return c.checkMetadata(key, exists)
+}
+
+// checkContents compares the file at key with its latest version, and
+// returns whether the file exists after any fix.
+func (c *fsck) checkContents(key string, exists bool, latest *Version) (bool, error) {
+	fs := c.fs
+	want, err := fs.Versioning.ReadVersion(latest)
+	if err != nil {
+		c.add(FsckUnreadableVersion, key, fmt.Sprintf("version %d: %v", latest.Version, err), nil)
+		return exists, nil
+	}
+
+	if !exists {
+		c.add(FsckMissingFile, key, fmt.Sprintf("latest is version %d", latest.Version), func() error {
+			if err := mkdirAllBackend(fs.Backend, path.Dir(key)); err != nil {
+				return err
+			}
+			return fs.Backend.Put(key, want)
+		})
+		_, err := fs.Backend.Stat(key)
+		return err == nil, nil
+	}
+
+	data, err := fs.Backend.Get(key)
+	if err != nil {
+		return true, err
+	}
+	if latest.Checksum != "" && checksum(data) == latest.Checksum || latest.Checksum == "" && bytes.Equal(data, want) {
+		return true, nil
+	}
+	detail := fmt.Sprintf("%d bytes in storage, %d in version %d", len(data), len(want), latest.Version)
+	c.add(FsckContentMismatch, key, detail, func() error {
+		if err := c.quarantinePut(key, data); err != nil {
+			return err
+		}
+		return fs.Backend.Put(key, want)
+	})
+	return true, nil
+}
+
+// checkNoHistory handles a file without versions, and returns whether its
+// metadata is to be checked against storage.
+func (c *fsck) checkNoHistory(key string) (bool, error) {
+	fs := c.fs
+	file, err := fs.db.GetFileMetadata(key)
+	if err != nil {
+		return true, err
+	}
+	if file != nil {
+		c.add(FsckNoHistory, key, "", func() error {
+			info, err := fs.Backend.Stat(key)
+			if err != nil {
+				return err
+			}
+			data, err := fs.Backend.Get(key)
+			if err != nil {
+				return err
+			}
+			// The file was there all along; only its history is new.
+			return fs.addVersionFrom(key, bytes.NewReader(data), info)
+		})
+		return true, nil
+	}
+
+	c.add(FsckOrphan, key, "", func() error {
+		if err := mkdirAllBackend(fs.Backend, path.Dir(path.Join(c.quarantine, key))); err != nil {
+			return err
+		}
+		if err := renameBackend(fs.Backend, key, path.Join(c.quarantine, key)); err != nil {
+			return err
+		}
+		c.report.Quarantine = c.quarantine
+		return fs.unindexKey(key)
+	})
+	// An orphan has no metadata to check.
+	return false, nil
+}
+
+// checkMetadata compares the metadata of key with what is in storage.
+func (c *fsck) checkMetadata(key string, exists bool) error {
+	fs := c.fs
+	file, err := fs.db.GetFileMetadata(key)
+	if err != nil {
+		return err
+	}
+
+	if !exists {
+		if file != nil {
+			versions, err := fs.Versioning.GetLatestVersion(key)
+			if err != nil || versions > 0 {
+				// Kept for when the file is recreated.
+				return err
+			}
+			c.add(FsckStaleMetadata, key, "", func() error {
+				return fs.db.DeleteFileMetadata(key)
+			})
+		}
+		return nil
+	}
+
+	if file == nil {
+		c.add(FsckMissingMetadata, key, "", func() error {
+			return fs.syncMetadata(&FileMetadata{Filename: key})
+		})
+		return nil
+	}
+	data, err := fs.Backend.Get(key)
+	if err != nil {
+		return err
+	}
+	if file.FileSize == int64(len(data)) && file.Checksum == checksum(data) {
+		return nil
+	}
+	detail := fmt.Sprintf("recorded %d bytes, %d in storage", file.FileSize, len(data))
+	if file.Checksum == "" {
+		detail = "no checksum recorded"
+	}
+	c.add(FsckMetadataMismatch, key, detail, func() error {
+		return fs.syncMetadata(file)
+	})
+	return nil
+}
+
+// checkUsage compares the usage counters of user with what they keep.
+func (c *fsck) checkUsage(user string) error {
+	fs := c.fs
+	stored, counted, err := fs.storedUsage(user)
+	if err != nil || !counted {
+		// Never counted, so nothing to be wrong.
+		return err
+	}
+	usage, err := fs.countUsage(user)
+	if err != nil || *usage == *stored {
+		return err
+	}
+
+	detail := fmt.Sprintf("recorded %d bytes, %d of history and %d files; found %d, %d and %d",
+		stored.Bytes, stored.HistoryBytes, stored.Files, usage.Bytes, usage.HistoryBytes, usage.Files)
+	c.add(FsckUsageMismatch, user, detail, func() error {
+		_, err := fs.RecomputeUsage(user)
+		return err
+	})
+	return nil
+}
+
+// quarantinePut keeps a copy of data, which was stored at key.
+func (c *fsck) quarantinePut(key string, data []byte) error {
+	target := path.Join(c.quarantine, key)
+	if err := mkdirAllBackend(c.fs.Backend, path.Dir(target)); err != nil {
+		return err
+	}
+	c.report.Quarantine = c.quarantine
+	return c.fs.Backend.Put(target, data)
+}
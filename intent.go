@@ -0,0 +1,298 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"time"
+)
+
+// intentRecords is the record collection holding pending intents.
+const intentRecords = "intents"
+
+const (
+	intentWrite       = "write"
+	intentDelete      = "delete"
+	intentTransaction = "transaction"
+	intentRename      = "rename"
+	intentLink        = "link"
+)
+
+// Intent describes a FileSystem operation that touches both storage and
+// version history. It is recorded before either is changed and removed
+// once both are, so an operation cut short by a crash can be finished, or
+// undone, by Recover.
+type Intent struct {
+	ID  string `bson:"id"`
+	Op  string `bson:"op"`
+	Key string `bson:"key"`
+
+	// BaseVersion is the latest version of Key when the operation began. A
+	// later version means the operation got as far as recording it.
+	BaseVersion int `bson:"base_version"`
+
+	// Chunks holds the new contents of a write, already in the blob store.
+	// Streamed writes go to storage first and have no chunks.
+	Chunks   []Chunk `bson:"chunks,omitempty"`
+	Size     int64   `bson:"size"`
+	Streamed bool    `bson:"streamed,omitempty"`
+
+	// Target is where a rename moves Key to, or the inode a file gets
+	// when it is first linked. Files are the files a rename moves, or a
+	// delete removes, relative to Key.
+	Target string   `bson:"target,omitempty"`
+	Files  []string `bson:"files,omitempty"`
+
+	// Ops holds the writes and deletes of a transaction, which are
+	// recovered together.
+	Ops []Intent `bson:"ops,omitempty"`
+
+	Time time.Time `bson:"time"`
+}
+
+// IntentLog keeps intents in the metadata store.
+type IntentLog struct {
+	store MetadataStore
+}
+
+func NewIntentLog(store MetadataStore) *IntentLog {
+	return &IntentLog{store: store}
+}
+
+// Begin records an intent and assigns its ID.
+func (l *IntentLog) Begin(intent *Intent) error {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+
+	intent.Time = time.Now().UTC()
+	// IDs sort in the order the intents were recorded.
+	intent.ID = intent.Time.Format("20060102T150405.000000000") + "-" + hex.EncodeToString(suffix)
+
+	return l.store.PutRecord(intentRecords, intent.ID, intent)
+}
+
+// Done removes a finished intent.
+func (l *IntentLog) Done(intent *Intent) error {
+	return l.store.DeleteRecord(intentRecords, intent.ID)
+}
+
+// Pending returns every intent that has not been finished, oldest first.
+func (l *IntentLog) Pending() ([]Intent, error) {
+	ids, err := l.store.ListRecords(intentRecords, "")
+	if err != nil {
+		return nil, err
+	}
+
+	var intents []Intent
+	for _, id := range ids {
+		var intent Intent
+		if err := l.store.GetRecord(intentRecords, id, &intent); err != nil {
+			return nil, err
+		}
+		intents = append(intents, intent)
+	}
+	return intents, nil
+}
+
+// PendingOn reports whether an unfinished operation touches key. Until it
+// is recovered, what is stored for key may be ahead of its history.
+func (l *IntentLog) PendingOn(key string) (bool, error) {
+	intents, err := l.Pending()
+	if err != nil {
+		return false, err
+	}
+	for i := range intents {
+		keys := intents[i].keys()
+		if intents[i].Target != "" {
+			keys = append(keys, intents[i].Target)
+		}
+		for _, k := range keys {
+			if withinKey(key, k) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// Recover finishes or undoes every operation that was interrupted, and
+// returns how many there were. It should run before the FileSystem is used.
+func (fs *FileSystem) Recover() (int, error) {
+	intents, err := fs.intents.Pending()
+	if err != nil {
+		return 0, err
+	}
+
+	for i := range intents {
+		intent := &intents[i]
+		if err := fs.recoverIntent(intent); err != nil {
+			return i, fmt.Errorf("failed to recover %s of '%s': %v", intent.Op, intent.Key, err)
+		}
+		if local, ok := fs.Backend.(*LocalBackend); ok {
+			for _, key := range intent.keys() {
+				if err := local.removeTempFiles(path.Dir(key)); err != nil {
+					return i, err
+				}
+			}
+		}
+		if err := fs.intents.Done(intent); err != nil {
+			return i, err
+		}
+	}
+
+	return len(intents), nil
+}
+
+// keys returns every key the intent touches.
+func (intent *Intent) keys() []string {
+	switch intent.Op {
+	case intentRename:
+		return []string{intent.Key, intent.Target}
+	case intentTransaction:
+		keys := make([]string, len(intent.Ops))
+		for i, op := range intent.Ops {
+			keys[i] = op.Key
+		}
+		return keys
+	default:
+		return []string{intent.Key}
+	}
+}
+
+func (fs *FileSystem) recoverIntent(intent *Intent) error {
+	switch intent.Op {
+	case intentTransaction:
+		// The intent is only recorded once every new version is in the
+		// blob store, so the whole transaction is rolled forward.
+		for i := range intent.Ops {
+			op := &intent.Ops[i]
+			op.Time = intent.Time
+			if err := fs.recoverIntent(op); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case intentRename:
+		// Roll forward: move whatever is still at the old name, then the
+		// histories that did not follow yet.
+		if _, err := fs.Backend.Stat(intent.Key); err == nil {
+			if err := renameBackend(fs.Backend, intent.Key, intent.Target); err != nil {
+				return err
+			}
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		return fs.moveHistories(intent)
+
+	case intentLink:
+		return fs.makeInode(intent.Key, path.Base(intent.Target))
+
+	case intentDelete:
+		// Roll forward: everything was going away anyway.
+		if err := fs.removeKey(intent.Key); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		for _, file := range intent.Files {
+			if err := fs.forget(path.Join(intent.Key, file)); err != nil {
+				return err
+			}
+		}
+		return fs.db.DeleteFileMetadata(intent.Key)
+
+	case intentWrite:
+		latest, err := fs.Versioning.GetLatestVersion(intent.Key)
+		if err != nil {
+			return err
+		}
+		if latest > intent.BaseVersion {
+			// Storage was written before the version was recorded, so
+			// both are done.
+			return nil
+		}
+		if intent.Streamed {
+			return fs.recoverStreamedWrite(intent)
+		}
+		return fs.recoverWrite(intent)
+
+	default:
+		return fmt.Errorf("unknown operation")
+	}
+}
+
+// recoverWrite rolls a write forward from the contents saved in the
+// intent. If those can no longer be read the write is rolled back instead;
+// storage was replaced atomically, so it holds either the old contents or
+// the new ones.
+func (fs *FileSystem) recoverWrite(intent *Intent) error {
+	version := &Version{
+		Chunks:       intent.Chunks,
+		Size:         intent.Size,
+		CreatedTime:  intent.Time,
+		ModifiedTime: intent.Time,
+	}
+
+	r, err := fs.Versioning.OpenVersion(version)
+	if err != nil {
+		fs.Versioning.AbortVersion(version)
+		return nil
+	}
+	defer r.Close()
+
+	w, err := createBackendWriter(fs.Backend, intent.Key)
+	if err != nil {
+		return err
+	}
+	if _, err := copyAndClose(w, r); err != nil {
+		fs.Versioning.AbortVersion(version)
+		return nil
+	}
+
+	before, err := fs.statBefore(intent)
+	if err != nil {
+		return err
+	}
+	return fs.commitVersion(intent.Key, version, before)
+}
+
+// recoverStreamedWrite records whatever a streamed write left in storage as
+// the new version: the new contents if the write landed, otherwise the old
+// ones again. Either way history ends up matching storage. If there is
+// nothing in storage, the write never happened.
+func (fs *FileSystem) recoverStreamedWrite(intent *Intent) error {
+	r, err := openBackendReader(fs.Backend, intent.Key)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	before, err := fs.statBefore(intent)
+	if err != nil {
+		return err
+	}
+	return fs.addVersionFrom(intent.Key, r, before)
+}
+
+// statBefore describes the file an interrupted write replaced, from the
+// version it was based on, or returns nil if the write created the file.
+func (fs *FileSystem) statBefore(intent *Intent) (*ObjectInfo, error) {
+	if intent.BaseVersion == 0 {
+		return nil, nil
+	}
+	versions, err := fs.Versioning.GetAllVersions(intent.Key)
+	if err != nil {
+		return nil, err
+	}
+	for _, version := range versions {
+		if version.Version == intent.BaseVersion {
+			return &ObjectInfo{Name: intent.Key, Size: version.Size}, nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"path"
+	"time"
+)
+
+// IOFS exposes a directory of a FileSystem as an io/fs file system, so it
+// can be handed to http.FS, template.ParseFS, fs.WalkDir and friends.
+// Names are resolved below the directory the IOFS was created for and
+// fs.ValidPath rejects anything that would climb out of it.
+//
+// If version is non-zero, files are served as they were at that version
+// and files without such a version do not exist. Permissions are checked
+// for the user of the FileSystem, as for its own methods.
+type IOFS struct {
+	vfs     *FileSystem
+	root    string
+	version int
+}
+
+var (
+	_ fs.FS         = (*IOFS)(nil)
+	_ fs.StatFS     = (*IOFS)(nil)
+	_ fs.ReadDirFS  = (*IOFS)(nil)
+	_ fs.ReadFileFS = (*IOFS)(nil)
+	_ fs.SubFS      = (*IOFS)(nil)
+)
+
+// DirFS returns an io/fs view of dir, resolved like any other name. The
+// user's home directory is usually the right choice for dir.
+func (fs *FileSystem) DirFS(dir string) (*IOFS, error) {
+	root, err := fs.Resolve("open", dir)
+	if err != nil {
+		return nil, err
+	}
+	return &IOFS{vfs: fs, root: root}, nil
+}
+
+// AtVersion returns a view of the same directory in which every file reads
+// as its given version.
+func (f *IOFS) AtVersion(version int) *IOFS {
+	return &IOFS{vfs: f.vfs, root: f.root, version: version}
+}
+
+// key resolves name below the root like Resolve does: symbolic links are
+// followed and a file with hard links resolves to the key its contents
+// are kept under.
+func (f *IOFS) key(op, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	key, err := resolvePath(f.vfs.Backend, op, f.root, f.root, name)
+	if err != nil {
+		return "", err
+	}
+	if key, err = f.vfs.resolveShared(op, name, key); err != nil {
+		return "", err
+	}
+	return f.follow(op, name, key)
+}
+
+// follow returns the key holding the contents of the entry at key.
+func (f *IOFS) follow(op, name, key string) (string, error) {
+	key, err := f.vfs.followSymlinks(op, name, key, true)
+	if err != nil {
+		return "", err
+	}
+	return f.vfs.contentKey(key)
+}
+
+func (f *IOFS) Open(name string) (fs.File, error) {
+	key, err := f.key("open", name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: unwrapPathError(err)}
+	}
+	if err := f.vfs.access("open", name, key, permRead); err != nil {
+		return nil, err
+	}
+
+	unlock := f.vfs.locks.RLock(key)
+	defer unlock()
+
+	info, err := f.stat("open", name, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.IsDir() {
+		entries, err := f.readDir("open", name, key)
+		if err != nil {
+			return nil, err
+		}
+		return &ioDir{info: info, entries: entries}, nil
+	}
+
+	data, err := f.readFile("open", name, key)
+	if err != nil {
+		return nil, err
+	}
+	return &ioFile{info: info, reader: bytes.NewReader(data)}, nil
+}
+
+func (f *IOFS) Stat(name string) (fs.FileInfo, error) {
+	key, err := f.key("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.vfs.access("stat", name, key, 0); err != nil {
+		return nil, err
+	}
+	return f.stat("stat", name, key)
+}
+
+func (f *IOFS) stat(op, name, key string) (*ioFileInfo, error) {
+	object, err := f.vfs.Backend.Stat(key)
+	if err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: unwrapPathError(err)}
+	}
+	info := newIOFileInfo(*object)
+	// key may be a link target or an inode.
+	info.name = path.Base(name)
+
+	if f.version != 0 && !object.IsDir {
+		version, err := f.findVersion(key)
+		if err != nil {
+			return nil, &fs.PathError{Op: op, Path: name, Err: err}
+		}
+		info.size = version.Len()
+		info.modTime = version.ModifiedTime
+	}
+
+	return info, nil
+}
+
+func (f *IOFS) ReadFile(name string) ([]byte, error) {
+	key, err := f.key("read", name)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.vfs.access("read", name, key, permRead); err != nil {
+		return nil, err
+	}
+
+	unlock := f.vfs.locks.RLock(key)
+	defer unlock()
+	return f.readFile("read", name, key)
+}
+
+func (f *IOFS) readFile(op, name, key string) ([]byte, error) {
+	if f.version != 0 {
+		version, err := f.findVersion(key)
+		if err != nil {
+			return nil, &fs.PathError{Op: op, Path: name, Err: err}
+		}
+		return f.vfs.Versioning.ReadVersion(version)
+	}
+
+	data, err := f.vfs.Backend.Get(key)
+	if err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: unwrapPathError(err)}
+	}
+	return data, nil
+}
+
+func (f *IOFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	key, err := f.key("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.vfs.access("readdir", name, key, permRead); err != nil {
+		return nil, err
+	}
+
+	unlock := f.vfs.locks.RLock(key)
+	defer unlock()
+	return f.readDir("readdir", name, key)
+}
+
+// readDir lists the directory at key. Entries that are links are
+// described by what they point to; a dangling symbolic link is described
+// as itself.
+func (f *IOFS) readDir(op, name, key string) ([]fs.DirEntry, error) {
+	objects, err := f.vfs.Backend.List(key)
+	if err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: unwrapPathError(err)}
+	}
+
+	entries := make([]fs.DirEntry, 0, len(objects))
+	for _, object := range objects {
+		entry := path.Base(object.Name)
+		if target, err := f.follow(op, name, object.Name); err == nil && target != object.Name {
+			if resolved, err := f.vfs.Backend.Stat(target); err == nil {
+				object = *resolved
+				object.Name = target
+			}
+		}
+		info := newIOFileInfo(object)
+		info.name = entry
+		if f.version != 0 && !object.IsDir {
+			version, err := f.findVersion(object.Name)
+			if err != nil {
+				continue
+			}
+			info.size = version.Len()
+			info.modTime = version.ModifiedTime
+		}
+		entries = append(entries, fs.FileInfoToDirEntry(info))
+	}
+	return entries, nil
+}
+
+func (f *IOFS) Sub(dir string) (fs.FS, error) {
+	key, err := f.key("sub", dir)
+	if err != nil {
+		return nil, err
+	}
+	return &IOFS{vfs: f.vfs, root: key, version: f.version}, nil
+}
+
+// findVersion returns the version of the file at key the IOFS serves. key
+// must be resolved, so that hard links find the history of their inode.
+func (f *IOFS) findVersion(key string) (*Version, error) {
+	versions, err := f.vfs.Versioning.GetAllVersions(key)
+	if err != nil {
+		return nil, err
+	}
+	for i := range versions {
+		if versions[i].Version == f.version {
+			return &versions[i], nil
+		}
+	}
+	return nil, fs.ErrNotExist
+}
+
+// unwrapPathError strips a backend's own PathError so the io/fs error
+// reports the name the caller used.
+func unwrapPathError(err error) error {
+	if pathErr, ok := err.(*fs.PathError); ok {
+		return pathErr.Err
+	}
+	return err
+}
+
+type ioFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	isDir   bool
+}
+
+func newIOFileInfo(object ObjectInfo) *ioFileInfo {
+	name := path.Base(object.Name)
+	if object.Name == "" {
+		name = "."
+	}
+	return &ioFileInfo{
+		name:    name,
+		size:    object.Size,
+		modTime: object.ModTime,
+		isDir:   object.IsDir,
+	}
+}
+
+func (i *ioFileInfo) Name() string       { return i.name }
+func (i *ioFileInfo) Size() int64        { return i.size }
+func (i *ioFileInfo) ModTime() time.Time { return i.modTime }
+func (i *ioFileInfo) IsDir() bool        { return i.isDir }
+func (i *ioFileInfo) Sys() interface{}   { return nil }
+
+func (i *ioFileInfo) Mode() fs.FileMode {
+	if i.isDir {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
+
+type ioFile struct {
+	info   fs.FileInfo
+	reader *bytes.Reader
+}
+
+func (f *ioFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *ioFile) Read(p []byte) (int, error) { return f.reader.Read(p) }
+func (f *ioFile) Close() error               { return nil }
+
+func (f *ioFile) Seek(offset int64, whence int) (int64, error) {
+	return f.reader.Seek(offset, whence)
+}
+
+func (f *ioFile) ReadAt(p []byte, offset int64) (int, error) {
+	return f.reader.ReadAt(p, offset)
+}
+
+type ioDir struct {
+	info    fs.FileInfo
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *ioDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *ioDir) Close() error               { return nil }
+
+func (d *ioDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.Name(), Err: fs.ErrInvalid}
+}
+
+func (d *ioDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	remaining := d.entries[d.offset:]
+	if n <= 0 {
+		d.offset = len(d.entries)
+		return remaining, nil
+	}
+	if len(remaining) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(remaining) {
+		n = len(remaining)
+	}
+	d.offset += n
+	return remaining[:n], nil
+}
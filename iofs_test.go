@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+	"testing/fstest"
+)
+
+func TestIOFS(t *testing.T) {
+	fs := newTestFileSystem(t)
+
+	if err := fs.Mkdir("docs"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.CreateFile("a.txt", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.UpdateFile("a.txt", []byte("hello, world")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.CreateFile("docs/b.txt", []byte("inside")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Symlink("docs/b.txt", "link"); err != nil {
+		t.Fatal(err)
+	}
+
+	fsys, err := fs.DirFS("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fstest.TestFS(fsys, "a.txt", "docs", "docs/b.txt", "link"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fstest.TestFS(fsys.AtVersion(1), "a.txt", "docs/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+}
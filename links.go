@@ -0,0 +1,410 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// Links are kept in the metadata store. Every link name also has an entry
+// in storage so that it shows up in listings and moves with its directory:
+// a symbolic link's entry holds its target, a hard link's is empty.
+const (
+	symlinkRecords  = "symlinks"  // link key -> target, as given
+	hardlinkRecords = "hardlinks" // name key -> inode ID
+	inodeRecords    = "inodes"    // inode ID -> Inode
+
+	// inodePrefix is the backend directory holding the contents of files
+	// with hard links. Each such file is stored, and versioned, once.
+	inodePrefix = ".inodes"
+
+	maxSymlinkHops = 40
+)
+
+var errTooManyLinks = errors.New("too many levels of symbolic links")
+
+// Inode lists the names of a file that has hard links.
+type Inode struct {
+	Names []string `bson:"names"`
+}
+
+func inodeKey(id string) string {
+	return path.Join(inodePrefix, id)
+}
+
+// lresolve is Resolve without following a link in the last element of
+// name, for operations on the link itself.
+func (fs *FileSystem) lresolve(op, name string) (string, error) {
+	key, err := resolvePath(fs.Backend, op, fs.home, fs.cwd, name)
+	if err != nil {
+		return "", err
+	}
+	if key, err = fs.resolveShared(op, name, key); err != nil {
+		return "", err
+	}
+	return fs.followSymlinks(op, name, key, false)
+}
+
+// followSymlinks replaces every symbolic link along key with its target.
+// Targets are resolved like any other name, so they cannot leave the home
+// directory.
+func (fs *FileSystem) followSymlinks(op, name, key string, followLast bool) (string, error) {
+	for hops := 0; ; {
+		parts := strings.Split(key, "/")
+		followed := false
+		for i := range parts {
+			if i == len(parts)-1 && !followLast {
+				break
+			}
+			prefix := strings.Join(parts[:i+1], "/")
+			target, ok, err := fs.readlinkKey(prefix)
+			if err != nil {
+				return "", err
+			} else if !ok {
+				continue
+			}
+
+			hops++
+			if hops > maxSymlinkHops {
+				return "", &os.PathError{Op: op, Path: name, Err: errTooManyLinks}
+			}
+			resolved, err := resolvePath(fs.Backend, op, fs.home, path.Dir(prefix), target)
+			if err != nil {
+				return "", err
+			}
+			key = cleanKey(path.Join(resolved, strings.Join(parts[i+1:], "/")))
+			followed = true
+			break
+		}
+		if !followed {
+			return key, nil
+		}
+	}
+}
+
+// contentKey returns the key holding the contents of the file named key:
+// the inode for a file with hard links, key itself otherwise.
+func (fs *FileSystem) contentKey(key string) (string, error) {
+	var id string
+	err := fs.Versioning.store.GetRecord(hardlinkRecords, key, &id)
+	if err == ErrNotFound {
+		return key, nil
+	} else if err != nil {
+		return "", err
+	}
+	return inodeKey(id), nil
+}
+
+// Symlink creates a symbolic link at name pointing to target. Relative
+// targets are taken from the directory holding the link, absolute ones
+// from the home directory. The target does not need to exist.
+func (fs *FileSystem) Symlink(target, name string) error {
+	key, err := fs.lresolve("symlink", name)
+	if err != nil {
+		return err
+	}
+	if _, err := resolvePath(fs.Backend, "symlink", fs.home, path.Dir(key), target); err != nil {
+		return err
+	}
+	if err := fs.accessParent("symlink", name, key); err != nil {
+		return err
+	}
+
+	unlock := fs.locks.Lock(key)
+	defer unlock()
+
+	if _, err := fs.Backend.Stat(key); err == nil {
+		return &os.PathError{Op: "symlink", Path: name, Err: os.ErrExist}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	return fs.symlinkKey(target, key)
+}
+
+func (fs *FileSystem) symlinkKey(target, key string) error {
+	if err := fs.Versioning.store.PutRecord(symlinkRecords, key, target); err != nil {
+		return err
+	}
+	return fs.Backend.Put(key, []byte(target))
+}
+
+// Link gives the file existing a second name. Both names refer to the same
+// contents and version history, which stay until the last name is deleted.
+func (fs *FileSystem) Link(existing, name string) error {
+	// Symbolic links are followed, hard links are not: the new name joins
+	// the existing one.
+	oldKey, err := resolvePath(fs.Backend, "link", fs.home, fs.cwd, existing)
+	if err != nil {
+		return err
+	}
+	if oldKey, err = fs.followSymlinks("link", existing, oldKey, true); err != nil {
+		return err
+	}
+	newKey, err := fs.lresolve("link", name)
+	if err != nil {
+		return err
+	}
+	if err := fs.access("link", existing, oldKey, 0); err != nil {
+		return err
+	}
+	if err := fs.accessParent("link", name, newKey); err != nil {
+		return err
+	}
+
+	unlock := fs.locks.LockAll([]string{oldKey, newKey})
+	defer unlock()
+
+	info, err := fs.Backend.Stat(oldKey)
+	if err != nil {
+		return err
+	}
+	if info.IsDir {
+		return &os.PathError{Op: "link", Path: existing, Err: fmt.Errorf("cannot hard link a directory")}
+	}
+	if _, err := fs.Backend.Stat(newKey); err == nil {
+		return &os.PathError{Op: "link", Path: name, Err: os.ErrExist}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	id, inode, err := fs.inodeOf(oldKey)
+	if err != nil {
+		return err
+	}
+	if inode == nil {
+		// The file gets its first hard link: move its contents and history
+		// where all its names can share them.
+		suffix := make([]byte, 8)
+		if _, err := rand.Read(suffix); err != nil {
+			return err
+		}
+		id = hex.EncodeToString(suffix)
+		inode = &Inode{Names: []string{oldKey}}
+
+		intent := &Intent{Op: intentLink, Key: oldKey, Target: inodeKey(id)}
+		if err := fs.intents.Begin(intent); err != nil {
+			return err
+		}
+		if err := fs.makeInode(oldKey, id); err != nil {
+			return err
+		}
+		if err := fs.intents.Done(intent); err != nil {
+			return err
+		}
+	}
+
+	inode.Names = append(inode.Names, newKey)
+	if err := fs.Versioning.store.PutRecord(inodeRecords, id, inode); err != nil {
+		return err
+	}
+	if err := fs.Versioning.store.PutRecord(hardlinkRecords, newKey, id); err != nil {
+		return err
+	}
+	return fs.Backend.Put(newKey, nil)
+}
+
+// makeInode moves the contents, permissions, metadata and history of the
+// file at key under the inode id and leaves key as its first name. Every
+// step can be repeated, so Recover can run it again after a crash.
+func (fs *FileSystem) makeInode(key, id string) error {
+	inode := inodeKey(id)
+
+	if _, err := fs.Backend.Stat(inode); os.IsNotExist(err) {
+		if err := renameBackend(fs.Backend, key, inode); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	if latest, err := fs.Versioning.GetLatestVersion(key); err != nil {
+		return err
+	} else if latest > 0 {
+		if err := fs.Versioning.RekeyHistory(key, inode); err != nil {
+			return err
+		}
+	}
+
+	if err := fs.db.RenameFileMetadata(key, inode); err != nil {
+		return err
+	}
+	if err := fs.reindex(key, inode); err != nil {
+		return err
+	}
+	var perm Permissions
+	if err := fs.Versioning.store.GetRecord(permissionRecords, inode, &perm); err == ErrNotFound {
+		// Files without a record of their own would otherwise lose their
+		// owner along with their name.
+		current, err := fs.permissions(key, false)
+		if err != nil {
+			return err
+		}
+		if err := fs.Versioning.store.PutRecord(permissionRecords, inode, current); err != nil {
+			return err
+		}
+		if err := fs.Versioning.store.DeleteRecord(permissionRecords, key); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	if err := fs.Versioning.store.PutRecord(inodeRecords, id, &Inode{Names: []string{key}}); err != nil {
+		return err
+	}
+	if err := fs.Versioning.store.PutRecord(hardlinkRecords, key, id); err != nil {
+		return err
+	}
+	return fs.Backend.Put(key, nil)
+}
+
+// inodeOf returns the inode of the file named key, or a nil Inode if it has
+// no hard links.
+func (fs *FileSystem) inodeOf(key string) (string, *Inode, error) {
+	var id string
+	err := fs.Versioning.store.GetRecord(hardlinkRecords, key, &id)
+	if err == ErrNotFound {
+		return "", nil, nil
+	} else if err != nil {
+		return "", nil, err
+	}
+
+	var inode Inode
+	if err := fs.Versioning.store.GetRecord(inodeRecords, id, &inode); err != nil {
+		return "", nil, err
+	}
+	return id, &inode, nil
+}
+
+// Readlink returns the target of the symbolic link name.
+func (fs *FileSystem) Readlink(name string) (string, error) {
+	key, err := fs.lresolve("readlink", name)
+	if err != nil {
+		return "", err
+	}
+	target, ok, err := fs.readlinkKey(key)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", &os.PathError{Op: "readlink", Path: name, Err: fmt.Errorf("not a symbolic link")}
+	}
+	return target, nil
+}
+
+func (fs *FileSystem) readlinkKey(key string) (string, bool, error) {
+	var target string
+	err := fs.Versioning.store.GetRecord(symlinkRecords, key, &target)
+	if err == ErrNotFound {
+		return "", false, nil
+	}
+	return target, err == nil, err
+}
+
+// LinkCount returns the number of names of the file at key.
+func (fs *FileSystem) LinkCount(key string) (int, error) {
+	_, inode, err := fs.inodeOf(key)
+	if err != nil || inode == nil {
+		return 1, err
+	}
+	return len(inode.Names), nil
+}
+
+// unlink removes key if it is a link, and reports whether it was. The
+// contents of a file with hard links are only deleted with its last name.
+func (fs *FileSystem) unlink(key string) (bool, error) {
+	if _, ok, err := fs.readlinkKey(key); err != nil {
+		return false, err
+	} else if ok {
+		if err := fs.Backend.Delete(key); err != nil && !os.IsNotExist(err) {
+			return true, err
+		}
+		return true, fs.Versioning.store.DeleteRecord(symlinkRecords, key)
+	}
+
+	id, inode, err := fs.inodeOf(key)
+	if err != nil || inode == nil {
+		return false, err
+	}
+
+	unlock := fs.locks.Lock(inodeKey(id))
+	defer unlock()
+
+	var names []string
+	for _, name := range inode.Names {
+		if name != key {
+			names = append(names, name)
+		}
+	}
+	if err := fs.Backend.Delete(key); err != nil && !os.IsNotExist(err) {
+		return true, err
+	}
+	if err := fs.Versioning.store.DeleteRecord(hardlinkRecords, key); err != nil {
+		return true, err
+	}
+	if len(names) > 0 {
+		inode.Names = names
+		return true, fs.Versioning.store.PutRecord(inodeRecords, id, inode)
+	}
+
+	owner, err := fs.quotaOwner(inodeKey(id))
+	if err != nil {
+		return true, err
+	}
+	usage, err := fs.fileUsage(inodeKey(id))
+	if err != nil {
+		return true, err
+	}
+	if err := fs.Backend.Delete(inodeKey(id)); err != nil && !os.IsNotExist(err) {
+		return true, err
+	}
+	if err := fs.Versioning.DeleteHistory(inodeKey(id)); err != nil {
+		return true, err
+	}
+	if err := fs.unindexKey(inodeKey(id)); err != nil {
+		return true, err
+	}
+	if err := fs.db.DeleteFileMetadata(inodeKey(id)); err != nil {
+		return true, err
+	}
+	if err := fs.Versioning.store.DeleteRecord(permissionRecords, inodeKey(id)); err != nil {
+		return true, err
+	}
+	if err := fs.addUsage(owner, usage.negate()); err != nil {
+		return true, err
+	}
+	return true, fs.Versioning.store.DeleteRecord(inodeRecords, id)
+}
+
+// moveLinks moves the link records of from, if any, over to to.
+func (fs *FileSystem) moveLinks(from, to string) error {
+	if target, ok, err := fs.readlinkKey(from); err != nil {
+		return err
+	} else if ok {
+		if err := fs.Versioning.store.PutRecord(symlinkRecords, to, target); err != nil {
+			return err
+		}
+		return fs.Versioning.store.DeleteRecord(symlinkRecords, from)
+	}
+
+	id, inode, err := fs.inodeOf(from)
+	if err != nil || inode == nil {
+		return err
+	}
+	for i, name := range inode.Names {
+		if name == from {
+			inode.Names[i] = to
+		}
+	}
+	if err := fs.Versioning.store.PutRecord(inodeRecords, id, inode); err != nil {
+		return err
+	}
+	if err := fs.Versioning.store.PutRecord(hardlinkRecords, to, id); err != nil {
+		return err
+	}
+	return fs.Versioning.store.DeleteRecord(hardlinkRecords, from)
+}
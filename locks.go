@@ -0,0 +1,91 @@
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// pathLocks hands out a reader/writer lock per backend key. Locks are
+// created on first use and dropped again once nobody holds or waits for
+// them, so the table only ever holds keys that are in use.
+type pathLocks struct {
+	mutex sync.Mutex
+	locks map[string]*pathLock
+}
+
+type pathLock struct {
+	sync.RWMutex
+	refs int
+}
+
+func newPathLocks() *pathLocks {
+	return &pathLocks{locks: make(map[string]*pathLock)}
+}
+
+func (l *pathLocks) acquire(key string) *pathLock {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	lock, ok := l.locks[key]
+	if !ok {
+		lock = &pathLock{}
+		l.locks[key] = lock
+	}
+	lock.refs++
+	return lock
+}
+
+func (l *pathLocks) release(key string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	lock := l.locks[key]
+	lock.refs--
+	if lock.refs == 0 {
+		delete(l.locks, key)
+	}
+}
+
+// Lock locks key for writing and returns the function that unlocks it.
+func (l *pathLocks) Lock(key string) func() {
+	lock := l.acquire(key)
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		l.release(key)
+	}
+}
+
+// RLock locks key for reading and returns the function that unlocks it.
+func (l *pathLocks) RLock(key string) func() {
+	lock := l.acquire(key)
+	lock.RLock()
+	return func() {
+		lock.RUnlock()
+		l.release(key)
+	}
+}
+
+// LockAll locks several keys for writing. Keys are always taken in sorted
+// order so that two callers locking overlapping sets cannot deadlock.
+func (l *pathLocks) LockAll(keys []string) func() {
+	sorted := make([]string, 0, len(keys))
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		if !seen[key] {
+			seen[key] = true
+			sorted = append(sorted, key)
+		}
+	}
+	sort.Strings(sorted)
+
+	unlocks := make([]func(), len(sorted))
+	for i, key := range sorted {
+		unlocks[i] = l.Lock(key)
+	}
+	return func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
+		}
+	}
+}
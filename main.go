@@ -2,52 +2,112 @@ package main
 
 import (
 	"bufio"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 
 	//"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 	//"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 var currentUser string
 var isLoggedIn bool
 
+var imagePath = flag.String("image", "", "store all files in a single .vfs pack file instead of ./storageData")
+var storeKind = flag.String("store", "mongo", "metadata store to use: mongo or embedded")
+var mongoURI = flag.String("mongo-uri", "mongodb://localhost:27017", "MongoDB connection string for -store=mongo")
+var storePath = flag.String("store-path", "./vfs-metadata.log", "log file for -store=embedded")
+var trashRetention = flag.Duration("trash-retention", DefaultTrashRetention, "how long deleted files stay in the trash before they are purged")
+var scrubInterval = flag.Duration("scrub-interval", DefaultScrubInterval, "time between background scrubs of stored contents, 0 to only scrub on request")
+var scrubRate = flag.Int64("scrub-rate", 4<<20, "bytes per second a scrub may read, 0 for no limit")
+var scrubMirror = flag.String("scrub-mirror", "", "directory holding a copy of ./storageData to heal damaged contents from")
+var indexHistory = flag.Bool("index-history", false, "index every version of a file for search -history, not only its current contents")
+var admins = flag.String("admins", "", "comma-separated usernames that get the ADMIN role when they sign up")
+
 func main() {
-	currentDirectory, _ := os.Getwd()
-	storageDirectory := filepath.Join(currentDirectory, "storageData")
+	flag.Parse()
+
+	baseDir := "./storageData" // Update the base directory path as per your requirement
 
-	// Create the storage directory if it doesn't exist
-	if _, err := os.Stat(storageDirectory); os.IsNotExist(err) {
-		err := os.Mkdir(storageDirectory, 0755)
+	var backend StorageBackend
+	if *imagePath != "" {
+		pack, err := OpenPackBackend(*imagePath)
 		if err != nil {
-			fmt.Printf("Failed to create the storage directory: %s\n", err.Error())
+			fmt.Printf("Failed to open pack file: %s\n", err.Error())
 			return
 		}
+		defer pack.Close()
+		backend = pack
+	} else {
+		currentDirectory, _ := os.Getwd()
+		storageDirectory := filepath.Join(currentDirectory, "storageData")
+
+		// Create the storage directory if it doesn't exist
+		if _, err := os.Stat(storageDirectory); os.IsNotExist(err) {
+			err := os.Mkdir(storageDirectory, 0755)
+			if err != nil {
+				fmt.Printf("Failed to create the storage directory: %s\n", err.Error())
+				return
+			}
+		}
+		backend = NewLocalBackend(baseDir)
 	}
 
-	// Initialize virtual file system
-	versioning, err := NewVersioning()
-	baseDir := "./storageData" // Update the base directory path as per your requirement
-	fs := NewFileSystem(baseDir, versioning)
+	// Initialize metadata store
+	store, err := OpenMetadataStore(*storeKind, *mongoURI, *storePath)
+	if err != nil {
+		fmt.Printf("Failed to open the metadata store: %v\n", err)
+		return
+	}
+	defer store.Close()
 
-	// Initialize database
-	db := NewDatabase()
+	// Initialize virtual file system
+	blobs := NewBlobStore(backend, store)
+	versioning := NewVersioning(store, blobs)
+	fs := NewFileSystem(baseDir, backend, versioning)
+	fs.TrashRetention = *trashRetention
+	fs.IndexHistory = *indexHistory
 
+	// Finish anything a previous run left half done
+	recovered, err := fs.Recover()
 	if err != nil {
-		panic(err)
+		fmt.Printf("Failed to recover interrupted operations: %v\n", err)
+		return
+	}
+	if recovered > 0 {
+		fmt.Printf("Recovered %d interrupted operations\n", recovered)
 	}
-	defer db.Close()
+	purgeTrash(fs)
+	// Keep purging while running, for sessions that outlast the retention
+	purgeInterval := TrashPurgeInterval
+	if *trashRetention > 0 && *trashRetention < purgeInterval {
+		purgeInterval = *trashRetention
+	}
+	stopPurging := startTrashPurger(fs, purgeInterval)
+	defer stopPurging()
+
+	// Check stored contents for damage in the background
+	scrubber := NewScrubber(fs)
+	scrubber.Interval = *scrubInterval
+	scrubber.BytesPerSecond = *scrubRate
+	if *scrubMirror != "" {
+		scrubber.Mirror = NewLocalBackend(*scrubMirror)
+	}
+	scrubber.Start()
+	defer scrubber.Stop()
 
 	// Initialize cache
 	cache := NewCache()
 
-	authService := NewAuthService(db.client)
-	if err != nil {
-		fmt.Printf("Failed to initialize auth: %v\n", err)
-		return
-	}
+	authService := NewAuthService(store, backend)
 
 	// Main loop for user interaction
 	scanner := bufio.NewScanner(os.Stdin)
@@ -62,15 +122,11 @@ func main() {
 		input := scanner.Text()
 
 		if input == "exit" {
-			//fs.Close()
-			db.Close()
-			//cache.Close()
-			versioning.Close()
 			break
 		}
 
 		// Process user input
-		parts := strings.Split(input, " ")
+		parts := splitArgs(input)
 		command := parts[0]
 
 		switch command {
@@ -90,7 +146,13 @@ func main() {
 			password, _ := reader.ReadString('\n')
 			password = strings.TrimSpace(password)
 
-			err := authService.Signup(username, password, "ADMIN")
+			role := "USER"
+			for _, admin := range strings.Split(*admins, ",") {
+				if strings.TrimSpace(admin) == username {
+					role = "ADMIN"
+				}
+			}
+			err := authService.Signup(username, password, role)
 			if err != nil {
 				fmt.Printf("Failed to signup: %v\n", err)
 			} else {
@@ -100,6 +162,8 @@ func main() {
 			if isLoggedIn {
 				isLoggedIn = false
 				currentUser = ""
+				fs.SetHome("")
+				fs.SetUser("", nil)
 				fmt.Println("Logged out successfully!")
 			} else {
 				fmt.Println("No user currently logged in.")
@@ -113,20 +177,26 @@ func main() {
 			password, _ := reader.ReadString('\n')
 			password = strings.TrimSpace(password)
 
-			var err error
-			isLoggedIn, err = authService.Login(username, password)
+			ok, err := authService.Login(username, password)
 			if err != nil {
 				fmt.Printf("Error logging in: %v\n", err)
+			} else if !ok {
+				fmt.Println("Invalid credentials")
+			} else if err := checkHomeDirectory(fs.Backend, username); err != nil {
+				fmt.Printf("Error logging in: %v\n", err)
 			} else {
 				currentUser = username
 				fmt.Printf("Welcome %s\n", currentUser)
 				isLoggedIn = true
-				fmt.Println(isLoggedIn)
-				newDirPath := filepath.Join(fs.BaseDir, username)
-				fs.BaseDir = newDirPath
+				fs.SetHome(username)
+				if user, err := authService.GetUser(username); err == nil {
+					fs.SetUser(username, user.Groups)
+				}
 				// You can perform additional actions for a logged-in user here
 				// For example, you can set a flag or store the user's login status in a variable
 			}
+		case "compact":
+			handleCompactCommand(fs, authService)
 		case "pwd":
 			handlePWDCommand(fs)
 		case "cd":
@@ -136,7 +206,7 @@ func main() {
 		case "ls":
 			handleListCommand(parts, fs)
 		case "rmdir":
-			handleDeleteCommand(parts, storageDirectory)
+			handleDeleteCommand(parts, fs, reader)
 		case "create":
 			if len(parts) != 3 {
 				fmt.Println("Invalid command. Usage: create <filename>")
@@ -202,6 +272,185 @@ func main() {
 			} else {
 				fmt.Println("Please login")
 			}
+		case "mv":
+			if len(parts) != 3 {
+				fmt.Println("Invalid command. Usage: mv <source> <destination>")
+				continue
+			}
+			if isLoggedIn {
+				err := moveFile(fs, parts[1], parts[2])
+				if err != nil {
+					fmt.Printf("Error moving file: %s\n", err.Error())
+					continue
+				}
+				fmt.Println("File moved successfully.")
+			} else {
+				fmt.Println("Please login")
+			}
+		case "cp":
+			recursive := len(parts) == 4 && parts[1] == "-r"
+			if len(parts) != 3 && !recursive {
+				fmt.Println("Invalid command. Usage: cp [-r] <source> <destination>")
+				continue
+			}
+			if isLoggedIn {
+				args := parts[1:]
+				if recursive {
+					args = parts[2:]
+				}
+				err := copyFile(fs, args[0], args[1], recursive)
+				if err != nil {
+					fmt.Printf("Error copying file: %s\n", err.Error())
+					continue
+				}
+				fmt.Println("File copied successfully.")
+			} else {
+				fmt.Println("Please login")
+			}
+		case "ln":
+			symbolic := len(parts) == 4 && parts[1] == "-s"
+			if len(parts) != 3 && !symbolic {
+				fmt.Println("Invalid command. Usage: ln [-s] <target> <linkname>")
+				continue
+			}
+			if isLoggedIn {
+				var err error
+				if symbolic {
+					err = fs.Symlink(parts[2], parts[3])
+				} else {
+					err = fs.Link(parts[1], parts[2])
+				}
+				if err != nil {
+					fmt.Printf("Error creating link: %s\n", err.Error())
+					continue
+				}
+				fmt.Println("Link created successfully.")
+			} else {
+				fmt.Println("Please login")
+			}
+		case "tag", "untag":
+			if len(parts) < 3 {
+				fmt.Printf("Invalid command. Usage: %s <filename> <tag>...\n", parts[0])
+				continue
+			}
+			if isLoggedIn {
+				var err error
+				if parts[0] == "tag" {
+					err = fs.Tag(parts[1], parts[2:]...)
+				} else {
+					err = fs.Untag(parts[1], parts[2:]...)
+				}
+				if err != nil {
+					fmt.Printf("Error updating tags: %s\n", err.Error())
+					continue
+				}
+				tags, err := fs.Tags(parts[1])
+				if err != nil {
+					fmt.Printf("Error updating tags: %s\n", err.Error())
+					continue
+				}
+				fmt.Printf("Tags of '%s': %s\n", parts[1], strings.Join(tags, ", "))
+			} else {
+				fmt.Println("Please login")
+			}
+		case "setattr":
+			if len(parts) < 3 {
+				fmt.Println("Invalid command. Usage: setattr <filename> <name> [value]")
+				continue
+			}
+			if isLoggedIn {
+				err := fs.SetAttr(parts[1], parts[2], strings.Join(parts[3:], " "))
+				if err != nil {
+					fmt.Printf("Error setting attribute: %s\n", err.Error())
+					continue
+				}
+				fmt.Println("Attribute set successfully.")
+			} else {
+				fmt.Println("Please login")
+			}
+		case "getattr":
+			if len(parts) != 2 && len(parts) != 3 {
+				fmt.Println("Invalid command. Usage: getattr <filename> [name]")
+				continue
+			}
+			if isLoggedIn {
+				if len(parts) == 3 {
+					value, err := fs.GetAttr(parts[1], parts[2])
+					if err != nil {
+						fmt.Printf("Error getting attribute: %s\n", err.Error())
+						continue
+					}
+					fmt.Printf("%s=%s\n", parts[2], value)
+					continue
+				}
+				attrs, err := fs.Attrs(parts[1])
+				if err != nil {
+					fmt.Printf("Error getting attributes: %s\n", err.Error())
+					continue
+				}
+				printAttributes(attrs)
+			} else {
+				fmt.Println("Please login")
+			}
+		case "chmod":
+			if len(parts) != 3 {
+				fmt.Println("Invalid command. Usage: chmod <mode> <filename>")
+				continue
+			}
+			if isLoggedIn {
+				mode, err := strconv.ParseUint(parts[1], 8, 32)
+				if err != nil || mode > 0777 {
+					fmt.Println("Invalid mode. Use octal permission bits such as 644.")
+					continue
+				}
+				if err := fs.Chmod(parts[2], os.FileMode(mode)); err != nil {
+					fmt.Printf("Error changing mode: %s\n", err.Error())
+					continue
+				}
+				fmt.Println("Mode changed successfully.")
+			} else {
+				fmt.Println("Please login")
+			}
+		case "chown":
+			if len(parts) != 3 {
+				fmt.Println("Invalid command. Usage: chown <owner>[:<group>] <filename>")
+				continue
+			}
+			if isLoggedIn {
+				owner, group := parts[1], ""
+				if i := strings.Index(owner, ":"); i >= 0 {
+					owner, group = owner[:i], owner[i+1:]
+				}
+				if err := fs.Chown(parts[2], owner, group); err != nil {
+					fmt.Printf("Error changing owner: %s\n", err.Error())
+					continue
+				}
+				fmt.Println("Owner changed successfully.")
+			} else {
+				fmt.Println("Please login")
+			}
+		case "share":
+			if len(parts) != 4 {
+				fmt.Println("Invalid command. Usage: share <path> <user|@group> <read|write|admin|none>")
+				continue
+			}
+			if isLoggedIn {
+				level := parts[3]
+				if level == "none" {
+					level = ""
+				}
+				if err := fs.Share(parts[1], parts[2], level); err != nil {
+					fmt.Printf("Error sharing: %s\n", err.Error())
+					continue
+				}
+				if level == "" {
+					fmt.Println("Sharing removed successfully.")
+				} else {
+					fmt.Println("Shared successfully.")
+				}
+			} else {
+				fmt.Println("Please login")
+			}
 		case "compress":
 			if len(parts) != 2 {
 				fmt.Println("Invalid command. Usage: compress <filename>")
@@ -209,12 +458,7 @@ func main() {
 			}
 			if isLoggedIn {
 				filename := parts[1]
-				content, err := fs.ReadFile(filename)
-				if err != nil {
-					fmt.Printf("Error reading file: %s\n", err.Error())
-					continue
-				}
-				Compress(content, filename+".gz")
+				err := compressFile(fs, filename, filename+".gz")
 				if err != nil {
 					fmt.Printf("Error compressing file: %s\n", err.Error())
 					continue
@@ -230,13 +474,13 @@ func main() {
 			}
 			if isLoggedIn {
 				filename := parts[1]
-
-				decompressedContent, err := Decompress(filename)
+				fmt.Print("Decompressed content: ")
+				err := decompressFile(fs, filename, os.Stdout)
+				fmt.Println()
 				if err != nil {
 					fmt.Printf("Error decompressing file: %s\n", err.Error())
 					continue
 				}
-				fmt.Printf("Decompressed content: %s\n", decompressedContent)
 			} else {
 				fmt.Println("Please login")
 			}
@@ -247,17 +491,12 @@ func main() {
 			}
 			if isLoggedIn {
 				filename := parts[1]
-				content, err := fs.ReadFile(filename)
-				if err != nil {
-					fmt.Printf("Error reading file: %s\n", err.Error())
-					continue
-				}
-				encryptedContent, err := Encrypt(content)
+				err := encryptFile(fs, filename, filename+".enc")
 				if err != nil {
 					fmt.Printf("Error encrypting file: %s\n", err.Error())
 					continue
 				}
-				fmt.Printf("Encrypted content: %v\n", encryptedContent)
+				fmt.Printf("Encrypted content: " + filename + ".enc\n")
 			} else {
 				fmt.Println("Please login")
 			}
@@ -268,17 +507,13 @@ func main() {
 			}
 			if isLoggedIn {
 				filename := parts[1]
-				content, err := fs.ReadFile(filename)
-				if err != nil {
-					fmt.Printf("Error reading file: %s\n", err.Error())
-					continue
-				}
-				decryptedContent, err := Decrypt(content)
+				fmt.Print("Decrypted content: ")
+				err := decryptFile(fs, filename, os.Stdout)
+				fmt.Println()
 				if err != nil {
 					fmt.Printf("Error decrypting file: %s\n", err.Error())
 					continue
 				}
-				fmt.Printf("Decrypted content: %s\n", decryptedContent)
 			} else {
 				fmt.Println("Please login")
 			}
@@ -315,7 +550,15 @@ func main() {
 			}
 			if isLoggedIn {
 				filename := parts[1]
-				latestVersion, err := versioning.GetLatestVersion(filename)
+				key, err := fs.Resolve("version", filename)
+				if err == nil {
+					err = fs.access("version", filename, key, permRead)
+				}
+				if err != nil {
+					fmt.Printf("Error getting latest version: %s\n", err.Error())
+					continue
+				}
+				latestVersion, err := versioning.GetLatestVersion(key)
 				if err != nil {
 					fmt.Printf("Error getting latest version: %s\n", err.Error())
 					continue
@@ -323,19 +566,84 @@ func main() {
 				fmt.Printf("Latest version of file '%s': %d\n", filename, latestVersion)
 
 				// Retrieve all previous versions of the file
-				previousVersions, err := versioning.GetAllVersions(filename)
+				previousVersions, err := versioning.GetAllVersions(key)
 				if err != nil {
 					fmt.Printf("Error getting previous versions: %s\n", err.Error())
 					continue
 				}
 
-				// Print the content of each previous version
+				events, err := versioning.GetEvents(key)
+				if err != nil {
+					fmt.Printf("Error getting file history: %s\n", err.Error())
+					continue
+				}
+
+				// Print the content of each previous version, along with
+				// where the file was renamed in between
 				for _, version := range previousVersions {
-					fmt.Printf("Version %d content: %s\n", version.Version, version.Content)
+					for len(events) > 0 && events[0].Version < version.Version {
+						printHistoryEvent(events[0])
+						events = events[1:]
+					}
+
+					content, err := versioning.ReadVersion(&version)
+					if err != nil {
+						fmt.Printf("Error reading version %d: %s\n", version.Version, err.Error())
+						continue
+					}
+					fmt.Printf("Version %d content: %s\n", version.Version, content)
+					if len(version.Tags) > 0 {
+						fmt.Printf("Version %d tags: %s\n", version.Version, strings.Join(version.Tags, ", "))
+					}
+					printAttributes(version.Attributes)
+				}
+				for _, event := range events {
+					printHistoryEvent(event)
+				}
+			} else {
+				fmt.Println("Please login")
+			}
+		case "versionstats":
+			if len(parts) != 2 {
+				fmt.Println("Invalid command. Usage: versionstats <filename>")
+				continue
+			}
+			if isLoggedIn {
+				filename := parts[1]
+				key, err := fs.Resolve("versionstats", filename)
+				if err == nil {
+					err = fs.access("versionstats", filename, key, permRead)
+				}
+				if err != nil {
+					fmt.Printf("Error getting version stats: %s\n", err.Error())
+					continue
+				}
+				stats, err := versioning.GetVersionStats(key)
+				if err != nil {
+					fmt.Printf("Error getting version stats: %s\n", err.Error())
+					continue
+				}
+				for _, stat := range stats {
+					fmt.Printf("Version %d: %d bytes in %d chunks, %d new, %d shared\n",
+						stat.Version, stat.Size, stat.Chunks, stat.NewBytes, stat.SharedBytes)
 				}
 			} else {
 				fmt.Println("Please login")
 			}
+		case "quota":
+			handleQuotaCommand(parts, fs, authService)
+		case "trash":
+			handleTrashCommand(parts, fs)
+		case "find":
+			handleFindCommand(parts, fs)
+		case "search":
+			handleSearchCommand(input, fs)
+		case "stat":
+			handleStatCommand(parts, fs)
+		case "fsck":
+			handleFsckCommand(parts, fs, authService)
+		case "scrub":
+			handleScrubCommand(parts, scrubber, authService)
 		default:
 			fmt.Println("Unknown command. Enter 'help' to see available commands.")
 		}
@@ -352,6 +660,24 @@ func parseInput(input string) []string {
 	return parts
 }
 
+// splitArgs splits a command line at spaces. Text in double quotes is kept
+// together, so names such as "Shared with me" can be typed.
+func splitArgs(input string) []string {
+	parts := []string{""}
+	quoted := false
+	for _, r := range input {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case r == ' ' && !quoted:
+			parts = append(parts, "")
+		default:
+			parts[len(parts)-1] += string(r)
+		}
+	}
+	return parts
+}
+
 func handlePWDCommand(fs *FileSystem) {
 	fmt.Println("Current working directory:", fs.BaseDir)
 }
@@ -364,60 +690,45 @@ func handleChangeDirectory(parts []string, fs *FileSystem) {
 
 	if isLoggedIn {
 		dirPath := parts[1]
-		if dirPath == ".." {
-			if fs.BaseDir != filepath.Join("./storageData", currentUser) {
-				// Navigate up one level within the base path
-				fs.BaseDir = filepath.Dir(fs.BaseDir)
-				fmt.Println("Changed to directory:", fs.BaseDir)
-			} else {
+
+		// Resolve and change to the new directory; the resolver keeps us
+		// within the user's home directory
+		err := fs.Chdir(dirPath)
+		var permErr *PermissionError
+		if errors.Is(err, os.ErrPermission) {
+			if dirPath == ".." {
 				fmt.Println("Cannot navigate up beyond the base path.")
+			} else if errors.As(err, &permErr) && strings.HasPrefix(permErr.Reason, "outside") {
+				fmt.Println("Access denied. You can only navigate within your home directory.")
+			} else {
+				fmt.Printf("Access denied: %s\n", err.Error())
 			}
 			return
-		}
-
-		// Construct the new directory path
-		newDirPath := filepath.Join(fs.BaseDir, dirPath)
-
-		// Check if the directory exists
-		if _, err := os.Stat(newDirPath); os.IsNotExist(err) {
+		} else if err != nil {
 			fmt.Println("Directory does not exist.")
 			return
 		}
 
-		// Check if the new directory is within the user's home directory
-		homeDir := filepath.Join("./storageData", currentUser)
-		if !isSubdirectory(newDirPath, homeDir) {
-			fmt.Println("Access denied. You can only navigate within your home directory.")
-			return
-		}
-
-		// Update the base directory to the new directory path
-		fs.BaseDir = newDirPath
 		fmt.Println("Changed to directory:", fs.BaseDir)
 	} else {
 		fmt.Println("Please login")
 	}
 }
 
-// Check if dirPath is a subdirectory of parentDir
-func isSubdirectory(dirPath, parentDir string) bool {
-	relPath, err := filepath.Rel(parentDir, dirPath)
-	if err != nil {
-		return false
-	}
-	return !strings.HasPrefix(relPath, "..")
-}
-
 func handleCreateDirCommand(parts []string, fs *FileSystem) {
-	if len(parts) != 2 {
-		fmt.Println("Invalid command. Usage: create <dirname>")
+	all := len(parts) == 3 && parts[1] == "-p"
+	if len(parts) != 2 && !all {
+		fmt.Println("Invalid command. Usage: mkdir [-p] <dirname>")
 		return
 	}
 
 	if isLoggedIn {
-		dirname := parts[1]
-		dirPath := filepath.Join(fs.BaseDir, dirname)
-		err := os.Mkdir(dirPath, 0755)
+		var err error
+		if all {
+			err = fs.MkdirAll(parts[2])
+		} else {
+			err = fs.Mkdir(parts[1])
+		}
 		if err != nil {
 			fmt.Printf("Error creating directory: %s\n", err.Error())
 			return
@@ -430,73 +741,927 @@ func handleCreateDirCommand(parts []string, fs *FileSystem) {
 }
 
 func handleListCommand(parts []string, fs *FileSystem) {
-	if len(parts) != 1 {
-		fmt.Println("Invalid command. Usage: list")
+	tag := ""
+	if len(parts) == 3 && parts[1] == "-t" {
+		tag = parts[2]
+	} else if len(parts) != 1 {
+		fmt.Println("Invalid command. Usage: ls [-t <tag>]")
 		return
 	}
 
 	if isLoggedIn {
-		filepath.Walk(fs.BaseDir, func(path string, info os.FileInfo, err error) error {
-			if err == nil {
-				relativePath, err := filepath.Rel(fs.BaseDir, path)
-				if err != nil {
-					fmt.Printf("Error getting relative path: %s\n", err.Error())
+		entries, err := fs.ReadDir(".")
+		if err != nil {
+			fmt.Printf("Error listing directory: %s\n", err.Error())
+			return
+		}
+		if tag == "" {
+			fmt.Println("[.]")
+		}
+		for _, entry := range entries {
+			err := fs.Walk(entry.Name, func(name string, info *FileInfo) error {
+				// Check if it's a directory
+				if info.IsDir {
+					if tag == "" {
+						fmt.Printf("[%s]%s\n", name, sharedSuffix(info))
+					}
 					return nil
 				}
 
-				// Check if it's a directory
-				if info.IsDir() {
-					fmt.Printf("[%s]\n", relativePath)
+				// Only show tagged files when filtering
+				if tag != "" {
+					if tagged, err := fs.HasTag(info.key, tag); err != nil || !tagged {
+						return nil
+					}
+				}
+
+				// Show where links lead
+				if info.Link != "" {
+					fmt.Printf("%s -> %s\n", name, info.Link)
+				} else if info.Links > 1 {
+					fmt.Printf("%s (%d links)%s\n", name, info.Links, sharedSuffix(info))
 				} else {
-					fmt.Println(relativePath)
+					fmt.Printf("%s%s\n", name, sharedSuffix(info))
 				}
+				return nil
+			})
+			if err != nil {
+				fmt.Printf("Error listing %s: %s\n", entry.Name, err.Error())
 			}
-			return nil
-		})
+		}
 	} else {
 		fmt.Println("Please login")
 	}
 }
 
-func handleDeleteCommand(parts []string, storageDirectory string) {
-	if len(parts) != 2 {
-		fmt.Println("Invalid command. Usage: delete <filename>")
+// sharedSuffix shows the access level of an item shared with the user.
+func sharedSuffix(info *FileInfo) string {
+	if info.Shared == "" {
+		return ""
+	}
+	return " (" + info.Shared + ")"
+}
+
+func handleDeleteCommand(parts []string, fs *FileSystem, reader *bufio.Reader) {
+	recursive := len(parts) == 3 && parts[1] == "-r"
+	if len(parts) != 2 && !recursive {
+		fmt.Println("Invalid command. Usage: rmdir [-r] <dirname>")
 		return
 	}
 	if isLoggedIn {
+		dirname := parts[len(parts)-1]
+		info, err := fs.Stat(dirname)
+		if err != nil {
+			fmt.Printf("Error deleting directory: %s\n", err.Error())
+			return
+		}
+		if !info.IsDir {
+			fmt.Printf("Error deleting directory: %s is not a directory\n", dirname)
+			return
+		}
 
-		filename := parts[1]
-		filePath := filepath.Join(storageDirectory, filename)
+		if !recursive {
+			// Empty directories go to the trash like files do
+			if entries, err := fs.ReadDir(dirname); err != nil {
+				fmt.Printf("Error deleting directory: %s\n", err.Error())
+				return
+			} else if len(entries) > 0 {
+				fmt.Printf("Error deleting directory: %s is not empty, use rmdir -r to remove it with everything in it\n", dirname)
+				return
+			}
+			if err := fs.DeleteFile(dirname); err != nil {
+				fmt.Printf("Error deleting directory: %s\n", err.Error())
+				return
+			}
+			fmt.Println("Directory deleted successfully.")
+			return
+		}
 
-		err := os.Remove(filePath)
+		files := 0
+		err = fs.Walk(dirname, func(name string, info *FileInfo) error {
+			if !info.IsDir {
+				files++
+			}
+			return nil
+		})
 		if err != nil {
-			fmt.Printf("Error deleting file: %s\n", err.Error())
+			fmt.Printf("Error deleting directory: %s\n", err.Error())
+			return
+		}
+		fmt.Printf("Permanently remove %s and the %d files in it, with their version history? [y/N]: ", dirname, files)
+		answer, _ := reader.ReadString('\n')
+		if answer = strings.ToLower(strings.TrimSpace(answer)); answer != "y" && answer != "yes" {
+			fmt.Println("Nothing removed.")
 			return
 		}
 
-		fmt.Println("File deleted successfully.")
+		if err := fs.RemoveAll(dirname); err != nil {
+			fmt.Printf("Error deleting directory: %s\n", err.Error())
+			return
+		}
+		fmt.Println("Directory removed successfully.")
 	} else {
 		fmt.Println("Please login")
 	}
 }
 
+// compressFile streams src through gzip into dst, both relative to the
+// current directory.
+func compressFile(fs *FileSystem, src, dst string) error {
+	r, err := fs.OpenReader(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	// Written like any other file, so it is versioned and counted.
+	w, err := fs.OpenWriter(dst)
+	if err != nil {
+		return err
+	}
+
+	gzWriter := NewCompressWriter(w)
+	if _, err := io.Copy(gzWriter, r); err != nil {
+		gzWriter.Close()
+		abortWrite(w)
+		return err
+	}
+	if err := gzWriter.Close(); err != nil {
+		abortWrite(w)
+		return err
+	}
+	return w.Close()
+}
+
+// decompressFile streams the gunzipped contents of name to out.
+func decompressFile(fs *FileSystem, name string, out io.Writer) error {
+	r, err := fs.OpenReader(name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	gzReader, err := NewDecompressReader(r)
+	if err != nil {
+		return err
+	}
+	defer gzReader.Close()
+
+	_, err = io.Copy(out, gzReader)
+	return err
+}
+
+// encryptFile streams src through encryption into dst, both relative to
+// the current directory.
+func encryptFile(fs *FileSystem, src, dst string) error {
+	r, err := fs.OpenReader(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	w, err := fs.OpenWriter(dst)
+	if err != nil {
+		return err
+	}
+
+	encWriter, err := NewEncryptWriter(w)
+	if err != nil {
+		abortWrite(w)
+		return err
+	}
+	if _, err := io.Copy(encWriter, r); err != nil {
+		abortWrite(w)
+		return err
+	}
+	if err := encWriter.Close(); err != nil {
+		abortWrite(w)
+		return err
+	}
+	return w.Close()
+}
+
+// decryptFile streams the decrypted contents of name to out.
+func decryptFile(fs *FileSystem, name string, out io.Writer) error {
+	r, err := fs.OpenReader(name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	decReader, err := NewDecryptReader(r)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, decReader)
+	return err
+}
+
+// moveFile renames src to dst, or moves it into dst if that is an existing
+// directory.
+func moveFile(fs *FileSystem, src, dst string) error {
+	key, err := fs.Resolve("rename", dst)
+	if err != nil {
+		return err
+	}
+	if info, err := fs.Backend.Stat(key); err == nil && info.IsDir {
+		dst = path.Join(filepath.ToSlash(dst), path.Base(filepath.ToSlash(src)))
+	}
+	return fs.Rename(src, dst)
+}
+
+// copyFile copies src to dst, or into dst if that is an existing directory.
+// Directories are only copied if recursive is set.
+func copyFile(fs *FileSystem, src, dst string, recursive bool) error {
+	srcKey, err := fs.Resolve("copy", src)
+	if err != nil {
+		return err
+	}
+	info, err := fs.Backend.Stat(srcKey)
+	if err != nil {
+		return err
+	}
+	if info.IsDir && !recursive {
+		return fmt.Errorf("'%s' is a directory (use cp -r)", src)
+	}
+
+	key, err := fs.Resolve("copy", dst)
+	if err != nil {
+		return err
+	}
+	if info, err := fs.Backend.Stat(key); err == nil && info.IsDir {
+		dst = path.Join(filepath.ToSlash(dst), path.Base(filepath.ToSlash(src)))
+	}
+	return fs.Copy(src, dst)
+}
+
+func printAttributes(attrs map[string]string) {
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("%s=%s\n", name, attrs[name])
+	}
+}
+
+func handleFindCommand(parts []string, fs *FileSystem) {
+	if !isLoggedIn {
+		fmt.Println("Please login")
+		return
+	}
+
+	var query Query
+	args := parts[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		query.Root, args = args[0], args[1:]
+	}
+
+	var size, after, before, kind string
+	flags := flag.NewFlagSet("find", flag.ContinueOnError)
+	flags.SetOutput(os.Stdout)
+	flags.StringVar(&query.Name, "name", "", "shell `pattern` the base name must match, e.g. '*.txt'")
+	flags.StringVar(&query.Regex, "regex", "", "regular `expression` the path must match")
+	flags.StringVar(&kind, "type", "", "f for files, d for directories, l for symbolic links")
+	flags.StringVar(&size, "size", "", "size `range` such as 10k..2m, 1m.. or ..512")
+	flags.StringVar(&after, "after", "", "modified after a `time`: 2006-01-02, RFC 3339, or a duration ago such as 24h")
+	flags.StringVar(&before, "before", "", "modified before a `time`, like -after")
+	flags.StringVar(&query.Tag, "tag", "", "files with this `tag`")
+	flags.IntVar(&query.VersionsOver, "versions", 0, "files with more than `n` versions")
+	flags.StringVar(&query.Contains, "contains", "", "files containing this `text`")
+	flags.StringVar(&query.SortBy, "sort", "name", "sort by name, size, time or versions")
+	flags.BoolVar(&query.Reverse, "reverse", false, "reverse the order")
+	flags.IntVar(&query.Limit, "limit", 0, "show at most `n` results")
+	if err := flags.Parse(args); err != nil {
+		return
+	}
+	if flags.NArg() > 0 {
+		fmt.Println("Invalid command. Usage: find [<dir>] [options], see find -h")
+		return
+	}
+
+	var err error
+	switch kind {
+	case "":
+	case "f", "file":
+		query.Type = "file"
+	case "d", "dir":
+		query.Type = "dir"
+	case "l", "link":
+		query.Type = "link"
+	default:
+		fmt.Printf("Invalid type '%s'. Use f, d or l.\n", kind)
+		return
+	}
+	if size != "" {
+		if query.MinSize, query.MaxSize, err = parseSizeRange(size); err != nil {
+			fmt.Printf("Error finding files: %s\n", err.Error())
+			return
+		}
+	}
+	if after != "" {
+		if query.ModifiedAfter, err = parseFindTime(after); err != nil {
+			fmt.Printf("Error finding files: %s\n", err.Error())
+			return
+		}
+	}
+	if before != "" {
+		if query.ModifiedBefore, err = parseFindTime(before); err != nil {
+			fmt.Printf("Error finding files: %s\n", err.Error())
+			return
+		}
+	}
+
+	results, err := fs.Find(query)
+	if err != nil {
+		fmt.Printf("Error finding files: %s\n", err.Error())
+		return
+	}
+	for _, result := range results {
+		info := result.Info
+		switch {
+		case info.IsDir:
+			fmt.Printf("[%s]\n", result.Path)
+		case info.Link != "":
+			fmt.Printf("%s -> %s\n", result.Path, info.Link)
+		case query.SortBy == "versions":
+			fmt.Printf("%s  %d versions\n", result.Path, result.Versions)
+		default:
+			fmt.Printf("%s  %d bytes  %s\n", result.Path, info.Size, info.ModTime.Local().Format("2006-01-02 15:04:05"))
+		}
+	}
+	fmt.Printf("%d found\n", len(results))
+}
+
+// handleSearchCommand runs search. It takes the raw input, because quotes
+// in a query mark phrases.
+func handleSearchCommand(input string, fs *FileSystem) {
+	if !isLoggedIn {
+		fmt.Println("Please login")
+		return
+	}
+
+	opts := SearchOptions{Limit: 20}
+	query := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(input), "search"))
+	// Options come first; anything else starting with - excludes a word.
+options:
+	for {
+		fields := strings.Fields(query)
+		if len(fields) == 0 {
+			break
+		}
+		n := 1
+		switch fields[0] {
+		case "-history":
+			opts.History = true
+		case "-limit":
+			limit := -1
+			if len(fields) > 1 {
+				limit, _ = strconv.Atoi(fields[1])
+			}
+			if len(fields) < 2 || limit < 0 {
+				fmt.Println("Invalid command. Usage: search [-history] [-limit <n>] <query>")
+				return
+			}
+			opts.Limit = limit
+			n = 2
+		case "-reindex":
+			indexed, err := fs.Reindex(".")
+			if err != nil {
+				fmt.Printf("Error indexing files: %s\n", err.Error())
+				return
+			}
+			fmt.Printf("Indexed %d files successfully.\n", indexed)
+			return
+		default:
+			break options
+		}
+		for _, field := range fields[:n] {
+			query = strings.TrimSpace(strings.TrimPrefix(query, field))
+		}
+	}
+	if query == "" {
+		fmt.Println("Invalid command. Usage: search [-history] [-limit <n>] <query>")
+		return
+	}
+	if opts.History && !fs.IndexHistory {
+		fmt.Println("Versions are not indexed. Start with -index-history and run search -reindex.")
+		return
+	}
+
+	results, err := fs.Search(query, opts)
+	if err != nil {
+		fmt.Printf("Error searching files: %s\n", err.Error())
+		return
+	}
+	for _, result := range results {
+		if opts.History {
+			fmt.Printf("%s  introduced in version %d, found in versions %s\n", result.Path, result.Versions[0], joinInts(result.Versions))
+		} else {
+			fmt.Println(result.Path)
+		}
+		if result.Snippet != "" {
+			fmt.Printf("    %s\n", result.Snippet)
+		}
+	}
+	fmt.Printf("%d found\n", len(results))
+}
+
+func joinInts(values []int) string {
+	s := make([]string, len(values))
+	for i, v := range values {
+		s[i] = strconv.Itoa(v)
+	}
+	return strings.Join(s, ", ")
+}
+
+// parseSizeRange parses min..max, where either end may be left out, or a
+// single size. Sizes may end in k, m or g.
+func parseSizeRange(s string) (int64, int64, error) {
+	min, max := s, s
+	if i := strings.Index(s, ".."); i >= 0 {
+		min, max = s[:i], s[i+2:]
+	}
+
+	var bounds [2]int64
+	for i, bound := range []string{min, max} {
+		if bound == "" {
+			continue
+		}
+		unit := int64(1)
+		switch strings.ToLower(bound[len(bound)-1:]) {
+		case "k":
+			unit = 1 << 10
+		case "m":
+			unit = 1 << 20
+		case "g":
+			unit = 1 << 30
+		}
+		if unit > 1 {
+			bound = bound[:len(bound)-1]
+		}
+		n, err := strconv.ParseInt(bound, 10, 64)
+		if err != nil || n < 0 {
+			return 0, 0, fmt.Errorf("invalid size '%s', use a range such as 10k..2m", s)
+		}
+		bounds[i] = n * unit
+	}
+	return bounds[0], bounds[1], nil
+}
+
+// parseFindTime parses a date, an RFC 3339 time, or a duration meaning
+// that long ago.
+func parseFindTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time '%s', use 2006-01-02, an RFC 3339 time or a duration such as 24h", s)
+}
+
+func handleStatCommand(parts []string, fs *FileSystem) {
+	if !isLoggedIn {
+		fmt.Println("Please login")
+		return
+	}
+	usage := "Invalid command. Usage: stat <filename> | stat -largest [n] | stat -recent [n] | stat -checksum <checksum>"
+	if len(parts) < 2 || len(parts) > 3 {
+		fmt.Println(usage)
+		return
+	}
+
+	if !strings.HasPrefix(parts[1], "-") {
+		if len(parts) != 2 {
+			fmt.Println(usage)
+			return
+		}
+		file, err := fs.Metadata(parts[1])
+		if err != nil {
+			fmt.Printf("Error getting metadata: %s\n", err.Error())
+			return
+		}
+		fmt.Printf("File: %s\n", parts[1])
+		fmt.Printf("Size: %d bytes\n", file.FileSize)
+		fmt.Printf("Checksum: %s\n", file.Checksum)
+		fmt.Printf("Modified: %s\n", file.Timestamp.Local().Format("2006-01-02 15:04:05"))
+		if len(file.Tags) > 0 {
+			fmt.Printf("Tags: %s\n", strings.Join(file.Tags, ", "))
+		}
+		printAttributes(file.Attributes)
+		return
+	}
+
+	n := 10
+	if len(parts) == 3 && parts[1] != "-checksum" {
+		var err error
+		if n, err = strconv.Atoi(parts[2]); err != nil || n <= 0 {
+			fmt.Printf("Invalid number '%s'\n", parts[2])
+			return
+		}
+	}
+	var results []MetadataResult
+	var err error
+	switch {
+	case parts[1] == "-largest":
+		results, err = fs.LargestFiles(n)
+	case parts[1] == "-recent":
+		results, err = fs.RecentlyModified(n)
+	case parts[1] == "-checksum" && len(parts) == 3:
+		results, err = fs.FilesWithChecksum(parts[2])
+	default:
+		fmt.Println(usage)
+		return
+	}
+	if err != nil {
+		fmt.Printf("Error querying metadata: %s\n", err.Error())
+		return
+	}
+	for _, result := range results {
+		file := result.Metadata
+		fmt.Printf("%s  %d bytes  %s\n", result.Path, file.FileSize, file.Timestamp.Local().Format("2006-01-02 15:04:05"))
+	}
+	fmt.Printf("%d found\n", len(results))
+}
+
+func handleCompactCommand(fs *FileSystem, authService *AuthService) {
+	if !isLoggedIn {
+		fmt.Println("Please login")
+		return
+	}
+	// The pack file holds every user's files, so only admins may
+	user, err := authService.GetUser(currentUser)
+	if err != nil {
+		fmt.Printf("Error getting user: %s\n", err.Error())
+		return
+	}
+	if user.Role != "ADMIN" {
+		fmt.Println("Access denied. Only admins can compact the pack file.")
+		return
+	}
+
+	pack, ok := fs.Backend.(*PackBackend)
+	if !ok {
+		fmt.Println("compact is only available when running against a pack file (-image)")
+		return
+	}
+	reclaimed := pack.Garbage()
+	if err := pack.Compact(); err != nil {
+		fmt.Printf("Error compacting pack file: %s\n", err.Error())
+		return
+	}
+	fmt.Printf("Compacted pack file, reclaimed %d bytes\n", reclaimed)
+}
+
+func handleFsckCommand(parts []string, fs *FileSystem, authService *AuthService) {
+	fix := len(parts) == 2 && (parts[1] == "--fix" || parts[1] == "-fix")
+	if len(parts) > 2 || len(parts) == 2 && !fix {
+		fmt.Println("Invalid command. Usage: fsck [--fix]")
+		return
+	}
+	if !isLoggedIn {
+		fmt.Println("Please login")
+		return
+	}
+	// Every user's files are checked, so only admins may
+	user, err := authService.GetUser(currentUser)
+	if err != nil {
+		fmt.Printf("Error getting user: %s\n", err.Error())
+		return
+	}
+	if user.Role != "ADMIN" {
+		fmt.Println("Access denied. Only admins can run fsck.")
+		return
+	}
+
+	report, err := fs.Fsck(fix)
+	if report != nil {
+		for _, issue := range report.Issues {
+			line := fmt.Sprintf("%s: %s", issue.Category, issue.Key)
+			if issue.Detail != "" {
+				line += ": " + issue.Detail
+			}
+			switch {
+			case issue.Fixed:
+				line += " (fixed)"
+			case issue.FixError != nil:
+				line += fmt.Sprintf(" (fix failed: %v)", issue.FixError)
+			case fix:
+				line += " (cannot be fixed)"
+			}
+			fmt.Println(line)
+		}
+	}
+	if err != nil {
+		fmt.Printf("Error checking files: %s\n", err.Error())
+		return
+	}
+	fmt.Printf("Checked %d files: %d issues, %d fixed.\n", report.Files, len(report.Issues), report.Fixed())
+	if report.Quarantine != "" {
+		fmt.Printf("Quarantined files are in %s\n", report.Quarantine)
+	}
+}
+
+func handleScrubCommand(parts []string, scrubber *Scrubber, authService *AuthService) {
+	if len(parts) != 2 || parts[1] != "status" && parts[1] != "run" {
+		fmt.Println("Invalid command. Usage: scrub status | scrub run")
+		return
+	}
+	if !isLoggedIn {
+		fmt.Println("Please login")
+		return
+	}
+	// Scrubs cover every user's files, so only admins may look
+	user, err := authService.GetUser(currentUser)
+	if err != nil {
+		fmt.Printf("Error getting user: %s\n", err.Error())
+		return
+	}
+	if user.Role != "ADMIN" {
+		fmt.Println("Access denied. Only admins can manage scrubs.")
+		return
+	}
+
+	if parts[1] == "run" {
+		if scrubber.Status() != nil {
+			fmt.Println("A scrub is already running.")
+			return
+		}
+		scrubber.RunNow()
+		fmt.Println("Scrub started successfully.")
+		return
+	}
+
+	if current := scrubber.Status(); current != nil {
+		fmt.Printf("Scrub running since %s: %d of %d blobs and files checked, %d bytes read, %d issues so far\n",
+			current.Started.Local().Format("2006-01-02 15:04:05"), current.Blobs+current.Files, current.Total, current.Bytes, len(current.Issues))
+	} else if scrubber.Interval > 0 {
+		fmt.Printf("No scrub running. Scrubs run every %s.\n", scrubber.Interval)
+	} else {
+		fmt.Println("No scrub running. Scrubs only run with scrub run.")
+	}
+
+	last, err := scrubber.Last()
+	if err != nil {
+		fmt.Printf("Error getting the last scrub: %s\n", err.Error())
+		return
+	}
+	if last == nil {
+		fmt.Println("No scrub has run yet.")
+		return
+	}
+	unrecoverable := last.Unrecoverable()
+	fmt.Printf("Last scrub: %s to %s, %d blobs and %d files checked, %d bytes read, %d healed, %d unrecoverable\n",
+		last.Started.Local().Format("2006-01-02 15:04:05"), last.Finished.Local().Format("2006-01-02 15:04:05"),
+		last.Blobs, last.Files, last.Bytes, len(last.Issues)-len(unrecoverable), len(unrecoverable))
+	if last.Error != "" {
+		fmt.Printf("It did not finish: %s\n", last.Error)
+	}
+	for _, issue := range last.Issues {
+		if issue.Healed {
+			fmt.Printf("Healed %s from %s: %s\n", issue.Key, issue.Source, issue.Detail)
+		}
+	}
+	for _, issue := range unrecoverable {
+		fmt.Printf("Unrecoverable: %s: %s\n", issue.Key, issue.Detail)
+	}
+}
+
+func handleTrashCommand(parts []string, fs *FileSystem) {
+	if len(parts) < 2 || parts[1] == "restore" && len(parts) != 3 || parts[1] != "restore" && len(parts) != 2 {
+		fmt.Println("Invalid command. Usage: trash ls | trash restore <id|filename> | trash empty")
+		return
+	}
+	if !isLoggedIn {
+		fmt.Println("Please login")
+		return
+	}
+	purgeTrash(fs)
+
+	switch parts[1] {
+	case "ls":
+		items, err := fs.TrashItems()
+		if err != nil {
+			fmt.Printf("Error listing trash: %s\n", err.Error())
+			return
+		}
+		if len(items) == 0 {
+			fmt.Println("The trash is empty.")
+		}
+		for _, item := range items {
+			name := item.Name()
+			if item.IsDir {
+				name = "[" + name + "]"
+			}
+			fmt.Printf("%s  %s  deleted %s\n", item.ID, name, item.Deleted.Local().Format(time.RFC3339))
+		}
+	case "restore":
+		item, err := fs.Restore(parts[2])
+		if err != nil {
+			fmt.Printf("Error restoring: %s\n", err.Error())
+			return
+		}
+		fmt.Printf("Restored %s successfully.\n", item.Name())
+	case "empty":
+		n, err := fs.EmptyTrash()
+		if err != nil {
+			fmt.Printf("Error emptying trash: %s\n", err.Error())
+			return
+		}
+		fmt.Printf("Trash emptied successfully, %d items removed.\n", n)
+	default:
+		fmt.Println("Invalid command. Usage: trash ls | trash restore <id|filename> | trash empty")
+	}
+}
+
+// purgeTrash removes what has been in the trash for longer than the
+// retention period.
+func purgeTrash(fs *FileSystem) {
+	purged, err := fs.PurgeTrash()
+	if err != nil {
+		fmt.Printf("Failed to purge the trash: %v\n", err)
+	} else if purged > 0 {
+		fmt.Printf("Purged %d items from the trash\n", purged)
+	}
+}
+
+// startTrashPurger purges the trash every interval in the background. The
+// returned func stops it, waiting for a purge in progress to finish.
+func startTrashPurger(fs *FileSystem, interval time.Duration) func() {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				purgeTrash(fs)
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+func handleQuotaCommand(parts []string, fs *FileSystem, authService *AuthService) {
+	usage := "Invalid command. Usage: quota [<username>] | quota set <username> <bytes> <history bytes> <files> | quota recompute <username>"
+	subcommand := ""
+	if len(parts) > 1 && (parts[1] == "set" || parts[1] == "recompute") {
+		subcommand = parts[1]
+	}
+	if subcommand == "" && len(parts) > 2 || subcommand == "set" && len(parts) != 6 || subcommand == "recompute" && len(parts) != 3 {
+		fmt.Println(usage)
+		return
+	}
+	if !isLoggedIn {
+		fmt.Println("Please login")
+		return
+	}
+
+	username := currentUser
+	if len(parts) > 1 {
+		// Only admins look at or change the quotas of others
+		user, err := authService.GetUser(currentUser)
+		if err != nil {
+			fmt.Printf("Error getting user: %s\n", err.Error())
+			return
+		}
+		if user.Role != "ADMIN" {
+			fmt.Println("Access denied. Only admins can manage quotas.")
+			return
+		}
+		if subcommand == "" {
+			username = parts[1]
+		} else {
+			username = parts[2]
+		}
+		if _, err := authService.GetUser(username); err != nil {
+			fmt.Printf("Unknown user '%s'\n", username)
+			return
+		}
+	}
+
+	if subcommand == "set" {
+		var limits [3]int64
+		for i := range limits {
+			n, err := strconv.ParseInt(parts[3+i], 10, 64)
+			if err != nil || n < 0 {
+				fmt.Println("Invalid limit. Use a number, or 0 for no limit.")
+				return
+			}
+			limits[i] = n
+		}
+		quota := Quota{MaxBytes: limits[0], MaxHistoryBytes: limits[1], MaxFiles: limits[2]}
+		if err := fs.SetQuota(username, quota); err != nil {
+			fmt.Printf("Error setting quota: %s\n", err.Error())
+			return
+		}
+		fmt.Println("Quota set successfully.")
+		return
+	}
+
+	quota, err := fs.GetQuota(username)
+	if err != nil {
+		fmt.Printf("Error getting quota: %s\n", err.Error())
+		return
+	}
+	var used *Usage
+	if subcommand == "recompute" {
+		// Walks every file and version of the user
+		used, err = fs.RecomputeUsage(username)
+	} else {
+		used, err = fs.Usage(username)
+	}
+	if err != nil {
+		fmt.Printf("Error getting quota: %s\n", err.Error())
+		return
+	}
+	fmt.Printf("Quota for %s:\n", username)
+	printQuotaLine("Bytes", used.Bytes, quota.MaxBytes)
+	printQuotaLine("History bytes", used.HistoryBytes, quota.MaxHistoryBytes)
+	printQuotaLine("Files", used.Files, quota.MaxFiles)
+}
+
+func printQuotaLine(resource string, used, limit int64) {
+	if limit == 0 {
+		fmt.Printf("%s: %d (no limit)\n", resource, used)
+	} else {
+		fmt.Printf("%s: %d of %d\n", resource, used, limit)
+	}
+}
+
+func printHistoryEvent(event HistoryEvent) {
+	switch {
+	case event.Op == "rename" && strings.HasPrefix(event.To, trashPrefix+"/"):
+		fmt.Printf("Deleted from '%s' after version %d on %s\n",
+			event.From, event.Version, event.Time.Format(time.RFC3339))
+	case event.Op == "rename" && strings.HasPrefix(event.From, trashPrefix+"/"):
+		fmt.Printf("Restored to '%s' after version %d on %s\n",
+			event.To, event.Version, event.Time.Format(time.RFC3339))
+	case event.Op == "rename":
+		fmt.Printf("Renamed from '%s' to '%s' after version %d on %s\n",
+			event.From, event.To, event.Version, event.Time.Format(time.RFC3339))
+	case event.Op == "copy":
+		fmt.Printf("Copied from '%s' version %d on %s\n",
+			event.From, event.FromVersion, event.Time.Format(time.RFC3339))
+	}
+}
+
 func printHelp() {
 	fmt.Println("Available commands:")
 	fmt.Println("help - Print this help message")
 	fmt.Println("cd <dirname> - Navigate to a directory")
 	fmt.Println("pwd - Print working directory")
-	fmt.Println("mkdir <dirname> - Create a new directory")
-	fmt.Println("ls - Lists all files and directories")
-	fmt.Println("rmdir <dirname> - Delete a directory")
+	fmt.Println("mkdir [-p] <dirname> - Create a new directory, with -p along with any missing parents")
+	fmt.Println("ls [-t <tag>] - Lists all files and directories, or only files tagged with tag")
+	fmt.Println("rmdir [-r] <dirname> - Move an empty directory to the trash, or with -r permanently remove it and everything in it")
 	fmt.Println("create <filename> <content> - Create a new file")
 	fmt.Println("read <filename> - Read the content of a file")
 	fmt.Println("update <filename> <content> - Update the content of a file")
 	fmt.Println("delete <filename> - Delete a file")
+	fmt.Println("mv <source> <destination> - Move or rename a file or directory")
+	fmt.Println("cp [-r] <source> <destination> - Copy a file, or a directory with -r")
+	fmt.Println("ln [-s] <target> <linkname> - Create a hard link, or a symbolic link with -s")
+	fmt.Println("chmod <mode> <filename> - Change the permission bits of a file or directory")
+	fmt.Println("chown <owner>[:<group>] <filename> - Change the owner and group of a file or directory")
+	fmt.Println("share <path> <user|@group> <read|write|admin|none> - Share a file or directory, or stop sharing it with none")
+	fmt.Println("tag <filename> <tag>... - Add tags to a file")
+	fmt.Println("untag <filename> <tag>... - Remove tags from a file")
+	fmt.Println("setattr <filename> <name> [value] - Set an attribute of a file, or remove it without a value")
+	fmt.Println("getattr <filename> [name] - Show one or all attributes of a file")
 	fmt.Println("compress <filename> - Compress the content of a file")
 	fmt.Println("decompress <filename> - Decompress the content of a file")
-	fmt.Println("encrypt <filename> - Encrypt the content of a file")
-	fmt.Println("decrypt <filename> - Decrypt the content of a file")
+	fmt.Println("encrypt <filename> - Encrypt the content of a file into <filename>.enc")
+	fmt.Println("decrypt <filename> - Decrypt the content of a file encrypted with encrypt")
 	fmt.Println("cache <filename> - Get the content of a file from cache")
 	fmt.Println("version <filename> - Get the latest version of a file")
+	fmt.Println("versionstats <filename> - Show new and shared bytes per version")
+	fmt.Println("find [<dir>] [-name <pattern>] [-regex <re>] [-type f|d|l] [-size <min>..<max>] [-after <time>] [-before <time>] [-tag <tag>] [-versions <n>] [-contains <text>] [-sort name|size|time|versions] [-reverse] [-limit <n>] - Find files and directories")
+	fmt.Println("stat <filename> - Show the size, checksum, modification time, tags and attributes of a file")
+	fmt.Println("stat -largest [n] | stat -recent [n] | stat -checksum <checksum> - List the largest or most recently modified files, or the files with given contents")
+	fmt.Println("fsck [--fix] - Check storage, metadata and version history against each other, and with --fix repair what can be (admins only)")
+	fmt.Println("scrub status - Show the progress of the background scrub, the last one and any unrecoverable files (admins only)")
+	fmt.Println("scrub run - Start a scrub now (admins only)")
+	fmt.Println("search [-history] [-limit <n>] <query> - Search file contents; \"phrase\", OR and -word or NOT word are supported")
+	fmt.Println("search -reindex - Index files written before the search index existed")
+	fmt.Println("trash ls - List what was deleted from your home directory, by you or by users it is shared with")
+	fmt.Println("trash restore <id|filename> - Restore a file or directory deleted from your home directory")
+	fmt.Println("trash empty - Permanently remove everything in the trash of your home directory")
+	fmt.Println("quota [<username>] - Show storage used and quota limits")
+	fmt.Println("quota set <username> <bytes> <history bytes> <files> - Set the quota of a user, 0 for no limit (admins only)")
+	fmt.Println("quota recompute <username> - Recount the storage a user uses from their files and history (admins only)")
+	fmt.Println("compact - Reclaim unused space in the pack file (admins only)")
 	fmt.Println("exit - Exit the program")
 }
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Metadata returns the metadata of the file name: its size, checksum,
+// modification time, tags and attributes. Files written before metadata
+// was kept get theirs computed from their contents now.
+func (fs *FileSystem) Metadata(name string) (*FileMetadata, error) {
+	key, err := fs.Resolve("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	if err := fs.access("stat", name, key, permRead); err != nil {
+		return nil, err
+	}
+	if key, err = fs.contentKey(key); err != nil {
+		return nil, err
+	}
+
+	unlock := fs.locks.Lock(key)
+	defer unlock()
+
+	file, err := fs.fileMetadata(key)
+	if err != nil || file.Checksum != "" {
+		return file, err
+	}
+	return file, fs.syncMetadata(file)
+}
+
+// syncMetadata sets the size, checksum and modification time of file from
+// what is stored for it, and saves it. The caller must hold its lock.
+func (fs *FileSystem) syncMetadata(file *FileMetadata) error {
+	info, err := fs.Backend.Stat(file.Filename)
+	if err != nil {
+		return err
+	}
+	data, err := fs.Backend.Get(file.Filename)
+	if err != nil {
+		return err
+	}
+	file.FileSize = int64(len(data))
+	file.Checksum = checksum(data)
+	file.Timestamp = info.ModTime.UTC()
+	return fs.db.PutFileMetadata(file)
+}
+
+// MetadataQuery selects files by their metadata for QueryMetadata. Zero
+// fields match everything.
+type MetadataQuery struct {
+	Checksum string // files with exactly these contents
+	SortBy   string // "name" (the default), "size" for largest first or "time" for most recent first
+	Limit    int    // at most this many results, 0 for all
+}
+
+// MetadataResult is a file that matched a MetadataQuery.
+type MetadataResult struct {
+	Path     string // below the home directory
+	Metadata FileMetadata
+}
+
+// QueryMetadata returns the metadata of the files the user can read, in
+// their home directory or shared with them, that match query. Only files
+// with recorded metadata are considered.
+func (fs *FileSystem) QueryMetadata(query MetadataQuery) ([]MetadataResult, error) {
+	var less func(a, b *MetadataResult) bool
+	switch query.SortBy {
+	case "", "name":
+		less = func(a, b *MetadataResult) bool { return a.Path < b.Path }
+	case "size":
+		less = func(a, b *MetadataResult) bool { return a.Metadata.FileSize > b.Metadata.FileSize }
+	case "time":
+		less = func(a, b *MetadataResult) bool { return a.Metadata.Timestamp.After(b.Metadata.Timestamp) }
+	default:
+		return nil, fmt.Errorf("cannot sort by '%s'", query.SortBy)
+	}
+
+	shared, err := fs.SharedWithMe()
+	if err != nil {
+		return nil, err
+	}
+	// Files with hard links keep their metadata under their inode.
+	prefixes := []string{fs.home + "/", inodePrefix + "/"}
+	if fs.home == "" {
+		prefixes = []string{""}
+	}
+	for _, item := range shared {
+		prefixes = append(prefixes, item.Key)
+	}
+
+	seen := make(map[string]bool)
+	var results []MetadataResult
+	for _, prefix := range prefixes {
+		files, err := fs.db.ListFileMetadata(prefix)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			if seen[file.Filename] || strings.HasPrefix(file.Filename, trashPrefix+"/") {
+				continue
+			}
+			seen[file.Filename] = true
+			if query.Checksum != "" && file.Checksum != query.Checksum {
+				continue
+			}
+			if _, err := fs.Backend.Stat(file.Filename); err != nil {
+				// Left behind by something interrupted.
+				continue
+			}
+			name, ok := fs.readableName("stat", file.Filename, shared)
+			if !ok {
+				continue
+			}
+			results = append(results, MetadataResult{Path: name, Metadata: file})
+		}
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		if less(&results[i], &results[j]) {
+			return true
+		}
+		return !less(&results[j], &results[i]) && results[i].Path < results[j].Path
+	})
+	if query.Limit > 0 && len(results) > query.Limit {
+		results = results[:query.Limit]
+	}
+	return results, nil
+}
+
+// LargestFiles returns the n largest files the user can read.
+func (fs *FileSystem) LargestFiles(n int) ([]MetadataResult, error) {
+	return fs.QueryMetadata(MetadataQuery{SortBy: "size", Limit: n})
+}
+
+// RecentlyModified returns the n files the user can read that were
+// modified last.
+func (fs *FileSystem) RecentlyModified(n int) ([]MetadataResult, error) {
+	return fs.QueryMetadata(MetadataQuery{SortBy: "time", Limit: n})
+}
+
+// FilesWithChecksum returns the files the user can read whose contents
+// have the given checksum.
+func (fs *FileSystem) FilesWithChecksum(sum string) ([]MetadataResult, error) {
+	return fs.QueryMetadata(MetadataQuery{Checksum: strings.ToLower(sum)})
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrNotFound is returned by a MetadataStore when a record does not exist.
+var ErrNotFound = errors.New("not found")
+
+// MetadataStore persists everything the VFS knows about its files apart
+// from their contents: user accounts, file metadata and version history.
+type MetadataStore interface {
+	// Users
+	InsertUser(user User) error
+	FindUser(username string) (*User, error)
+	ListUsers() ([]User, error)
+
+	// File metadata. GetFileMetadata returns nil, nil if there is none.
+	SaveFileMetadata(file *FileMetadata) error
+	UpdateFileMetadata(file *FileMetadata) error
+	DeleteFileMetadata(filename string) error
+	GetFileMetadata(filename string) (*FileMetadata, error)
+	// ListFileMetadata returns the metadata of every file whose name
+	// starts with prefix, sorted by name.
+	ListFileMetadata(prefix string) ([]FileMetadata, error)
+
+	// Version history, ordered from oldest to newest.
+	GetVersions(filename string) ([]Version, error)
+	LatestVersion(filename string) (int, error)
+	AppendVersion(filename string, version Version) error
+	RemoveVersion(filename string, version int) error
+	// ListHistories returns every file whose name starts with prefix and
+	// that has a version, sorted.
+	ListHistories(prefix string) ([]string, error)
+	// RenameHistory moves the history of oldName to newName, which must
+	// not have one.
+	RenameHistory(oldName, newName string) error
+
+	// Records hold state for features that don't need their own queries.
+	// A record is any value that encodes to both JSON and BSON, stored
+	// under a key within a collection. GetRecord returns ErrNotFound if
+	// there is no such record.
+	PutRecord(collection, key string, value interface{}) error
+	GetRecord(collection, key string, value interface{}) error
+	DeleteRecord(collection, key string) error
+	ListRecords(collection, prefix string) ([]string, error)
+	// PutRecords puts many records of a collection in one go, deleting
+	// those whose value is nil.
+	PutRecords(collection string, records map[string]interface{}) error
+
+	// Increment atomically adds delta to the integer record at key,
+	// creating it at zero first if needed, and returns the new value.
+	Increment(collection, key string, delta int64) (int64, error)
+
+	Close() error
+}
+
+// OpenMetadataStore opens the store selected by kind: "mongo" connects to
+// the server at mongoURI, "embedded" keeps everything in the log file at
+// path.
+func OpenMetadataStore(kind, mongoURI, path string) (MetadataStore, error) {
+	switch kind {
+	case "mongo":
+		return NewMongoStore(mongoURI)
+	case "embedded":
+		return OpenEmbeddedStore(path)
+	default:
+		return nil, fmt.Errorf("unknown metadata store '%s'", kind)
+	}
+}
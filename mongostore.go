@@ -0,0 +1,390 @@
+package main
+
+import (
+	"context"
+	"log"
+	"regexp"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// MongoStore is a MetadataStore backed by the "myfilesdb" MongoDB database.
+type MongoStore struct {
+	client   *mongo.Client
+	db       *mongo.Database
+	users    *mongo.Collection
+	files    *mongo.Collection
+	metadata *mongo.Collection
+}
+
+func NewMongoStore(uri string) (*MongoStore, error) {
+	client, err := mongo.NewClient(options.Client().ApplyURI(uri))
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err = client.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	err = client.Ping(ctx, readpref.Primary())
+	if err != nil {
+		return nil, err
+	}
+
+	db := client.Database("myfilesdb")
+
+	store := &MongoStore{
+		client:   client,
+		db:       db,
+		users:    db.Collection("users"),
+		files:    db.Collection("files"),
+		metadata: db.Collection("metadata"),
+	}
+
+	// One history document per file, even when two versions of a new file
+	// are appended at once.
+	index := mongo.IndexModel{
+		Keys:    bson.D{{Key: "filename", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	}
+	if _, err := store.files.Indexes().CreateOne(ctx, index); err != nil {
+		log.Printf("Error creating unique index on file histories: %v", err)
+	}
+
+	return store, nil
+}
+
+func (s *MongoStore) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	return s.client.Disconnect(ctx)
+}
+
+func (s *MongoStore) InsertUser(user User) error {
+	_, err := s.users.InsertOne(context.Background(), user)
+	return err
+}
+
+func (s *MongoStore) FindUser(username string) (*User, error) {
+	filter := bson.M{"username": username}
+
+	var user User
+	err := s.users.FindOne(context.Background(), filter).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+func (s *MongoStore) ListUsers() ([]User, error) {
+	opts := options.Find().SetSort(bson.M{"username": 1})
+	cursor, err := s.users.Find(context.Background(), bson.M{}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+
+	var users []User
+	if err := cursor.All(context.Background(), &users); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (s *MongoStore) SaveFileMetadata(file *FileMetadata) error {
+	_, err := s.metadata.InsertOne(context.Background(), file)
+	return err
+}
+
+func (s *MongoStore) UpdateFileMetadata(file *FileMetadata) error {
+	filter := bson.M{"filename": file.Filename}
+	update := bson.M{"$set": bson.M{
+		"filesize":   file.FileSize,
+		"checksum":   file.Checksum,
+		"timestamp":  file.Timestamp,
+		"tags":       file.Tags,
+		"attributes": file.Attributes,
+	}}
+	_, err := s.metadata.UpdateOne(context.Background(), filter, update)
+	return err
+}
+
+func (s *MongoStore) DeleteFileMetadata(filename string) error {
+	filter := bson.M{"filename": filename}
+	_, err := s.metadata.DeleteOne(context.Background(), filter)
+	return err
+}
+
+func (s *MongoStore) GetFileMetadata(filename string) (*FileMetadata, error) {
+	filter := bson.M{"filename": filename}
+	result := s.metadata.FindOne(context.Background(), filter)
+	if result.Err() == mongo.ErrNoDocuments {
+		return nil, nil
+	} else if result.Err() != nil {
+		return nil, result.Err()
+	}
+
+	var file FileMetadata
+	err := result.Decode(&file)
+	if err != nil {
+		return nil, err
+	}
+
+	return &file, nil
+}
+
+func (s *MongoStore) ListFileMetadata(prefix string) ([]FileMetadata, error) {
+	filter := bson.M{"filename": bson.M{"$regex": "^" + regexp.QuoteMeta(prefix)}}
+	opts := options.Find().SetSort(bson.M{"filename": 1})
+	cursor, err := s.metadata.Find(context.Background(), filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+
+	var files []FileMetadata
+	if err := cursor.All(context.Background(), &files); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+func (s *MongoStore) GetVersions(filename string) ([]Version, error) {
+	filter := bson.M{"filename": filename}
+	opts := options.Find().SetSort(bson.M{"versions.version": 1})
+	cursor, err := s.files.Find(context.Background(), filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+
+	var versions []Version
+	for cursor.Next(context.Background()) {
+		var fileMetadata VFileMetadata
+		err := cursor.Decode(&fileMetadata)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, fileMetadata.Versions...)
+	}
+
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+
+	return versions, nil
+}
+
+func (s *MongoStore) LatestVersion(filename string) (int, error) {
+	// Create a filter to match the desired filename
+	filter := bson.M{"filename": filename}
+
+	// Define the projection to retrieve only the latest version
+	projection := bson.M{"versions": bson.M{"$slice": -1}}
+
+	// Execute the query and retrieve the single result
+	result := s.files.FindOne(context.Background(), filter, options.FindOne().SetProjection(projection).SetSort(bson.M{"versions.version": -1}))
+	if result.Err() == mongo.ErrNoDocuments {
+		return 0, nil // No documents found for the filename
+	} else if result.Err() != nil {
+		return 0, result.Err() // Error occurred during the query
+	}
+
+	// Decode the result into a structure that includes the version field
+	var fileMetadata struct {
+		Versions []struct {
+			Version int `bson:"version"`
+		} `bson:"versions"`
+	}
+	err := result.Decode(&fileMetadata)
+	if err != nil {
+		return 0, err // Error occurred during result decoding
+	}
+
+	if len(fileMetadata.Versions) > 0 {
+		return fileMetadata.Versions[0].Version, nil
+	}
+
+	return 0, nil // No versions found for the filename
+}
+
+func (s *MongoStore) AppendVersion(filename string, version Version) error {
+	filter := bson.M{"filename": filename}
+	update := bson.M{
+		// Versions may be appended out of order by concurrent writers; keep
+		// the array sorted so the last entry is always the latest.
+		"$push": bson.M{"versions": bson.M{
+			"$each": []Version{version},
+			"$sort": bson.M{"version": 1},
+		}},
+		"$set": bson.M{
+			"updated_at": time.Now().UTC(),
+		},
+		"$setOnInsert": bson.M{
+			"created_at": time.Now().UTC(),
+		},
+	}
+
+	_, err := s.files.UpdateOne(context.Background(), filter, update, options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		// Another writer created the document first; append to it.
+		_, err = s.files.UpdateOne(context.Background(), filter, update)
+	}
+	return err
+}
+
+func (s *MongoStore) RemoveVersion(filename string, version int) error {
+	filter := bson.M{"filename": filename}
+	update := bson.M{
+		"$pull": bson.M{"versions": bson.M{"version": version}},
+		"$set": bson.M{
+			"updated_at": time.Now().UTC(),
+		},
+	}
+
+	_, err := s.files.UpdateOne(context.Background(), filter, update)
+	return err
+}
+
+func (s *MongoStore) ListHistories(prefix string) ([]string, error) {
+	filter := bson.M{
+		"filename":   bson.M{"$regex": "^" + regexp.QuoteMeta(prefix)},
+		"versions.0": bson.M{"$exists": true},
+	}
+	values, err := s.files.Distinct(context.Background(), "filename", filter)
+	if err != nil {
+		return nil, err
+	}
+
+	filenames := make([]string, 0, len(values))
+	for _, value := range values {
+		if filename, ok := value.(string); ok {
+			filenames = append(filenames, filename)
+		}
+	}
+
+	sort.Strings(filenames)
+	return filenames, nil
+}
+
+func (s *MongoStore) RenameHistory(oldName, newName string) error {
+	// A history whose versions were all removed still has a document.
+	_, err := s.files.DeleteOne(context.Background(), bson.M{"filename": newName, "versions": bson.M{"$size": 0}})
+	if err != nil {
+		return err
+	}
+
+	filter := bson.M{"filename": oldName}
+	update := bson.M{"$set": bson.M{
+		"filename":   newName,
+		"updated_at": time.Now().UTC(),
+	}}
+	_, err = s.files.UpdateOne(context.Background(), filter, update)
+	return err
+}
+
+// Records are stored as {_id: key, value: value} documents in a collection
+// of their own.
+type mongoRecord struct {
+	Value bson.RawValue `bson:"value"`
+}
+
+func (s *MongoStore) PutRecord(collection, key string, value interface{}) error {
+	filter := bson.M{"_id": key}
+	update := bson.M{"$set": bson.M{"value": value}}
+	_, err := s.db.Collection(collection).UpdateOne(context.Background(), filter, update, options.Update().SetUpsert(true))
+	return err
+}
+
+func (s *MongoStore) GetRecord(collection, key string, value interface{}) error {
+	var record mongoRecord
+	err := s.db.Collection(collection).FindOne(context.Background(), bson.M{"_id": key}).Decode(&record)
+	if err == mongo.ErrNoDocuments {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
+
+	return record.Value.Unmarshal(value)
+}
+
+func (s *MongoStore) DeleteRecord(collection, key string) error {
+	_, err := s.db.Collection(collection).DeleteOne(context.Background(), bson.M{"_id": key})
+	return err
+}
+
+func (s *MongoStore) PutRecords(collection string, records map[string]interface{}) error {
+	if len(records) == 0 {
+		return nil
+	}
+	models := make([]mongo.WriteModel, 0, len(records))
+	for key, value := range records {
+		filter := bson.M{"_id": key}
+		if value == nil {
+			models = append(models, mongo.NewDeleteOneModel().SetFilter(filter))
+		} else {
+			update := bson.M{"$set": bson.M{"value": value}}
+			models = append(models, mongo.NewUpdateOneModel().SetFilter(filter).SetUpdate(update).SetUpsert(true))
+		}
+	}
+	_, err := s.db.Collection(collection).BulkWrite(context.Background(), models, options.BulkWrite().SetOrdered(false))
+	return err
+}
+
+func (s *MongoStore) ListRecords(collection, prefix string) ([]string, error) {
+	filter := bson.M{"_id": bson.M{"$regex": "^" + regexp.QuoteMeta(prefix)}}
+	opts := options.Find().SetProjection(bson.M{"_id": 1})
+	cursor, err := s.db.Collection(collection).Find(context.Background(), filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+
+	var keys []string
+	for cursor.Next(context.Background()) {
+		var doc struct {
+			ID string `bson:"_id"`
+		}
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, err
+		}
+		keys = append(keys, doc.ID)
+	}
+
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (s *MongoStore) Increment(collection, key string, delta int64) (int64, error) {
+	filter := bson.M{"_id": key}
+	update := bson.M{"$inc": bson.M{"value": delta}}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+
+	var doc struct {
+		Value int64 `bson:"value"`
+	}
+	err := s.db.Collection(collection).FindOneAndUpdate(context.Background(), filter, update, opts).Decode(&doc)
+	if err != nil {
+		return 0, err
+	}
+
+	return doc.Value, nil
+}
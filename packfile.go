@@ -0,0 +1,674 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A pack file keeps the whole VFS in a single image:
+//
+//	[header][data][index][data][index]...
+//
+// The header is fixed size and points at the current index. Contents are
+// only ever appended; every change appends the new data followed by a fresh
+// copy of the index and then rewrites the header, so a crash before the
+// header is updated leaves the previous index intact. Overwritten and
+// deleted entries, and old copies of the index, are reclaimed by Compact.
+
+const (
+	packMagic      = "VFSPACK\x00"
+	packVersion    = 1
+	packHeaderSize = 64
+
+	// packTempPattern, after the name of the pack file, names the files
+	// streamed writes are kept in until they are appended.
+	packTempPattern = ".*.tmp"
+)
+
+type packHeader struct {
+	Magic         [8]byte
+	Version       uint32
+	_             uint32
+	IndexOffset   uint64
+	IndexLength   uint64
+	IndexChecksum uint32
+	_             [28]byte
+}
+
+type packEntry struct {
+	Name     string    `json:"name"`
+	Offset   int64     `json:"offset"`
+	Length   int64     `json:"length"`
+	Checksum uint32    `json:"checksum"`
+	ModTime  time.Time `json:"mod_time"`
+	IsDir    bool      `json:"is_dir,omitempty"`
+}
+
+// PackBackend is a StorageBackend that stores every file in one pack file.
+type PackBackend struct {
+	mutex   sync.RWMutex
+	path    string
+	file    *os.File
+	size    int64
+	index   map[string]packEntry
+	garbage int64
+
+	// refs counts the entries pointing at the data at each offset, as
+	// copies share the data of their source.
+	refs map[int64]int
+
+	// indexLength is the size of the index the header currently points at.
+	indexLength int64
+}
+
+// OpenPackBackend opens the pack file at path, creating an empty one if it
+// does not exist yet.
+func OpenPackBackend(path string) (*PackBackend, error) {
+	// Writes that never finished leave their files behind.
+	leftovers, _ := filepath.Glob(path + packTempPattern)
+	for _, leftover := range leftovers {
+		os.Remove(leftover)
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &PackBackend{
+		path:  path,
+		file:  file,
+		index: make(map[string]packEntry),
+		refs:  make(map[int64]int),
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if info.Size() == 0 {
+		b.size = packHeaderSize
+		err = b.commit()
+	} else {
+		b.size = info.Size()
+		err = b.load()
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return b, nil
+}
+
+func (b *PackBackend) load() error {
+	var header packHeader
+	buf := make([]byte, packHeaderSize)
+	if _, err := b.file.ReadAt(buf, 0); err != nil {
+		return fmt.Errorf("failed to read pack header: %v", err)
+	}
+	if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, &header); err != nil {
+		return err
+	}
+	if string(header.Magic[:]) != packMagic {
+		return fmt.Errorf("%s is not a pack file", b.path)
+	}
+	if header.Version != packVersion {
+		return fmt.Errorf("unsupported pack version %d", header.Version)
+	}
+
+	indexData := make([]byte, header.IndexLength)
+	if _, err := b.file.ReadAt(indexData, int64(header.IndexOffset)); err != nil {
+		return fmt.Errorf("failed to read pack index: %v", err)
+	}
+	if crc32.ChecksumIEEE(indexData) != header.IndexChecksum {
+		return fmt.Errorf("pack index checksum mismatch")
+	}
+
+	var entries []packEntry
+	if err := json.Unmarshal(indexData, &entries); err != nil {
+		return fmt.Errorf("failed to decode pack index: %v", err)
+	}
+
+	var live int64
+	for _, entry := range entries {
+		b.index[entry.Name] = entry
+		if b.ref(entry) == 1 {
+			live += entry.Length
+		}
+	}
+	b.indexLength = int64(header.IndexLength)
+	b.garbage = b.size - packHeaderSize - live - b.indexLength
+
+	return nil
+}
+
+// update sets the index entry of key, or removes it if entry is nil, and
+// commits the index. If the commit fails the previous entry is put back,
+// and the data written for the new one counts as garbage. Callers must
+// hold the write lock.
+func (b *PackBackend) update(key string, entry *packEntry) error {
+	old, hadOld := b.index[key]
+	garbage := b.garbage
+
+	b.set(key, entry)
+	if err := b.commit(); err != nil {
+		if hadOld {
+			b.set(key, &old)
+		} else {
+			b.set(key, nil)
+		}
+		b.garbage = garbage
+		if entry != nil && entry.Length > 0 && b.refs[entry.Offset] == 0 {
+			b.garbage += entry.Length
+		}
+		return err
+	}
+	return nil
+}
+
+// set replaces the index entry of key, or removes it if entry is nil. Data
+// no entry points at any more counts as garbage.
+func (b *PackBackend) set(key string, entry *packEntry) {
+	old, hadOld := b.index[key]
+	if entry != nil {
+		b.index[key] = *entry
+		b.ref(*entry)
+	} else {
+		delete(b.index, key)
+	}
+	if hadOld && old.Length > 0 {
+		b.refs[old.Offset]--
+		if b.refs[old.Offset] == 0 {
+			delete(b.refs, old.Offset)
+			b.garbage += old.Length
+		}
+	}
+}
+
+// ref counts one more entry pointing at the data of entry and returns how
+// many there are. Empty entries point at no data.
+func (b *PackBackend) ref(entry packEntry) int {
+	if entry.Length == 0 {
+		return 0
+	}
+	b.refs[entry.Offset]++
+	return b.refs[entry.Offset]
+}
+
+// commit appends the current index and points the header at it. Callers
+// must hold the write lock.
+func (b *PackBackend) commit() error {
+	entries := make([]packEntry, 0, len(b.index))
+	for _, entry := range b.index {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+
+	indexData, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+
+	indexOffset := b.size
+	if _, err := b.file.WriteAt(indexData, indexOffset); err != nil {
+		return err
+	}
+	if err := b.file.Sync(); err != nil {
+		return err
+	}
+
+	if err := writePackHeader(b.file, indexOffset, indexData); err != nil {
+		return err
+	}
+	if err := b.file.Sync(); err != nil {
+		return err
+	}
+
+	// The index we just superseded is garbage now.
+	b.garbage += b.indexLength
+	b.size = indexOffset + int64(len(indexData))
+	b.indexLength = int64(len(indexData))
+
+	return nil
+}
+
+func writePackHeader(file *os.File, indexOffset int64, indexData []byte) error {
+	header := packHeader{
+		Version:       packVersion,
+		IndexOffset:   uint64(indexOffset),
+		IndexLength:   uint64(len(indexData)),
+		IndexChecksum: crc32.ChecksumIEEE(indexData),
+	}
+	copy(header.Magic[:], packMagic)
+
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, &header); err != nil {
+		return err
+	}
+	_, err := file.WriteAt(buf.Bytes(), 0)
+	return err
+}
+
+func (b *PackBackend) Put(name string, data []byte) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	key := cleanKey(name)
+	if key == "" {
+		return &os.PathError{Op: "put", Path: name, Err: os.ErrInvalid}
+	}
+	if old, ok := b.index[key]; ok && old.IsDir {
+		return &os.PathError{Op: "put", Path: name, Err: fmt.Errorf("is a directory")}
+	}
+
+	offset := b.size
+	if _, err := b.file.WriteAt(data, offset); err != nil {
+		return err
+	}
+	b.size += int64(len(data))
+
+	return b.update(key, &packEntry{
+		Name:     key,
+		Offset:   offset,
+		Length:   int64(len(data)),
+		Checksum: crc32.ChecksumIEEE(data),
+		ModTime:  time.Now().UTC(),
+	})
+}
+
+func (b *PackBackend) Get(name string) ([]byte, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	entry, ok := b.index[cleanKey(name)]
+	if !ok || entry.IsDir {
+		return nil, &os.PathError{Op: "get", Path: name, Err: os.ErrNotExist}
+	}
+
+	data := make([]byte, entry.Length)
+	if _, err := b.file.ReadAt(data, entry.Offset); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(data) != entry.Checksum {
+		return nil, fmt.Errorf("checksum mismatch for %s", entry.Name)
+	}
+
+	return data, nil
+}
+
+// Open reads an entry through its own file handle, so a concurrent Compact
+// does not pull the data out from under it.
+func (b *PackBackend) Open(name string) (io.ReadCloser, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	entry, ok := b.index[cleanKey(name)]
+	if !ok || entry.IsDir {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+
+	file, err := os.Open(b.path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &packReader{
+		file:  file,
+		entry: entry,
+		r:     io.NewSectionReader(file, entry.Offset, entry.Length),
+		crc:   crc32.NewIEEE(),
+	}, nil
+}
+
+// Create writes a new entry. What is written goes to a file of its own
+// next to the pack file, so readers and other writers are not held up; it
+// is appended to the pack file when the returned writer is closed.
+func (b *PackBackend) Create(name string) (io.WriteCloser, error) {
+	key := cleanKey(name)
+	if key == "" {
+		return nil, &os.PathError{Op: "create", Path: name, Err: os.ErrInvalid}
+	}
+
+	b.mutex.RLock()
+	old, ok := b.index[key]
+	b.mutex.RUnlock()
+	if ok && old.IsDir {
+		return nil, &os.PathError{Op: "create", Path: name, Err: fmt.Errorf("is a directory")}
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(b.path), filepath.Base(b.path)+packTempPattern)
+	if err != nil {
+		return nil, err
+	}
+	return &packWriter{b: b, key: key, tmp: tmp, crc: crc32.NewIEEE()}, nil
+}
+
+type packReader struct {
+	file  *os.File
+	entry packEntry
+	r     io.Reader
+	crc   hash.Hash32
+}
+
+func (r *packReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.crc.Write(p[:n])
+	if err == io.EOF && r.crc.Sum32() != r.entry.Checksum {
+		return n, fmt.Errorf("checksum mismatch for %s", r.entry.Name)
+	}
+	return n, err
+}
+
+func (r *packReader) Close() error {
+	return r.file.Close()
+}
+
+type packWriter struct {
+	b      *PackBackend
+	key    string
+	tmp    *os.File
+	length int64
+	crc    hash.Hash32
+	err    error
+	closed bool
+}
+
+func (w *packWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, os.ErrClosed
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	n, err := w.tmp.Write(p)
+	w.crc.Write(p[:n])
+	w.length += int64(n)
+	w.err = err
+	return n, err
+}
+
+// Close appends what was written to the pack file and points the index at
+// it. The pack file is only locked while doing so.
+func (w *packWriter) Close() error {
+	if w.closed {
+		return os.ErrClosed
+	}
+	w.closed = true
+	defer os.Remove(w.tmp.Name())
+	defer w.tmp.Close()
+
+	if w.err != nil {
+		return w.err
+	}
+	if _, err := w.tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	b := w.b
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if old, ok := b.index[w.key]; ok && old.IsDir {
+		return &os.PathError{Op: "create", Path: w.key, Err: fmt.Errorf("is a directory")}
+	}
+
+	offset := b.size
+	n, err := io.Copy(io.NewOffsetWriter(b.file, offset), w.tmp)
+	b.size += n
+	if err == nil && n != w.length {
+		err = io.ErrShortWrite
+	}
+	if err != nil {
+		// Whatever was appended is garbage.
+		b.garbage += n
+		return err
+	}
+
+	return b.update(w.key, &packEntry{
+		Name:     w.key,
+		Offset:   offset,
+		Length:   w.length,
+		Checksum: w.crc.Sum32(),
+		ModTime:  time.Now().UTC(),
+	})
+}
+
+func (w *packWriter) Abort() error {
+	if w.err == nil {
+		w.err = fmt.Errorf("write aborted")
+	}
+	w.Close()
+	return nil
+}
+
+func (b *PackBackend) Delete(name string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	key := cleanKey(name)
+	entry, ok := b.index[key]
+	if !ok {
+		return &os.PathError{Op: "delete", Path: name, Err: os.ErrNotExist}
+	}
+	if entry.IsDir && b.hasChildren(key) {
+		return &os.PathError{Op: "delete", Path: name, Err: fmt.Errorf("directory not empty")}
+	}
+
+	return b.update(key, nil)
+}
+
+// Copy adds dst as an entry pointing at the data of src, so no bytes are
+// written besides the index. Later writes to either append data of their
+// own.
+func (b *PackBackend) Copy(src, dst string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	entry, ok := b.index[cleanKey(src)]
+	if !ok || entry.IsDir {
+		return &os.PathError{Op: "copy", Path: src, Err: os.ErrNotExist}
+	}
+	key := cleanKey(dst)
+	if key == "" {
+		return &os.PathError{Op: "copy", Path: dst, Err: os.ErrInvalid}
+	}
+	if old, ok := b.index[key]; ok && old.IsDir {
+		return &os.PathError{Op: "copy", Path: dst, Err: fmt.Errorf("is a directory")}
+	}
+
+	entry.Name = key
+	entry.ModTime = time.Now().UTC()
+	return b.update(key, &entry)
+}
+
+func (b *PackBackend) Stat(name string) (*ObjectInfo, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	key := cleanKey(name)
+	if entry, ok := b.index[key]; ok {
+		return &ObjectInfo{Name: key, Size: entry.Length, ModTime: entry.ModTime, IsDir: entry.IsDir}, nil
+	}
+	if key == "" || b.hasChildren(key) {
+		return &ObjectInfo{Name: key, IsDir: true}, nil
+	}
+	return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+}
+
+func (b *PackBackend) List(dir string) ([]ObjectInfo, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	prefix := cleanKey(dir)
+	if prefix != "" {
+		entry, ok := b.index[prefix]
+		if ok && !entry.IsDir || !ok && !b.hasChildren(prefix) {
+			return nil, &os.PathError{Op: "list", Path: dir, Err: os.ErrNotExist}
+		}
+		prefix += "/"
+	}
+
+	seen := make(map[string]bool)
+	var infos []ObjectInfo
+	for key, entry := range b.index {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		rest := key[len(prefix):]
+		if i := strings.Index(rest, "/"); i >= 0 {
+			child := prefix + rest[:i]
+			if !seen[child] {
+				seen[child] = true
+				infos = append(infos, ObjectInfo{Name: child, IsDir: true})
+			}
+			continue
+		}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		infos = append(infos, ObjectInfo{Name: key, Size: entry.Length, ModTime: entry.ModTime, IsDir: entry.IsDir})
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos, nil
+}
+
+func (b *PackBackend) Mkdir(name string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	key := cleanKey(name)
+	if _, ok := b.index[key]; ok || key == "" || b.hasChildren(key) {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	}
+	if parent := path.Dir(key); parent != "." {
+		if entry, ok := b.index[parent]; ok && !entry.IsDir {
+			return &os.PathError{Op: "mkdir", Path: name, Err: fmt.Errorf("not a directory")}
+		}
+	}
+
+	return b.update(key, &packEntry{Name: key, ModTime: time.Now().UTC(), IsDir: true})
+}
+
+func (b *PackBackend) hasChildren(key string) bool {
+	prefix := key + "/"
+	for name := range b.index {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Garbage returns the number of bytes that Compact would reclaim.
+func (b *PackBackend) Garbage() int64 {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	return b.garbage
+}
+
+// Compact rewrites the pack file with only the live entries and swaps it in
+// place of the current one.
+func (b *PackBackend) Compact() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	tmpPath := b.path + ".compact"
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	compacted := &PackBackend{
+		path:  b.path,
+		file:  tmp,
+		size:  packHeaderSize,
+		index: make(map[string]packEntry, len(b.index)),
+		refs:  make(map[int64]int, len(b.refs)),
+	}
+
+	// Entries sharing data keep sharing it.
+	moved := make(map[int64]int64, len(b.refs))
+	for key, entry := range b.index {
+		if offset, ok := moved[entry.Offset]; ok && entry.Length > 0 {
+			entry.Offset = offset
+		} else if !entry.IsDir {
+			data := make([]byte, entry.Length)
+			if _, err := b.file.ReadAt(data, entry.Offset); err != nil {
+				tmp.Close()
+				os.Remove(tmpPath)
+				return err
+			}
+			if _, err := tmp.WriteAt(data, compacted.size); err != nil {
+				tmp.Close()
+				os.Remove(tmpPath)
+				return err
+			}
+			if entry.Length > 0 {
+				moved[entry.Offset] = compacted.size
+			}
+			entry.Offset = compacted.size
+			compacted.size += entry.Length
+		}
+		compacted.index[key] = entry
+		compacted.ref(entry)
+	}
+
+	if err := compacted.commit(); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := os.Rename(tmpPath, b.path); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	b.file.Close()
+	b.file = tmp
+	b.size = compacted.size
+	b.index = compacted.index
+	b.refs = compacted.refs
+	b.indexLength = compacted.indexLength
+	b.garbage = 0
+
+	return syncDir(filepath.Dir(b.path))
+}
+
+// Close compacts the pack file if more than half of it is garbage and then
+// closes it.
+func (b *PackBackend) Close() error {
+	b.mutex.RLock()
+	compact := b.garbage*2 > b.size
+	b.mutex.RUnlock()
+
+	if compact {
+		if err := b.Compact(); err != nil {
+			fmt.Println("Error compacting pack file:", err)
+		}
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.file.Close()
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// packData returns how many bytes of the pack file hold file contents.
+func packData(b *PackBackend) int64 {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	return b.size - packHeaderSize - b.indexLength - b.garbage
+}
+
+func TestPackCopySharesData(t *testing.T) {
+	dir := t.TempDir()
+	pack, err := OpenPackBackend(filepath.Join(dir, "vfs.pack"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := OpenEmbeddedStore(filepath.Join(dir, "metadata.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	fs := NewFileSystem(dir, pack, NewVersioning(store, NewBlobStore(pack, store)))
+	if err := NewAuthService(store, pack).Signup("al", "secret", "USER"); err != nil {
+		t.Fatal(err)
+	}
+	fs.SetHome("al")
+	fs.SetUser("al", nil)
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	if err := fs.CreateFile("a.bin", data); err != nil {
+		t.Fatal(err)
+	}
+
+	before := packData(pack)
+	if err := fs.Copy("a.bin", "b.bin"); err != nil {
+		t.Fatal(err)
+	}
+	if after := packData(pack); after != before {
+		t.Errorf("copy grew the pack data from %d to %d bytes", before, after)
+	}
+
+	// Replacing the original leaves the copy alone.
+	if err := fs.UpdateFile("a.bin", []byte("changed")); err != nil {
+		t.Fatal(err)
+	}
+	if err := pack.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := fs.ReadFile("b.bin"); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("copy after compaction: %d bytes, %v", len(got), err)
+	}
+	if err := pack.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	pack, err = OpenPackBackend(filepath.Join(dir, "vfs.pack"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pack.Close()
+	if garbage := pack.Garbage(); garbage != 0 {
+		t.Errorf("reopened pack has %d bytes of garbage, want 0", garbage)
+	}
+	if got, err := pack.Get("al/b.bin"); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("copy after reopening: %d bytes, %v", len(got), err)
+	}
+}
+
+func TestPackWriterDoesNotBlockReaders(t *testing.T) {
+	pack, err := OpenPackBackend(filepath.Join(t.TempDir(), "vfs.pack"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pack.Close()
+	if err := pack.Put("a.txt", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := pack.Create("b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("streamed")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reads and other writes go ahead while the writer is open.
+	done := make(chan error, 1)
+	go func() {
+		if _, err := pack.Get("a.txt"); err != nil {
+			done <- err
+			return
+		}
+		done <- pack.Put("c.txt", []byte("put"))
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("an open writer blocked the pack file")
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := pack.Get("b.txt"); err != nil || string(got) != "streamed" {
+		t.Errorf("streamed entry: %q, %v", got, err)
+	}
+
+	aborted, err := pack.Create("d.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	aborted.Write([]byte("never"))
+	aborted.(interface{ Abort() error }).Abort()
+	if _, err := pack.Stat("d.txt"); err == nil {
+		t.Error("aborted entry was added")
+	}
+	if leftovers, _ := filepath.Glob(pack.path + packTempPattern); len(leftovers) > 0 {
+		t.Errorf("writes left %v behind", leftovers)
+	}
+}
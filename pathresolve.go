@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// PermissionError is returned when a path resolves to somewhere the caller
+// is not allowed to go. It matches os.ErrPermission with errors.Is.
+type PermissionError struct {
+	Op     string
+	Path   string
+	Reason string
+}
+
+func (e *PermissionError) Error() string {
+	return fmt.Sprintf("%s %s: permission denied: %s", e.Op, e.Path, e.Reason)
+}
+
+func (e *PermissionError) Unwrap() error {
+	return os.ErrPermission
+}
+
+// linkResolver is implemented by backends whose entries may be symbolic
+// links on the underlying storage. ResolveLinks returns the key name really
+// refers to, or an error if it points outside the backend.
+type linkResolver interface {
+	ResolveLinks(name string) (string, error)
+}
+
+// resolvePath turns a user-supplied name into a backend key. Relative names
+// are taken from base, absolute names from sandbox, and the result must stay
+// inside sandbox: ".." cannot climb out of it and neither can a symbolic
+// link on the backend. Top-level entries starting with a dot belong to the
+// VFS itself (blobs and the like) and are never reachable.
+func resolvePath(backend StorageBackend, op, sandbox, base, name string) (string, error) {
+	slashed := filepath.ToSlash(name)
+
+	var joined string
+	if path.IsAbs(slashed) {
+		joined = path.Join("/", sandbox, slashed)
+	} else {
+		joined = path.Join("/", base, slashed)
+	}
+	key := cleanKey(joined)
+
+	if !withinKey(key, sandbox) {
+		return "", &PermissionError{Op: op, Path: name, Reason: "outside of your home directory"}
+	}
+	if isReservedKey(key) {
+		return "", &PermissionError{Op: op, Path: name, Reason: "reserved path"}
+	}
+
+	if lr, ok := backend.(linkResolver); ok {
+		target, err := lr.ResolveLinks(key)
+		if err != nil {
+			return "", &PermissionError{Op: op, Path: name, Reason: err.Error()}
+		}
+		if !withinKey(target, sandbox) || isReservedKey(target) {
+			return "", &PermissionError{Op: op, Path: name, Reason: "link points outside of your home directory"}
+		}
+	}
+
+	return key, nil
+}
+
+// withinKey reports whether key is dir or below it. Every key is within
+// the root "".
+func withinKey(key, dir string) bool {
+	return dir == "" || key == dir || strings.HasPrefix(key, dir+"/")
+}
+
+func isReservedKey(key string) bool {
+	return strings.HasPrefix(key, ".")
+}
+
+// ResolveLinks follows symbolic links on disk and returns the key the
+// deepest existing part of name really refers to, joined with the rest.
+func (b *LocalBackend) ResolveLinks(name string) (string, error) {
+	root, err := filepath.Abs(b.Root)
+	if err != nil {
+		return "", err
+	}
+	root, err = filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+
+	existing := filepath.Join(root, filepath.FromSlash(cleanKey(name)))
+	rest := ""
+	for existing != root {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		}
+		rest = filepath.Join(filepath.Base(existing), rest)
+		existing = filepath.Dir(existing)
+	}
+
+	real, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		return "", err
+	}
+
+	rel, err := filepath.Rel(root, filepath.Join(real, rest))
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("link points outside of the storage directory")
+	}
+	return cleanKey(rel), nil
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// permissionRecords is the record collection holding the owner, group and
+// mode of files and directories, keyed like version history.
+const permissionRecords = "permissions"
+
+// Permission bits, as in the lowest octal digit of a mode.
+const (
+	permRead  = 4
+	permWrite = 2
+	permExec  = 1
+)
+
+// Permissions are the owner, group and mode bits of a file or directory.
+// Entries without a record of their own belong to the user whose home
+// directory they are in, with mode 0644 for files and 0755 for directories.
+type Permissions struct {
+	Owner string      `bson:"owner"`
+	Group string      `bson:"group"`
+	Mode  os.FileMode `bson:"mode"`
+}
+
+// MaintenanceUser is given to SetUser by administrative tasks that work on
+// every user's files: nothing is checked for it. It starts with a dot, so
+// no account can be named after it.
+const MaintenanceUser = ".maintenance"
+
+// SetUser makes username, a member of groups, the user every operation is
+// checked against. Without a user every check fails; MaintenanceUser
+// passes them all.
+func (fs *FileSystem) SetUser(username string, groups []string) {
+	fs.user = username
+	fs.groups = groups
+}
+
+// permissions returns the permissions of the entry at key.
+func (fs *FileSystem) permissions(key string, isDir bool) (*Permissions, error) {
+	var perm Permissions
+	err := fs.Versioning.store.GetRecord(permissionRecords, key, &perm)
+	if err == nil {
+		return &perm, nil
+	} else if err != ErrNotFound {
+		return nil, err
+	}
+
+	owner := strings.SplitN(key, "/", 2)[0]
+	perm = Permissions{Owner: owner, Group: owner, Mode: 0644}
+	if isDir {
+		perm.Mode = 0755
+	}
+	return &perm, nil
+}
+
+// allowed reports whether the current user has every bit of want on perm.
+func (fs *FileSystem) allowed(perm *Permissions, want os.FileMode) bool {
+	bits := perm.Mode & 7
+	if fs.user == perm.Owner {
+		bits = perm.Mode >> 6 & 7
+	} else if fs.user == perm.Group || hasTag(fs.groups, perm.Group) {
+		bits = perm.Mode >> 3 & 7
+	}
+	return bits&want == want
+}
+
+// access checks that the current user may use the entry at key as want
+// asks for. Every directory above it must be searchable too. name is only
+// used in errors.
+func (fs *FileSystem) access(op, name, key string, want os.FileMode) error {
+	if fs.user == MaintenanceUser {
+		return nil
+	}
+	if fs.user == "" {
+		return &PermissionError{Op: op, Path: name, Reason: "not logged in"}
+	}
+	if fs.home != "" && !withinKey(key, fs.home) && !isReservedKey(key) {
+		return fs.accessShared(op, name, key, want)
+	}
+	if fs.isSharedRoot(key) && want&permWrite != 0 {
+		return &PermissionError{Op: op, Path: name, Reason: "the shared directory is read-only"}
+	}
+
+	for dir := path.Dir(key); dir != "." && dir != "" && !isReservedKey(dir); dir = path.Dir(dir) {
+		perm, err := fs.permissions(dir, true)
+		if err != nil {
+			return err
+		}
+		if !fs.allowed(perm, permExec) {
+			return &PermissionError{Op: op, Path: name, Reason: fmt.Sprintf("cannot search '%s'", dir)}
+		}
+	}
+
+	info, err := fs.Backend.Stat(key)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	perm, err := fs.permissions(key, info.IsDir)
+	if err != nil {
+		return err
+	}
+	if !fs.allowed(perm, want) {
+		return &PermissionError{Op: op, Path: name, Reason: fmt.Sprintf("mode %04o, owner %s", perm.Mode, perm.Owner)}
+	}
+	return nil
+}
+
+// accessParent checks that the current user may change the directory
+// holding key, to add or remove it.
+func (fs *FileSystem) accessParent(op, name, key string) error {
+	if fs.isSharedRoot(key) {
+		return &PermissionError{Op: op, Path: name, Reason: "reserved path"}
+	}
+	dir := path.Dir(key)
+	if dir == "." {
+		dir = ""
+	}
+	if dir == "" {
+		// The top level only holds home directories, which are not
+		// created through the FileSystem.
+		return fs.access(op, name, key, 0)
+	}
+	return fs.access(op, name, dir, permWrite|permExec)
+}
+
+// accessWrite checks that the current user may write key: the file itself
+// if it exists, or the directory it would be created in.
+func (fs *FileSystem) accessWrite(op, name, key string) error {
+	if _, err := fs.Backend.Stat(key); os.IsNotExist(err) {
+		return fs.accessParent(op, name, key)
+	}
+	return fs.access(op, name, key, permWrite)
+}
+
+// setOwner gives a new entry at key to the current user, with mode.
+func (fs *FileSystem) setOwner(key string, mode os.FileMode) error {
+	if fs.user == "" || fs.user == MaintenanceUser {
+		return nil
+	}
+	perm := &Permissions{Owner: fs.user, Group: fs.user, Mode: mode}
+	return fs.Versioning.store.PutRecord(permissionRecords, key, perm)
+}
+
+// Chmod changes the mode bits of a file or directory. Only its owner may.
+func (fs *FileSystem) Chmod(name string, mode os.FileMode) error {
+	return fs.updatePermissions("chmod", name, func(perm *Permissions) {
+		perm.Mode = mode & os.ModePerm
+	})
+}
+
+// Chown changes the owner and group of a file or directory. Only its owner
+// may. An empty owner or group is left unchanged; others must exist.
+func (fs *FileSystem) Chown(name, owner, group string) error {
+	if owner != "" {
+		if err := fs.checkUser(owner); err != nil {
+			return err
+		}
+	}
+	if group != "" {
+		if err := fs.checkGroup(group); err != nil {
+			return err
+		}
+	}
+	return fs.updatePermissions("chown", name, func(perm *Permissions) {
+		if owner != "" {
+			perm.Owner = owner
+		}
+		if group != "" {
+			perm.Group = group
+		}
+	})
+}
+
+// checkUser returns an error unless user has an account.
+func (fs *FileSystem) checkUser(user string) error {
+	_, err := fs.Versioning.store.FindUser(user)
+	if err == ErrNotFound {
+		return fmt.Errorf("unknown user '%s'", user)
+	}
+	return err
+}
+
+// checkGroup returns an error unless group exists: every user has a group
+// of their own, and groups besides are those users are members of.
+func (fs *FileSystem) checkGroup(group string) error {
+	if _, err := fs.Versioning.store.FindUser(group); err != ErrNotFound {
+		return err
+	}
+	users, err := fs.Versioning.store.ListUsers()
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		if hasTag(user.Groups, group) {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown group '%s'", group)
+}
+
+func (fs *FileSystem) updatePermissions(op, name string, update func(perm *Permissions)) error {
+	key, err := fs.Resolve(op, name)
+	if err != nil {
+		return err
+	}
+
+	unlock := fs.locks.Lock(key)
+	defer unlock()
+
+	info, err := fs.Backend.Stat(key)
+	if err != nil {
+		return err
+	}
+	if err := fs.access(op, name, key, 0); err != nil {
+		return err
+	}
+	perm, err := fs.permissions(key, info.IsDir)
+	if err != nil {
+		return err
+	}
+	if fs.user != MaintenanceUser && fs.user != perm.Owner {
+		return &PermissionError{Op: op, Path: name, Reason: "only the owner can change permissions"}
+	}
+
+	update(perm)
+	return fs.Versioning.store.PutRecord(permissionRecords, key, perm)
+}
+
+// Permissions returns the permissions of a file or directory.
+func (fs *FileSystem) Permissions(name string) (*Permissions, error) {
+	key, err := fs.Resolve("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := fs.Backend.Stat(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := fs.access("stat", name, key, 0); err != nil {
+		return nil, err
+	}
+	return fs.permissions(key, info.IsDir)
+}
+
+// movePermissions moves the permission records of from and everything
+// below it over to to.
+func (fs *FileSystem) movePermissions(from, to string) error {
+	keys, err := fs.Versioning.store.ListRecords(permissionRecords, from)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if !withinKey(key, from) {
+			continue
+		}
+		var perm Permissions
+		if err := fs.Versioning.store.GetRecord(permissionRecords, key, &perm); err != nil {
+			return err
+		}
+		target := path.Join(to, strings.TrimPrefix(key, from))
+		if err := fs.Versioning.store.PutRecord(permissionRecords, target, &perm); err != nil {
+			return err
+		}
+		if err := fs.Versioning.store.DeleteRecord(permissionRecords, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
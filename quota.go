@@ -0,0 +1,404 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// quotaRecords is the record collection holding each user's Quota.
+const quotaRecords = "quotas"
+
+// usageRecords holds each user's Usage as counters under "<user>/bytes",
+// "<user>/history_bytes" and "<user>/files", kept up to date as files
+// change. A "<user>" record says the counters were set by counting.
+const usageRecords = "usage"
+
+// Quota limits what a user may keep in their home directory. A zero limit
+// means no limit.
+type Quota struct {
+	MaxBytes        int64 `bson:"max_bytes"`         // current contents
+	MaxHistoryBytes int64 `bson:"max_history_bytes"` // every recorded version
+	MaxFiles        int64 `bson:"max_files"`
+}
+
+// Usage is what a user keeps in their home directory, counted the way
+// Quota limits it. Files with several hard links count once; symbolic
+// links do not count.
+type Usage struct {
+	Bytes        int64
+	HistoryBytes int64
+	Files        int64
+}
+
+// counters returns the counter names of usage, and where their values go.
+func (u *Usage) counters() []struct {
+	name  string
+	value *int64
+} {
+	return []struct {
+		name  string
+		value *int64
+	}{
+		{"bytes", &u.Bytes},
+		{"history_bytes", &u.HistoryBytes},
+		{"files", &u.Files},
+	}
+}
+
+func (u Usage) negate() Usage {
+	return Usage{Bytes: -u.Bytes, HistoryBytes: -u.HistoryBytes, Files: -u.Files}
+}
+
+// QuotaError is returned for a change that would take a user over their
+// quota.
+type QuotaError struct {
+	Op       string
+	Path     string
+	User     string
+	Resource string
+	Used     int64
+	Limit    int64
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("%s %s: quota exceeded: %s would use %d of %d %s", e.Op, e.Path, e.User, e.Used, e.Limit, e.Resource)
+}
+
+// GetQuota returns the quota of user, which is zero if none was set.
+func (fs *FileSystem) GetQuota(user string) (*Quota, error) {
+	var quota Quota
+	err := fs.Versioning.store.GetRecord(quotaRecords, user, &quota)
+	if err == ErrNotFound {
+		return &quota, nil
+	}
+	return &quota, err
+}
+
+// SetQuota sets the quota of user. A zero Quota removes every limit.
+func (fs *FileSystem) SetQuota(user string, quota Quota) error {
+	if quota.MaxBytes < 0 || quota.MaxHistoryBytes < 0 || quota.MaxFiles < 0 {
+		return fmt.Errorf("quota limits cannot be negative")
+	}
+	if quota == (Quota{}) {
+		return fs.Versioning.store.DeleteRecord(quotaRecords, user)
+	}
+	return fs.Versioning.store.PutRecord(quotaRecords, user, &quota)
+}
+
+// Usage returns what user keeps in their home directory and their trash.
+// It is counted the first time it is asked for and kept up to date from
+// then on.
+func (fs *FileSystem) Usage(user string) (*Usage, error) {
+	usage, counted, err := fs.storedUsage(user)
+	if err != nil || counted {
+		return usage, err
+	}
+	return fs.RecomputeUsage(user)
+}
+
+// storedUsage returns the usage counters of user, and whether they were
+// ever set by counting.
+func (fs *FileSystem) storedUsage(user string) (*Usage, bool, error) {
+	var usage Usage
+	var counted bool
+	err := fs.Versioning.store.GetRecord(usageRecords, user, &counted)
+	if err == ErrNotFound {
+		return &usage, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	for _, counter := range usage.counters() {
+		err := fs.Versioning.store.GetRecord(usageRecords, user+"/"+counter.name, counter.value)
+		if err != nil && err != ErrNotFound {
+			return nil, false, err
+		}
+	}
+	return &usage, true, nil
+}
+
+// RecomputeUsage counts what user keeps by walking their files and
+// history, sets their usage counters to the result and returns it. Changes
+// made while it counts may be missed, so it is for when the counters are
+// first needed or have drifted, e.g. after a crash.
+func (fs *FileSystem) RecomputeUsage(user string) (*Usage, error) {
+	usage, err := fs.countUsage(user)
+	if err != nil {
+		return nil, err
+	}
+	stored, _, err := fs.storedUsage(user)
+	if err != nil {
+		return nil, err
+	}
+
+	want := usage.counters()
+	for i, counter := range stored.counters() {
+		if delta := *want[i].value - *counter.value; delta != 0 {
+			if _, err := fs.Versioning.store.Increment(usageRecords, user+"/"+counter.name, delta); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := fs.Versioning.store.PutRecord(usageRecords, user, true); err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
+
+// countUsage adds up what user keeps in their home directory and their
+// trash.
+func (fs *FileSystem) countUsage(user string) (*Usage, error) {
+	var usage Usage
+	seen := make(map[string]bool)
+
+	// What is in the trash counts until it is purged.
+	trash := path.Join(trashPrefix, user)
+	walk := func(info ObjectInfo) error {
+		if info.IsDir {
+			return nil
+		}
+		if _, ok, err := fs.readlinkKey(info.Name); err != nil || ok {
+			return err
+		}
+		key, err := fs.contentKey(info.Name)
+		if err != nil || seen[key] {
+			return err
+		}
+		seen[key] = true
+
+		if key != info.Name {
+			stat, err := fs.Backend.Stat(key)
+			if err != nil {
+				return err
+			}
+			info = *stat
+		}
+		usage.Files++
+		usage.Bytes += info.Size
+		return nil
+	}
+	for _, dir := range []string{user, trash} {
+		if err := walkBackend(fs.Backend, dir, walk); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		// Every file given a version since counters were introduced has
+		// one.
+		histories, err := fs.Versioning.store.ListRecords(versionCounters, dir+"/")
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range histories {
+			seen[key] = true
+		}
+	}
+
+	for key := range seen {
+		versions, err := fs.Versioning.GetAllVersions(key)
+		if err != nil {
+			return nil, err
+		}
+		for i := range versions {
+			usage.HistoryBytes += versions[i].Len()
+		}
+	}
+	return &usage, nil
+}
+
+// addUsage adds delta to the usage counters of owner. Users whose usage
+// was never counted are left alone; counting it finds the change.
+func (fs *FileSystem) addUsage(owner string, delta Usage) error {
+	if owner == "" || delta == (Usage{}) {
+		return nil
+	}
+	var counted bool
+	err := fs.Versioning.store.GetRecord(usageRecords, owner, &counted)
+	if err == ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, counter := range delta.counters() {
+		if *counter.value == 0 {
+			continue
+		}
+		if _, err := fs.Versioning.store.Increment(usageRecords, owner+"/"+counter.name, *counter.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fileUsage returns what the file at key adds to its owner's usage: its
+// contents and history. Links add nothing of their own.
+func (fs *FileSystem) fileUsage(key string) (Usage, error) {
+	var usage Usage
+	if _, ok, err := fs.readlinkKey(key); err != nil || ok {
+		return usage, err
+	}
+	if content, err := fs.contentKey(key); err != nil || content != key {
+		return usage, err
+	}
+
+	info, err := fs.Backend.Stat(key)
+	if err == nil && !info.IsDir {
+		usage.Files = 1
+		usage.Bytes = info.Size
+	} else if err != nil && !os.IsNotExist(err) {
+		return usage, err
+	}
+	versions, err := fs.Versioning.GetAllVersions(key)
+	if err != nil {
+		return usage, err
+	}
+	for i := range versions {
+		usage.HistoryBytes += versions[i].Len()
+	}
+	return usage, nil
+}
+
+// moveUsage moves the usage of the files a rename intent moved over to the
+// owner of its target, if that is someone else.
+func (fs *FileSystem) moveUsage(intent *Intent) error {
+	from, err := fs.quotaOwner(intent.Key)
+	if err != nil {
+		return err
+	}
+	to, err := fs.quotaOwner(intent.Target)
+	if err != nil || from == to {
+		return err
+	}
+
+	var moved Usage
+	for _, file := range intent.Files {
+		usage, err := fs.fileUsage(path.Join(intent.Target, file))
+		if err != nil {
+			return err
+		}
+		moved.Bytes += usage.Bytes
+		moved.HistoryBytes += usage.HistoryBytes
+		moved.Files += usage.Files
+	}
+	if err := fs.addUsage(from, moved.negate()); err != nil {
+		return err
+	}
+	return fs.addUsage(to, moved)
+}
+
+// quotaOwner returns the user whose quota a change to key counts against:
+// the one whose home directory, or trash, it is in.
+func (fs *FileSystem) quotaOwner(key string) (string, error) {
+	if strings.HasPrefix(key, inodePrefix+"/") {
+		var inode Inode
+		err := fs.Versioning.store.GetRecord(inodeRecords, strings.TrimPrefix(key, inodePrefix+"/"), &inode)
+		if err != nil {
+			return "", err
+		}
+		if len(inode.Names) == 0 {
+			return "", nil
+		}
+		key = inode.Names[0]
+	}
+	key = strings.TrimPrefix(key, trashPrefix+"/")
+	return strings.SplitN(key, "/", 2)[0], nil
+}
+
+// writeUsage returns how writing size bytes to key changes its owner's
+// usage.
+func (fs *FileSystem) writeUsage(key string, size int64) (Usage, error) {
+	usage := Usage{Bytes: size, HistoryBytes: size}
+	info, err := fs.Backend.Stat(key)
+	if os.IsNotExist(err) {
+		usage.Files = 1
+	} else if err != nil {
+		return usage, err
+	} else {
+		usage.Bytes -= info.Size
+	}
+	return usage, nil
+}
+
+// checkQuota returns a *QuotaError if adding delta to the usage of owner
+// would exceed their quota.
+func (fs *FileSystem) checkQuota(op, name, owner string, delta Usage) error {
+	quota, err := fs.GetQuota(owner)
+	if err != nil || *quota == (Quota{}) {
+		return err
+	}
+	usage, err := fs.Usage(owner)
+	if err != nil {
+		return err
+	}
+
+	limits := []struct {
+		resource           string
+		used, limit, added int64
+	}{
+		{"bytes", usage.Bytes + delta.Bytes, quota.MaxBytes, delta.Bytes},
+		{"bytes of history", usage.HistoryBytes + delta.HistoryBytes, quota.MaxHistoryBytes, delta.HistoryBytes},
+		{"files", usage.Files + delta.Files, quota.MaxFiles, delta.Files},
+	}
+	for _, l := range limits {
+		// Shrinking is always allowed, even when over the limit.
+		if l.limit > 0 && l.added > 0 && l.used > l.limit {
+			return &QuotaError{Op: op, Path: name, User: owner, Resource: l.resource, Used: l.used, Limit: l.limit}
+		}
+	}
+	return nil
+}
+
+// checkWriteQuota checks that size bytes may be written to key.
+func (fs *FileSystem) checkWriteQuota(op, name, key string, size int64) error {
+	owner, err := fs.quotaOwner(key)
+	if err != nil {
+		return err
+	}
+	delta, err := fs.writeUsage(key, size)
+	if err != nil {
+		return err
+	}
+	return fs.checkQuota(op, name, owner, delta)
+}
+
+// writeAllowance returns how many bytes may be written to key before its
+// owner's quota is exceeded, or -1 if there is no limit.
+func (fs *FileSystem) writeAllowance(op, name, key string) (int64, error) {
+	owner, err := fs.quotaOwner(key)
+	if err != nil {
+		return 0, err
+	}
+	quota, err := fs.GetQuota(owner)
+	if err != nil || *quota == (Quota{}) {
+		return -1, err
+	}
+	usage, err := fs.Usage(owner)
+	if err != nil {
+		return 0, err
+	}
+
+	var size int64
+	if info, err := fs.Backend.Stat(key); err == nil {
+		size = info.Size
+	} else if quota.MaxFiles > 0 && usage.Files+1 > quota.MaxFiles {
+		return 0, &QuotaError{Op: op, Path: name, User: owner, Resource: "files", Used: usage.Files + 1, Limit: quota.MaxFiles}
+	}
+
+	allowance := int64(-1)
+	limit := func(n int64) {
+		if n < 0 {
+			n = 0
+		}
+		if allowance < 0 || n < allowance {
+			allowance = n
+		}
+	}
+	if quota.MaxBytes > 0 {
+		limit(quota.MaxBytes - usage.Bytes + size)
+	}
+	if quota.MaxHistoryBytes > 0 {
+		limit(quota.MaxHistoryBytes - usage.HistoryBytes)
+	}
+	return allowance, nil
+}
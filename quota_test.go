@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestUsageOfFileWithoutMetadata(t *testing.T) {
+	fs := newTestFileSystem(t)
+	if err := fs.CreateFile("a.txt", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.RecomputeUsage("al"); err != nil {
+		t.Fatal(err)
+	}
+
+	// As for a file written before metadata was kept, or whose metadata
+	// failed to be recorded.
+	if err := fs.db.DeleteFileMetadata("al/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.UpdateFile("a.txt", []byte("hello, world")); err != nil {
+		t.Fatal(err)
+	}
+
+	usage, err := fs.Usage("al")
+	if err != nil {
+		t.Fatal(err)
+	}
+	counted, err := fs.countUsage("al")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *usage != *counted {
+		t.Errorf("usage %+v, counted %+v", *usage, *counted)
+	}
+	if usage.Files != 1 {
+		t.Errorf("%d files, want 1", usage.Files)
+	}
+}
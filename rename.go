@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// Rename moves a file or a directory, along with the version history of
+// every file it contains. The destination must not exist.
+func (fs *FileSystem) Rename(oldName, newName string) error {
+	oldKey, err := fs.lresolve("rename", oldName)
+	if err != nil {
+		return err
+	}
+	newKey, err := fs.lresolve("rename", newName)
+	if err != nil {
+		return err
+	}
+
+	if err := fs.accessParent("rename", oldName, oldKey); err != nil {
+		return err
+	}
+	if err := fs.accessParent("rename", newName, newKey); err != nil {
+		return err
+	}
+	if oldKey == fs.home {
+		return &PermissionError{Op: "rename", Path: oldName, Reason: "cannot move your home directory"}
+	}
+	if withinKey(newKey, oldKey) {
+		return &os.PathError{Op: "rename", Path: newName, Err: fmt.Errorf("cannot move a directory into itself")}
+	}
+	if _, err := fs.Backend.Stat(oldKey); err != nil {
+		return err
+	}
+	if _, err := fs.Backend.Stat(newKey); err == nil {
+		return &os.PathError{Op: "rename", Path: newName, Err: os.ErrExist}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := fs.moveKey(oldKey, newKey); err != nil {
+		return err
+	}
+
+	if withinKey(fs.cwd, oldKey) {
+		fs.chdirKey(path.Join(newKey, strings.TrimPrefix(fs.cwd, oldKey)))
+	}
+	return nil
+}
+
+// moveKey moves everything at oldKey, and its history, to newKey.
+func (fs *FileSystem) moveKey(oldKey, newKey string) error {
+	files, err := fs.filesBelow(oldKey)
+	if err != nil {
+		return err
+	}
+
+	// Lock both ends of every file being moved.
+	keys := make([]string, 0, 2*len(files))
+	for _, file := range files {
+		keys = append(keys, path.Join(oldKey, file), path.Join(newKey, file))
+	}
+	unlock := fs.locks.LockAll(keys)
+	defer unlock()
+
+	intent := &Intent{Op: intentRename, Key: oldKey, Target: newKey, Files: files}
+	if err := fs.intents.Begin(intent); err != nil {
+		return err
+	}
+
+	if err := renameBackend(fs.Backend, oldKey, newKey); err != nil {
+		// A backend without renames may have moved some of the files
+		// already; Recover finishes the move.
+		return err
+	}
+	if err := fs.moveHistories(intent); err != nil {
+		return fmt.Errorf("file moved but history not: %v", err)
+	}
+	if err := fs.moveUsage(intent); err != nil {
+		return err
+	}
+	return fs.intents.Done(intent)
+}
+
+// filesBelow returns the files in dir, relative to it. A file is returned
+// as "".
+func (fs *FileSystem) filesBelow(dir string) ([]string, error) {
+	var files []string
+	err := walkBackend(fs.Backend, dir, func(info ObjectInfo) error {
+		if !info.IsDir {
+			files = append(files, strings.TrimPrefix(strings.TrimPrefix(info.Name, dir), "/"))
+		}
+		return nil
+	})
+	return files, err
+}
+
+// moveHistories moves the permissions and ACLs of everything below a
+// rename intent's key, and the links, metadata and history of every file
+// it names. Files without one, including those whose history was already
+// moved, are skipped.
+func (fs *FileSystem) moveHistories(intent *Intent) error {
+	if err := fs.movePermissions(intent.Key, intent.Target); err != nil {
+		return err
+	}
+	if err := fs.moveACLs(intent.Key, intent.Target); err != nil {
+		return err
+	}
+
+	for _, file := range intent.Files {
+		from := path.Join(intent.Key, file)
+		to := path.Join(intent.Target, file)
+
+		if err := fs.moveLinks(from, to); err != nil {
+			return err
+		}
+		if err := fs.db.RenameFileMetadata(from, to); err != nil {
+			return err
+		}
+
+		if err := fs.reindex(from, to); err != nil {
+			return err
+		}
+
+		latest, err := fs.Versioning.GetLatestVersion(from)
+		if err != nil {
+			return err
+		}
+		events, err := fs.Versioning.GetEvents(from)
+		if err != nil {
+			return err
+		}
+		if latest == 0 && events == nil {
+			continue
+		}
+		if err := fs.Versioning.MoveHistory(from, to); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// scrubRecords holds the report of the last scrub, under "last".
+const scrubRecords = "scrub"
+
+// DefaultScrubInterval is how often the scrubber runs unless told otherwise.
+const DefaultScrubInterval = 24 * time.Hour
+
+var (
+	errScrubRunning = errors.New("a scrub is already running")
+	errScrubStopped = errors.New("stopped before finishing")
+)
+
+// ScrubIssue is stored content a scrub found damaged.
+type ScrubIssue struct {
+	Key    string `bson:"key"` // of the blob or file in storage
+	Detail string `bson:"detail"`
+	Healed bool   `bson:"healed"`
+	Source string `bson:"source,omitempty"` // where the good copy came from
+}
+
+// ScrubReport describes a scrub, finished or running.
+type ScrubReport struct {
+	Started  time.Time    `bson:"started"`
+	Finished time.Time    `bson:"finished"`
+	Total    int          `bson:"total"` // blobs and files to check
+	Blobs    int          `bson:"blobs"` // checked so far
+	Files    int          `bson:"files"`
+	Bytes    int64        `bson:"bytes"` // read so far
+	Issues   []ScrubIssue `bson:"issues"`
+	Error    string       `bson:"error,omitempty"`
+}
+
+// Unrecoverable returns the issues that could not be healed.
+func (r *ScrubReport) Unrecoverable() []ScrubIssue {
+	var issues []ScrubIssue
+	for _, issue := range r.Issues {
+		if !issue.Healed {
+			issues = append(issues, issue)
+		}
+	}
+	return issues
+}
+
+// Scrubber periodically re-reads everything stored, to find bit rot before
+// it spreads to backups. Every blob must still hash to its name, and every
+// file must still match the checksum of its latest version. Damaged
+// content is restored from a good copy: a blob from the mirror or from a
+// file holding the same bytes, a file from its latest version or the
+// mirror.
+type Scrubber struct {
+	fs *FileSystem
+
+	// Interval is the time between the end of one scrub and the start of
+	// the next; if zero, scrubs only run when asked to.
+	Interval time.Duration
+	// BytesPerSecond limits how fast a scrub reads; zero for no limit.
+	BytesPerSecond int64
+	// Mirror, if set, holds a copy of storage to heal from, with the same
+	// layout.
+	Mirror StorageBackend
+
+	mutex   sync.Mutex
+	current *ScrubReport // the running scrub, if any
+
+	trigger chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// NewScrubber creates a scrubber for fs. It does nothing until Start is
+// called.
+func NewScrubber(fs *FileSystem) *Scrubber {
+	return &Scrubber{
+		fs:       fs,
+		Interval: DefaultScrubInterval,
+		trigger:  make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Start runs scrubs in the background, the first one once Interval has
+// passed since the last recorded scrub finished, until Stop is called.
+func (s *Scrubber) Start() {
+	go s.run()
+}
+
+// Stop interrupts a running scrub and waits for the scrubber to exit.
+func (s *Scrubber) Stop() {
+	close(s.stop)
+	<-s.done
+}
+
+// RunNow asks the background scrubber to start a scrub now, unless one is
+// running already.
+func (s *Scrubber) RunNow() {
+	select {
+	case s.trigger <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Scrubber) run() {
+	defer close(s.done)
+	for {
+		var timer *time.Timer
+		var due <-chan time.Time
+		if s.Interval > 0 {
+			// A scrub that did not finish starts over right away.
+			wait := time.Duration(0)
+			if last, err := s.Last(); err == nil && last != nil && last.Error == "" {
+				wait = time.Until(last.Finished.Add(s.Interval))
+			}
+			timer = time.NewTimer(wait)
+			due = timer.C
+		}
+
+		select {
+		case <-s.stop:
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		case <-s.trigger:
+			if timer != nil {
+				timer.Stop()
+			}
+		case <-due:
+		}
+		// The outcome goes in the report.
+		s.Scrub()
+	}
+}
+
+// Status returns the running scrub, or nil if there is none.
+func (s *Scrubber) Status() *ScrubReport {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.current == nil {
+		return nil
+	}
+	report := *s.current
+	report.Issues = append([]ScrubIssue(nil), s.current.Issues...)
+	return &report
+}
+
+// Last returns the report of the last scrub that ran, or nil if none has.
+func (s *Scrubber) Last() (*ScrubReport, error) {
+	var report ScrubReport
+	err := s.fs.Versioning.store.GetRecord(scrubRecords, "last", &report)
+	if err == ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+// Scrub checks, and heals, everything stored once. Blobs go first, so that
+// versions are sound by the time files are restored from them. The report
+// is recorded even if the scrub fails or is stopped.
+func (s *Scrubber) Scrub() (*ScrubReport, error) {
+	report := &ScrubReport{Started: time.Now().UTC()}
+	s.mutex.Lock()
+	if s.current != nil {
+		s.mutex.Unlock()
+		return nil, errScrubRunning
+	}
+	s.current = report
+	s.mutex.Unlock()
+
+	err := s.scrub(report)
+
+	s.mutex.Lock()
+	report.Finished = time.Now().UTC()
+	if err != nil {
+		report.Error = err.Error()
+	}
+	s.current = nil
+	s.mutex.Unlock()
+
+	if putErr := s.fs.Versioning.store.PutRecord(scrubRecords, "last", report); putErr != nil && err == nil {
+		err = putErr
+	}
+	return report, err
+}
+
+func (s *Scrubber) scrub(report *ScrubReport) error {
+	fs := s.fs
+
+	var blobs []string
+	err := walkBackend(fs.Backend, blobPrefix, func(info ObjectInfo) error {
+		if !info.IsDir {
+			blobs = append(blobs, info.Name)
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	files, err := fs.Versioning.ListHistories("")
+	if err != nil {
+		return err
+	}
+	s.update(func() { report.Total = len(blobs) + len(files) })
+
+	for _, key := range blobs {
+		if err := s.scrubBlob(report, key, files); err != nil {
+			return err
+		}
+	}
+	for _, key := range files {
+		if err := s.scrubFile(report, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scrubBlob checks the blob stored at key. files are the files to look for
+// a good copy in.
+func (s *Scrubber) scrubBlob(report *ScrubReport, key string, files []string) error {
+	hash := strings.Replace(strings.TrimPrefix(key, blobPrefix+"/"), "/", "", 1)
+	data, err := s.fs.Backend.Get(key)
+	if os.IsNotExist(err) {
+		// Released since it was listed.
+		return s.throttle(report, 0, func() { report.Blobs++ })
+	}
+	if err == nil && checksum(data) == hash {
+		return s.throttle(report, len(data), func() { report.Blobs++ })
+	}
+
+	issue := ScrubIssue{Key: key, Detail: "contents do not match their hash"}
+	if err != nil {
+		issue.Detail = err.Error()
+	}
+	good, source := s.goodBlob(key, hash, files)
+	if good != nil {
+		if err := s.fs.Versioning.blobs.Repair(hash, good); err != nil {
+			issue.Detail += "; restoring it failed: " + err.Error()
+		} else {
+			issue.Healed = true
+			issue.Source = source
+		}
+	}
+	return s.throttle(report, len(data)+len(good), func() {
+		report.Blobs++
+		report.Issues = append(report.Issues, issue)
+	})
+}
+
+// goodBlob finds the contents of the blob hash elsewhere: in the mirror,
+// or in a file whose latest version refers to it and whose contents are
+// sound.
+func (s *Scrubber) goodBlob(key, hash string, files []string) ([]byte, string) {
+	fs := s.fs
+	if s.Mirror != nil {
+		if data, err := s.Mirror.Get(key); err == nil && checksum(data) == hash {
+			return data, "mirror"
+		}
+	}
+
+	for _, file := range files {
+		versions, err := fs.Versioning.GetAllVersions(file)
+		if err != nil || len(versions) == 0 {
+			continue
+		}
+		latest := versions[len(versions)-1]
+		if !containsString(latest.blobHashes(), hash) {
+			continue
+		}
+
+		unlock := fs.locks.RLock(file)
+		data, err := fs.Backend.Get(file)
+		unlock()
+		if err != nil || latest.Checksum == "" || checksum(data) != latest.Checksum {
+			continue
+		}
+		if latest.Blob == hash {
+			return data, file
+		}
+		chunker := NewChunker(bytes.NewReader(data))
+		for {
+			chunk, err := chunker.Next()
+			if err != nil {
+				break
+			}
+			if checksum(chunk) == hash {
+				return chunk, file
+			}
+		}
+	}
+	return nil, ""
+}
+
+// scrubFile checks the file at key against its latest version.
+func (s *Scrubber) scrubFile(report *ScrubReport, key string) error {
+	fs := s.fs
+	unlock := fs.locks.Lock(key)
+	issue, n := s.checkFile(key)
+	unlock()
+
+	return s.throttle(report, n, func() {
+		report.Files++
+		if issue != nil {
+			report.Issues = append(report.Issues, *issue)
+		}
+	})
+}
+
+// checkFile checks and heals the file at key, returning what was wrong
+// with it, if anything, and how many bytes it read. Files an interrupted
+// operation is pending on are left for Recover. The caller holds the
+// file's lock.
+func (s *Scrubber) checkFile(key string) (*ScrubIssue, int) {
+	fs := s.fs
+	if pending, err := fs.intents.PendingOn(key); err != nil || pending {
+		// A write that failed to record its version leaves storage ahead
+		// of history; restoring the version would undo it.
+		return nil, 0
+	}
+	versions, err := fs.Versioning.GetAllVersions(key)
+	if err != nil || len(versions) == 0 {
+		return nil, 0
+	}
+	latest := &versions[len(versions)-1]
+	if latest.Checksum == "" {
+		// Recorded before versions had checksums.
+		return nil, 0
+	}
+
+	data, err := fs.Backend.Get(key)
+	if err != nil {
+		// Missing or a directory: for fsck to sort out.
+		return nil, 0
+	}
+	n := len(data)
+	if checksum(data) == latest.Checksum {
+		return nil, n
+	}
+
+	issue := &ScrubIssue{Key: key, Detail: fmt.Sprintf("contents do not match version %d", latest.Version)}
+	var good []byte
+	if want, err := fs.Versioning.ReadVersion(latest); err == nil && checksum(want) == latest.Checksum {
+		good, issue.Source = want, fmt.Sprintf("version %d", latest.Version)
+	} else if s.Mirror != nil {
+		if mirrored, err := s.Mirror.Get(key); err == nil && checksum(mirrored) == latest.Checksum {
+			good, issue.Source = mirrored, "mirror"
+		}
+	}
+	if good == nil {
+		issue.Source = ""
+		return issue, n
+	}
+	n += len(good)
+
+	if err := fs.Backend.Put(key, good); err != nil {
+		issue.Detail += "; restoring it failed: " + err.Error()
+		issue.Source = ""
+		return issue, n
+	}
+	issue.Healed = true
+	return issue, n
+}
+
+// throttle counts n bytes read, updates the report with fn, and then
+// sleeps as long as it takes to keep to BytesPerSecond. It returns
+// errScrubStopped if the scrubber is stopped meanwhile.
+func (s *Scrubber) throttle(report *ScrubReport, n int, fn func()) error {
+	s.update(func() {
+		report.Bytes += int64(n)
+		fn()
+	})
+
+	var wait <-chan time.Time
+	if s.BytesPerSecond > 0 {
+		due := report.Started.Add(time.Duration(float64(report.Bytes) / float64(s.BytesPerSecond) * float64(time.Second)))
+		if d := time.Until(due); d > 0 {
+			wait = time.After(d)
+		}
+	}
+	if wait == nil {
+		select {
+		case <-s.stop:
+			return errScrubStopped
+		default:
+			return nil
+		}
+	}
+	select {
+	case <-s.stop:
+		return errScrubStopped
+	case <-wait:
+		return nil
+	}
+}
+
+// update changes the running report under the lock Status reads it with.
+func (s *Scrubber) update(fn func()) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	fn()
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,687 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The full-text index is kept in the metadata store. Each indexed document,
+// the current contents of a file or one of its versions, is one record
+// holding the positions of its terms; each term lists the documents it
+// occurs in.
+const (
+	searchDocs   = "search_docs"   // document ID -> IndexedDoc
+	searchTerms  = "search_terms"  // term -> sorted document IDs
+	searchCounts = "search_counts" // "c:" or "v:" -> number of documents of the kind
+
+	// maxIndexedSize is the largest file that is indexed. The index is
+	// meant for notes and configuration files, not bulk data.
+	maxIndexedSize = 1 << 20
+)
+
+// IndexedDoc is what the index knows about a document.
+type IndexedDoc struct {
+	Positions map[string][]int `bson:"positions"` // word positions of each term
+	Length    int              `bson:"length"`    // number of words
+}
+
+// Document IDs name either the current contents of a file or a version.
+func currentDoc(key string) string {
+	return "c:" + key
+}
+
+func versionDoc(key string, version int) string {
+	return "v:" + key + "#" + strconv.Itoa(version)
+}
+
+// parseDoc returns the file and version a document ID names; version is 0
+// for the current contents.
+func parseDoc(doc string) (string, int) {
+	if strings.HasPrefix(doc, "c:") {
+		return doc[2:], 0
+	}
+	i := strings.LastIndex(doc, "#")
+	if !strings.HasPrefix(doc, "v:") || i < 0 {
+		return "", 0
+	}
+	version, _ := strconv.Atoi(doc[i+1:])
+	return doc[2:i], version
+}
+
+// tokenize splits text into lower case words of letters and digits.
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// indexable reports whether data looks like text worth indexing.
+func indexable(data []byte) bool {
+	return len(data) <= maxIndexedSize && utf8.Valid(data) && bytes.IndexByte(data, 0) < 0
+}
+
+// indexDoc replaces what the index holds for doc with data. Only the
+// terms that were added or removed have their document lists rewritten,
+// all in one go.
+func (fs *FileSystem) indexDoc(doc string, data []byte) error {
+	if !indexable(data) {
+		return fs.unindexDoc(doc)
+	}
+
+	words := tokenize(string(data))
+	positions := make(map[string][]int)
+	for i, word := range words {
+		positions[word] = append(positions[word], i)
+	}
+
+	fs.indexing.Lock()
+	defer fs.indexing.Unlock()
+
+	old, err := fs.indexedDoc(doc)
+	if err != nil {
+		return err
+	}
+	var added, removed []string
+	for term := range positions {
+		if old == nil || old.Positions[term] == nil {
+			added = append(added, term)
+		}
+	}
+	if old != nil {
+		for term := range old.Positions {
+			if positions[term] == nil {
+				removed = append(removed, term)
+			}
+		}
+	}
+	if err := fs.updateTerms(doc, added, removed); err != nil {
+		return err
+	}
+
+	// The document goes last: terms listing one that has no record, or
+	// no positions for them, are ignored.
+	if err := fs.Versioning.store.PutRecord(searchDocs, doc, &IndexedDoc{Positions: positions, Length: len(words)}); err != nil {
+		return err
+	}
+	if old == nil {
+		_, err = fs.Versioning.store.Increment(searchCounts, doc[:2], 1)
+	}
+	return err
+}
+
+func (fs *FileSystem) unindexDoc(doc string) error {
+	fs.indexing.Lock()
+	defer fs.indexing.Unlock()
+
+	old, err := fs.indexedDoc(doc)
+	if err != nil || old == nil {
+		return err
+	}
+
+	if err := fs.Versioning.store.DeleteRecord(searchDocs, doc); err != nil {
+		return err
+	}
+	if _, err := fs.Versioning.store.Increment(searchCounts, doc[:2], -1); err != nil {
+		return err
+	}
+	terms := make([]string, 0, len(old.Positions))
+	for term := range old.Positions {
+		terms = append(terms, term)
+	}
+	return fs.updateTerms(doc, nil, terms)
+}
+
+// indexedDoc returns the record of doc, or nil if it is not indexed.
+func (fs *FileSystem) indexedDoc(doc string) (*IndexedDoc, error) {
+	var indexed IndexedDoc
+	err := fs.Versioning.store.GetRecord(searchDocs, doc, &indexed)
+	if err == ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &indexed, nil
+}
+
+// termDocs returns the documents term occurs in.
+func (fs *FileSystem) termDocs(term string) ([]string, error) {
+	var docs []string
+	err := fs.Versioning.store.GetRecord(searchTerms, term, &docs)
+	if err == ErrNotFound {
+		return nil, nil
+	}
+	return docs, err
+}
+
+// updateTerms adds doc to the document lists of the added terms and
+// removes it from those of the removed ones, writing them together. The
+// caller holds fs.indexing.
+func (fs *FileSystem) updateTerms(doc string, added, removed []string) error {
+	records := make(map[string]interface{}, len(added)+len(removed))
+	for _, term := range added {
+		docs, err := fs.termDocs(term)
+		if err != nil {
+			return err
+		}
+		i := sort.SearchStrings(docs, doc)
+		if i < len(docs) && docs[i] == doc {
+			continue
+		}
+		docs = append(docs, "")
+		copy(docs[i+1:], docs[i:])
+		docs[i] = doc
+		records[term] = docs
+	}
+	for _, term := range removed {
+		docs, err := fs.termDocs(term)
+		if err != nil {
+			return err
+		}
+		i := sort.SearchStrings(docs, doc)
+		if i == len(docs) || docs[i] != doc {
+			continue
+		}
+		if len(docs) == 1 {
+			records[term] = nil
+		} else {
+			records[term] = append(docs[:i], docs[i+1:]...)
+		}
+	}
+	return fs.Versioning.store.PutRecords(searchTerms, records)
+}
+
+// indexKey brings the index up to date with the file at key: its current
+// contents and, if IndexHistory is set, every version not indexed yet.
+// Files in the trash are not indexed.
+func (fs *FileSystem) indexKey(key string) error {
+	if strings.HasPrefix(key, trashPrefix+"/") {
+		return nil
+	}
+
+	data, err := fs.Backend.Get(key)
+	if err != nil {
+		// Gone, or a directory.
+		return fs.unindexDoc(currentDoc(key))
+	}
+	if err := fs.indexDoc(currentDoc(key), data); err != nil {
+		return err
+	}
+
+	if !fs.IndexHistory {
+		return nil
+	}
+	versions, err := fs.Versioning.GetAllVersions(key)
+	if err != nil {
+		return err
+	}
+	for i := range versions {
+		doc := versionDoc(key, versions[i].Version)
+		var indexed IndexedDoc
+		if err := fs.Versioning.store.GetRecord(searchDocs, doc, &indexed); err == nil {
+			continue
+		} else if err != ErrNotFound {
+			return err
+		}
+		data, err := fs.Versioning.ReadVersion(&versions[i])
+		if err != nil {
+			return err
+		}
+		if err := fs.indexDoc(doc, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unindexKey removes the file at key, and all its versions, from the index.
+func (fs *FileSystem) unindexKey(key string) error {
+	if err := fs.unindexDoc(currentDoc(key)); err != nil {
+		return err
+	}
+	docs, err := fs.Versioning.store.ListRecords(searchDocs, "v:"+key+"#")
+	if err != nil {
+		return err
+	}
+	for _, doc := range docs {
+		if name, _ := parseDoc(doc); name == key {
+			if err := fs.unindexDoc(doc); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// updateIndex indexes key after a change. The change itself has already
+// happened, so failing to index it is logged rather than returned.
+func (fs *FileSystem) updateIndex(key string) {
+	if err := fs.indexKey(key); err != nil {
+		log.Printf("Failed to index '%s': %v", key, err)
+	}
+}
+
+// reindex moves a file from one key to another in the index.
+func (fs *FileSystem) reindex(from, to string) error {
+	if err := fs.unindexKey(from); err != nil {
+		return err
+	}
+	return fs.indexKey(to)
+}
+
+// Reindex indexes every file below name, for files written before the
+// index existed or when IndexHistory has been turned on. It returns how
+// many files it indexed.
+func (fs *FileSystem) Reindex(name string) (int, error) {
+	indexed := 0
+	err := fs.Walk(name, func(name string, info *FileInfo) error {
+		if info.IsDir || info.Link != "" || fs.access("reindex", name, info.key, permRead) != nil {
+			return nil
+		}
+		key, err := fs.contentKey(info.key)
+		if err != nil {
+			return err
+		}
+		if err := fs.indexKey(key); err != nil {
+			return err
+		}
+		indexed++
+		return nil
+	})
+	return indexed, err
+}
+
+// SearchOptions controls a Search.
+type SearchOptions struct {
+	// History searches every indexed version instead of the current
+	// contents, to find which version introduced something.
+	History bool
+	Limit   int // at most this many results, 0 for all
+}
+
+// SearchResult is a file that matched a search.
+type SearchResult struct {
+	Path     string
+	Score    float64
+	Snippet  string
+	Versions []int // for a history search, the matching versions, oldest first
+
+	key string
+}
+
+// searchTerm is a word, or a phrase of several, in a query.
+type searchTerm []string
+
+// searchClause matches documents with every term in must and none in not.
+type searchClause struct {
+	must []searchTerm
+	not  []searchTerm
+}
+
+// parseQuery parses a query: words and "quoted phrases" that must all
+// match, words or phrases after - or NOT that must not, and alternatives
+// separated by OR.
+func parseQuery(query string) ([]searchClause, error) {
+	var clauses []searchClause
+	clause := searchClause{}
+	negate := false
+
+	add := func(text string) {
+		words := tokenize(text)
+		if len(words) == 0 {
+			return
+		}
+		// Something like foo-bar is a phrase even without quotes.
+		if negate {
+			clause.not = append(clause.not, words)
+		} else {
+			clause.must = append(clause.must, words)
+		}
+		negate = false
+	}
+	end := func() error {
+		if len(clause.must) == 0 {
+			return fmt.Errorf("every part of a query needs a word that is not excluded")
+		}
+		clauses = append(clauses, clause)
+		clause = searchClause{}
+		return nil
+	}
+
+	for query = strings.TrimSpace(query); query != ""; query = strings.TrimSpace(query) {
+		switch {
+		case query[0] == '"':
+			i := strings.IndexByte(query[1:], '"')
+			if i < 0 {
+				return nil, fmt.Errorf("unterminated phrase")
+			}
+			add(query[1 : i+1])
+			query = query[i+2:]
+			continue
+		case query[0] == '-':
+			negate = true
+			query = query[1:]
+			continue
+		}
+
+		word := query
+		if i := strings.IndexAny(query, " \t\""); i >= 0 {
+			word = query[:i]
+		}
+		query = query[len(word):]
+		switch word {
+		case "OR":
+			if err := end(); err != nil {
+				return nil, err
+			}
+		case "NOT":
+			negate = true
+		case "AND":
+		default:
+			add(word)
+		}
+	}
+	if err := end(); err != nil {
+		return nil, err
+	}
+	return clauses, nil
+}
+
+// searchIndex looks up terms, caching what it read for one search.
+type searchIndex struct {
+	fs       *FileSystem
+	history  bool
+	postings map[string]map[string][]int // word -> document -> positions
+	docs     map[string]*IndexedDoc
+}
+
+// lookup returns the documents a word occurs in, with its positions.
+func (s *searchIndex) lookup(word string) (map[string][]int, error) {
+	if postings, ok := s.postings[word]; ok {
+		return postings, nil
+	}
+
+	docs, err := s.fs.termDocs(word)
+	if err != nil {
+		return nil, err
+	}
+	postings := make(map[string][]int)
+	for _, doc := range docs {
+		if strings.HasPrefix(doc, "v:") != s.history {
+			continue
+		}
+		indexed, err := s.doc(doc)
+		if err != nil {
+			return nil, err
+		}
+		if indexed != nil && len(indexed.Positions[word]) > 0 {
+			postings[doc] = indexed.Positions[word]
+		}
+	}
+	s.postings[word] = postings
+	return postings, nil
+}
+
+// matches returns how often term occurs in each document it occurs in.
+func (s *searchIndex) matches(term searchTerm) (map[string]int, error) {
+	first, err := s.lookup(term[0])
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int)
+	for doc, positions := range first {
+		counts[doc] = len(positions)
+	}
+	if len(term) == 1 {
+		return counts, nil
+	}
+
+	// A phrase: every following word must come right after.
+	rest := make([]map[string][]int, len(term)-1)
+	for i, word := range term[1:] {
+		if rest[i], err = s.lookup(word); err != nil {
+			return nil, err
+		}
+	}
+	for doc, positions := range first {
+		n := 0
+		for _, start := range positions {
+			found := true
+			for i := range rest {
+				if !containsInt(rest[i][doc], start+i+1) {
+					found = false
+					break
+				}
+			}
+			if found {
+				n++
+			}
+		}
+		if n > 0 {
+			counts[doc] = n
+		} else {
+			delete(counts, doc)
+		}
+	}
+	return counts, nil
+}
+
+func (s *searchIndex) doc(doc string) (*IndexedDoc, error) {
+	if indexed, ok := s.docs[doc]; ok {
+		return indexed, nil
+	}
+	var indexed IndexedDoc
+	err := s.fs.Versioning.store.GetRecord(searchDocs, doc, &indexed)
+	if err == ErrNotFound {
+		s.docs[doc] = nil
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	s.docs[doc] = &indexed
+	return &indexed, nil
+}
+
+func containsInt(values []int, value int) bool {
+	i := sort.SearchInts(values, value)
+	return i < len(values) && values[i] == value
+}
+
+// Search returns the files the user can read whose contents match query,
+// best first. Words that occur often in a file, and rarely elsewhere,
+// rank it higher. See parseQuery for the query syntax.
+func (fs *FileSystem) Search(query string, opts SearchOptions) ([]SearchResult, error) {
+	clauses, err := parseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	index := &searchIndex{
+		fs:       fs,
+		history:  opts.History,
+		postings: make(map[string]map[string][]int),
+		docs:     make(map[string]*IndexedDoc),
+	}
+
+	prefix := "c:"
+	if opts.History {
+		prefix = "v:"
+	}
+	var count int64
+	err = fs.Versioning.store.GetRecord(searchCounts, prefix, &count)
+	if err != nil && err != ErrNotFound {
+		return nil, err
+	}
+	total := float64(count)
+
+	scores := make(map[string]float64)
+	for _, clause := range clauses {
+		var matched map[string]float64
+		for _, term := range clause.must {
+			counts, err := index.matches(term)
+			if err != nil {
+				return nil, err
+			}
+			idf := math.Log(1 + total/float64(len(counts)+1))
+
+			next := make(map[string]float64)
+			for doc, n := range counts {
+				if matched == nil {
+					next[doc] = float64(n) * idf
+				} else if score, ok := matched[doc]; ok {
+					next[doc] = score + float64(n)*idf
+				}
+			}
+			matched = next
+		}
+		for _, term := range clause.not {
+			counts, err := index.matches(term)
+			if err != nil {
+				return nil, err
+			}
+			for doc := range counts {
+				delete(matched, doc)
+			}
+		}
+		for doc, score := range matched {
+			if score > scores[doc] {
+				scores[doc] = score
+			}
+		}
+	}
+
+	shared, err := fs.SharedWithMe()
+	if err != nil {
+		return nil, err
+	}
+	byPath := make(map[string]*SearchResult)
+	var results []*SearchResult
+	for doc, score := range scores {
+		indexed, err := index.doc(doc)
+		if err != nil {
+			return nil, err
+		} else if indexed == nil {
+			continue
+		}
+		key, version := parseDoc(doc)
+		name, ok := fs.readableName("search", key, shared)
+		if !ok {
+			continue
+		}
+
+		// Longer documents mention everything more often.
+		score /= math.Sqrt(float64(indexed.Length) + 1)
+
+		result := byPath[name]
+		if result == nil {
+			result = &SearchResult{Path: name, key: key}
+			byPath[name] = result
+			results = append(results, result)
+		}
+		if score > result.Score {
+			result.Score = score
+		}
+		if version > 0 {
+			result.Versions = append(result.Versions, version)
+		}
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Path < results[j].Path
+	})
+	if opts.Limit > 0 && len(results) > opts.Limit {
+		results = results[:opts.Limit]
+	}
+
+	found := make([]SearchResult, len(results))
+	for i, result := range results {
+		sort.Ints(result.Versions)
+		result.Snippet = fs.snippet(result, clauses)
+		found[i] = *result
+	}
+	return found, nil
+}
+
+// snippet returns the text around the first match of a result.
+func (fs *FileSystem) snippet(result *SearchResult, clauses []searchClause) string {
+	var data []byte
+	var err error
+	if len(result.Versions) > 0 {
+		var versions []Version
+		if versions, err = fs.Versioning.GetAllVersions(result.key); err == nil {
+			for i := range versions {
+				if versions[i].Version == result.Versions[0] {
+					data, err = fs.Versioning.ReadVersion(&versions[i])
+				}
+			}
+		}
+	} else {
+		unlock := fs.locks.RLock(result.key)
+		data, err = fs.Backend.Get(result.key)
+		unlock()
+	}
+	if err != nil {
+		return ""
+	}
+
+	const context = 40
+	text := string(data)
+	at := -1
+	for _, clause := range clauses {
+		for _, term := range clause.must {
+			if i := indexFold(text, term[0]); i >= 0 && (at < 0 || i < at) {
+				at = i
+			}
+		}
+	}
+	if at < 0 {
+		at = 0
+	}
+
+	start, end := at-context, at+context
+	prefix, suffix := "...", "..."
+	if start <= 0 {
+		start, prefix = 0, ""
+	}
+	if end >= len(text) {
+		end, suffix = len(text), ""
+	}
+	// Don't cut a character in half.
+	for start > 0 && !utf8.RuneStart(text[start]) {
+		start--
+	}
+	for end < len(text) && !utf8.RuneStart(text[end]) {
+		end++
+	}
+	return prefix + strings.Join(strings.Fields(text[start:end]), " ") + suffix
+}
+
+// indexFold returns the byte offset in text of the first occurrence of
+// word, which is in lower case, ignoring case; or -1 if there is none.
+// Offsets into strings.ToLower(text) need not be offsets into text.
+func indexFold(text, word string) int {
+	for i := range text {
+		rest := text[i:]
+		found := true
+		for _, want := range word {
+			r, size := utf8.DecodeRuneInString(rest)
+			if size == 0 || unicode.ToLower(r) != want {
+				found = false
+				break
+			}
+			rest = rest[size:]
+		}
+		if found {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// sharedDir is the virtual directory in every home directory that holds
+// what other users have shared: "Shared with me/<owner>/<name>" is the
+// shared file or directory <name> of <owner>.
+const sharedDir = "Shared with me"
+
+const (
+	aclRecords   = "acls"   // key -> []ACLEntry
+	shareRecords = "shares" // "<grantee>:<key>" -> key, to find what was shared with whom
+)
+
+// Access levels an ACL entry can grant. Each includes the ones before it.
+const (
+	ACLRead  = "read"
+	ACLWrite = "write"
+	ACLAdmin = "admin"
+)
+
+var aclLevels = map[string]int{ACLRead: 1, ACLWrite: 2, ACLAdmin: 3}
+
+// ACLEntry grants a user, or a group written as "@group", access to a file
+// or directory and everything below it.
+type ACLEntry struct {
+	Grantee string `bson:"grantee"`
+	Level   string `bson:"level"`
+}
+
+// SharedItem is something another user has shared with the current user.
+type SharedItem struct {
+	Path  string // below the home directory, through sharedDir
+	Key   string
+	Level string
+}
+
+// Share grants grantee access to name at level, or revokes it when level
+// is empty. Only the owner of name, or someone with admin access to it,
+// may share it.
+func (fs *FileSystem) Share(name, grantee, level string) error {
+	if level != "" && aclLevels[level] == 0 {
+		return fmt.Errorf("unknown access level '%s'", level)
+	}
+	if grantee == "" || strings.Contains(grantee, ":") {
+		return fmt.Errorf("invalid user '%s'", grantee)
+	}
+	if level != "" {
+		// Entries of users or groups that are gone can still be removed.
+		var err error
+		if group := strings.TrimPrefix(grantee, "@"); group != grantee {
+			err = fs.checkGroup(group)
+		} else {
+			err = fs.checkUser(grantee)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	key, err := fs.Resolve("share", name)
+	if err != nil {
+		return err
+	}
+	info, err := fs.Backend.Stat(key)
+	if err != nil {
+		return err
+	}
+	if err := fs.access("share", name, key, 0); err != nil {
+		return err
+	}
+
+	if fs.user != MaintenanceUser {
+		perm, err := fs.permissions(key, info.IsDir)
+		if err != nil {
+			return err
+		}
+		if fs.user != perm.Owner && fs.aclLevel(key) < aclLevels[ACLAdmin] {
+			return &PermissionError{Op: "share", Path: name, Reason: "only the owner or an admin can share"}
+		}
+	}
+
+	unlock := fs.locks.Lock(key)
+	defer unlock()
+
+	entries, err := fs.acl(key)
+	if err != nil {
+		return err
+	}
+	var kept []ACLEntry
+	for _, entry := range entries {
+		if entry.Grantee != grantee {
+			kept = append(kept, entry)
+		}
+	}
+
+	if level == "" {
+		if err := fs.Versioning.store.DeleteRecord(shareRecords, grantee+":"+key); err != nil {
+			return err
+		}
+	} else {
+		kept = append(kept, ACLEntry{Grantee: grantee, Level: level})
+		if err := fs.Versioning.store.PutRecord(shareRecords, grantee+":"+key, key); err != nil {
+			return err
+		}
+	}
+	return fs.putACL(key, kept)
+}
+
+// ACL returns the entries set on name itself.
+func (fs *FileSystem) ACL(name string) ([]ACLEntry, error) {
+	key, err := fs.Resolve("getacl", name)
+	if err != nil {
+		return nil, err
+	}
+	if err := fs.access("getacl", name, key, 0); err != nil {
+		return nil, err
+	}
+	return fs.acl(key)
+}
+
+func (fs *FileSystem) acl(key string) ([]ACLEntry, error) {
+	var entries []ACLEntry
+	err := fs.Versioning.store.GetRecord(aclRecords, key, &entries)
+	if err == ErrNotFound {
+		return nil, nil
+	}
+	return entries, err
+}
+
+func (fs *FileSystem) putACL(key string, entries []ACLEntry) error {
+	if len(entries) == 0 {
+		return fs.Versioning.store.DeleteRecord(aclRecords, key)
+	}
+	return fs.Versioning.store.PutRecord(aclRecords, key, entries)
+}
+
+// aclLevel returns the highest level the current user has been granted on
+// key, directly or through a directory above it.
+func (fs *FileSystem) aclLevel(key string) int {
+	best := 0
+	for ; key != "." && key != ""; key = path.Dir(key) {
+		entries, err := fs.acl(key)
+		if err != nil {
+			return 0
+		}
+		for _, entry := range entries {
+			if entry.Grantee == fs.user || strings.HasPrefix(entry.Grantee, "@") && hasTag(fs.groups, entry.Grantee[1:]) {
+				if aclLevels[entry.Level] > best {
+					best = aclLevels[entry.Level]
+				}
+			}
+		}
+	}
+	return best
+}
+
+// accessShared checks access to a key outside the home directory, which
+// only ACL entries can grant.
+func (fs *FileSystem) accessShared(op, name, key string, want os.FileMode) error {
+	needed := aclLevels[ACLRead]
+	if want&permWrite != 0 {
+		needed = aclLevels[ACLWrite]
+	}
+	if fs.aclLevel(key) < needed {
+		return &PermissionError{Op: op, Path: name, Reason: "not shared with you"}
+	}
+	return nil
+}
+
+// SharedWithMe returns everything other users have shared with the current
+// user, sorted by path.
+func (fs *FileSystem) SharedWithMe() ([]SharedItem, error) {
+	if fs.user == "" || fs.user == MaintenanceUser {
+		return nil, nil
+	}
+
+	grantees := []string{fs.user}
+	for _, group := range fs.groups {
+		grantees = append(grantees, "@"+group)
+	}
+
+	seen := make(map[string]bool)
+	var items []SharedItem
+	for _, grantee := range grantees {
+		ids, err := fs.Versioning.store.ListRecords(shareRecords, grantee+":")
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			key := strings.TrimPrefix(id, grantee+":")
+			if seen[key] || withinKey(key, fs.home) || isReservedKey(key) {
+				continue
+			}
+			seen[key] = true
+
+			owner := strings.SplitN(key, "/", 2)[0]
+			granted, level := fs.aclLevel(key), ""
+			for l, n := range aclLevels {
+				if n == granted {
+					level = l
+				}
+			}
+			items = append(items, SharedItem{
+				Path:  path.Join(sharedDir, owner, path.Base(key)),
+				Key:   key,
+				Level: level,
+			})
+		}
+	}
+
+	// Items of one owner with the same name, from different directories,
+	// are told apart by a number, in the order of their keys.
+	sort.Slice(items, func(i, j int) bool { return items[i].Key < items[j].Key })
+	taken := make(map[string]bool, len(items))
+	for i := range items {
+		name := items[i].Path
+		for n := 2; taken[name]; n++ {
+			name = fmt.Sprintf("%s~%d", items[i].Path, n)
+		}
+		taken[name] = true
+		items[i].Path = name
+	}
+
+	sort.Slice(items, func(i, j int) bool { return items[i].Path < items[j].Path })
+	return items, nil
+}
+
+// resolveShared maps a key below the virtual shared directory to the key of
+// the shared item. Other keys are returned unchanged.
+func (fs *FileSystem) resolveShared(op, name, key string) (string, error) {
+	root := path.Join(fs.home, sharedDir)
+	if fs.home == "" || !withinKey(key, root) {
+		return key, nil
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(key, root), "/", 4)[1:]
+	if len(parts) < 2 {
+		// The shared directory itself, or one of its owner directories.
+		return key, nil
+	}
+
+	items, err := fs.SharedWithMe()
+	if err != nil {
+		return "", err
+	}
+	virtual := path.Join(sharedDir, parts[0], parts[1])
+	for _, item := range items {
+		if item.Path == virtual {
+			if len(parts) == 3 {
+				return path.Join(item.Key, parts[2]), nil
+			}
+			return item.Key, nil
+		}
+	}
+	return "", &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+}
+
+// isSharedRoot reports whether key is the virtual shared directory or one
+// of the owner directories in it, which hold nothing but shared items.
+func (fs *FileSystem) isSharedRoot(key string) bool {
+	root := path.Join(fs.home, sharedDir)
+	if fs.home == "" || !withinKey(key, root) {
+		return false
+	}
+	return strings.Count(strings.TrimPrefix(key, root), "/") <= 1
+}
+
+// moveACLs moves the ACL entries of from and everything below it over to
+// to, along with the records of who they were shared with.
+func (fs *FileSystem) moveACLs(from, to string) error {
+	keys, err := fs.Versioning.store.ListRecords(aclRecords, from)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if !withinKey(key, from) {
+			continue
+		}
+		entries, err := fs.acl(key)
+		if err != nil {
+			return err
+		}
+		target := path.Join(to, strings.TrimPrefix(key, from))
+		for _, entry := range entries {
+			if err := fs.Versioning.store.PutRecord(shareRecords, entry.Grantee+":"+target, target); err != nil {
+				return err
+			}
+			if err := fs.Versioning.store.DeleteRecord(shareRecords, entry.Grantee+":"+key); err != nil {
+				return err
+			}
+		}
+		if err := fs.putACL(target, entries); err != nil {
+			return err
+		}
+		if err := fs.putACL(key, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dropACL removes the ACL entries of key.
+func (fs *FileSystem) dropACL(key string) error {
+	entries, err := fs.acl(key)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := fs.Versioning.store.DeleteRecord(shareRecords, entry.Grantee+":"+key); err != nil {
+			return err
+		}
+	}
+	return fs.putACL(key, nil)
+}
+
+// readableName returns the name the user knows the file at key by, below
+// their home directory, and whether they may read it. shared is what
+// SharedWithMe returned.
+func (fs *FileSystem) readableName(op, key string, shared []SharedItem) (string, bool) {
+	if strings.HasPrefix(key, inodePrefix+"/") {
+		var inode Inode
+		if err := fs.Versioning.store.GetRecord(inodeRecords, path.Base(key), &inode); err != nil {
+			return "", false
+		}
+		for _, name := range inode.Names {
+			if found, ok := fs.readableName(op, name, shared); ok {
+				return found, true
+			}
+		}
+		return "", false
+	}
+
+	var name string
+	if withinKey(key, fs.home) {
+		name = strings.TrimPrefix(strings.TrimPrefix(key, fs.home), "/")
+	} else {
+		for _, item := range shared {
+			if withinKey(key, item.Key) {
+				name = path.Join(item.Path, strings.TrimPrefix(key, item.Key))
+				break
+			}
+		}
+	}
+	if name == "" || fs.access(op, name, key, permRead) != nil {
+		return "", false
+	}
+	return name, true
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"path"
+	"testing"
+)
+
+func TestSharedItemsWithTheSameName(t *testing.T) {
+	fs := newTestFileSystem(t)
+	if err := NewAuthService(fs.Versioning.store, fs.Backend).Signup("bo", "secret", "USER"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, dir := range []string{"a", "b"} {
+		if err := fs.Mkdir(dir); err != nil {
+			t.Fatal(err)
+		}
+		if err := fs.CreateFile(dir+"/report", []byte("report "+dir)); err != nil {
+			t.Fatal(err)
+		}
+		if err := fs.Share(dir+"/report", "bo", ACLRead); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fs.SetHome("bo")
+	fs.SetUser("bo", nil)
+	items, err := fs.SharedWithMe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 || items[0].Path == items[1].Path {
+		t.Fatalf("shared items: %+v", items)
+	}
+	for _, item := range items {
+		data, err := fs.ReadFile(item.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "report " + path.Base(path.Dir(item.Key)); string(data) != want {
+			t.Errorf("%s: got %q, want %q", item.Path, data, want)
+		}
+	}
+}
@@ -0,0 +1,505 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StorageBackend stores file contents for a FileSystem. Names are
+// slash-separated keys relative to the root of the backend.
+type StorageBackend interface {
+	Put(name string, data []byte) error
+	Get(name string) ([]byte, error)
+	Delete(name string) error
+	Stat(name string) (*ObjectInfo, error)
+	List(dir string) ([]ObjectInfo, error)
+	Mkdir(name string) error
+}
+
+// ObjectInfo describes an entry in a StorageBackend.
+type ObjectInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+	IsDir   bool
+}
+
+// LocalBackend stores files as regular files below Root on the local disk.
+type LocalBackend struct {
+	Root string
+}
+
+func NewLocalBackend(root string) *LocalBackend {
+	return &LocalBackend{Root: root}
+}
+
+func (b *LocalBackend) path(name string) string {
+	return filepath.Join(b.Root, filepath.FromSlash(name))
+}
+
+// Put replaces name atomically: readers see either the old or the new
+// contents, never a partial write, even if the process crashes.
+func (b *LocalBackend) Put(name string, data []byte) error {
+	w, err := b.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func (b *LocalBackend) Get(name string) ([]byte, error) {
+	return ioutil.ReadFile(b.path(name))
+}
+
+func (b *LocalBackend) Open(name string) (io.ReadCloser, error) {
+	return os.Open(b.path(name))
+}
+
+// Create writes to a temporary file next to name and renames it into place
+// when the writer is closed.
+func (b *LocalBackend) Create(name string) (io.WriteCloser, error) {
+	filePath := b.path(name)
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return nil, err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(filePath), localTempPrefix+filepath.Base(filePath)+"-")
+	if err != nil {
+		return nil, err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+
+	return &atomicFile{file: tmp, path: filePath}, nil
+}
+
+// localTempPrefix starts the names of files that are still being written.
+const localTempPrefix = ".vfs-tmp-"
+
+type atomicFile struct {
+	file *os.File
+	path string
+	err  error
+}
+
+func (f *atomicFile) Write(p []byte) (int, error) {
+	if f.err != nil {
+		return 0, f.err
+	}
+	n, err := f.file.Write(p)
+	f.err = err
+	return n, err
+}
+
+func (f *atomicFile) Close() error {
+	if f.err == nil {
+		f.err = f.file.Sync()
+	}
+	if err := f.file.Close(); f.err == nil {
+		f.err = err
+	}
+	if f.err != nil {
+		os.Remove(f.file.Name())
+		return f.err
+	}
+
+	if err := os.Rename(f.file.Name(), f.path); err != nil {
+		os.Remove(f.file.Name())
+		return err
+	}
+	return syncDir(filepath.Dir(f.path))
+}
+
+func (f *atomicFile) Abort() error {
+	f.file.Close()
+	return os.Remove(f.file.Name())
+}
+
+// syncDir flushes a directory so a rename inside it survives a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// removeTempFiles deletes files left behind in dir by writes that never
+// finished.
+func (b *LocalBackend) removeTempFiles(dir string) error {
+	entries, err := os.ReadDir(b.path(dir))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), localTempPrefix) {
+			if err := os.Remove(filepath.Join(b.path(dir), entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (b *LocalBackend) Delete(name string) error {
+	return os.Remove(b.path(name))
+}
+
+func (b *LocalBackend) Mkdir(name string) error {
+	return os.Mkdir(b.path(name), 0755)
+}
+
+func (b *LocalBackend) Stat(name string) (*ObjectInfo, error) {
+	info, err := os.Stat(b.path(name))
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectInfo{
+		Name:    cleanKey(name),
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		IsDir:   info.IsDir(),
+	}, nil
+}
+
+func (b *LocalBackend) List(dir string) ([]ObjectInfo, error) {
+	entries, err := os.ReadDir(b.path(dir))
+	if err != nil {
+		return nil, err
+	}
+
+	var infos []ObjectInfo
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), localTempPrefix) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		infos = append(infos, ObjectInfo{
+			Name:    path.Join(cleanKey(dir), entry.Name()),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+			IsDir:   entry.IsDir(),
+		})
+	}
+	return infos, nil
+}
+
+// MemoryBackend keeps all files in memory. Directories are either created
+// with Mkdir or implied by the keys stored below them.
+type MemoryBackend struct {
+	mutex sync.RWMutex
+	files map[string]memoryFile
+	dirs  map[string]bool
+}
+
+type memoryFile struct {
+	data    []byte
+	modTime time.Time
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		files: make(map[string]memoryFile),
+		dirs:  make(map[string]bool),
+	}
+}
+
+func (b *MemoryBackend) Put(name string, data []byte) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	buf := make([]byte, len(data))
+	copy(buf, data)
+	b.files[cleanKey(name)] = memoryFile{data: buf, modTime: time.Now()}
+	return nil
+}
+
+func (b *MemoryBackend) Get(name string) ([]byte, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	file, ok := b.files[cleanKey(name)]
+	if !ok {
+		return nil, &os.PathError{Op: "get", Path: name, Err: os.ErrNotExist}
+	}
+	buf := make([]byte, len(file.data))
+	copy(buf, file.data)
+	return buf, nil
+}
+
+func (b *MemoryBackend) Open(name string) (io.ReadCloser, error) {
+	data, err := b.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (b *MemoryBackend) Create(name string) (io.WriteCloser, error) {
+	return &bufferedWriter{flush: func(data []byte) error { return b.Put(name, data) }}, nil
+}
+
+func (b *MemoryBackend) Delete(name string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	key := cleanKey(name)
+	if b.dirs[key] {
+		if b.hasChildren(key) {
+			return &os.PathError{Op: "delete", Path: name, Err: fmt.Errorf("directory not empty")}
+		}
+		delete(b.dirs, key)
+		return nil
+	}
+	if _, ok := b.files[key]; !ok {
+		return &os.PathError{Op: "delete", Path: name, Err: os.ErrNotExist}
+	}
+	delete(b.files, key)
+	return nil
+}
+
+func (b *MemoryBackend) Mkdir(name string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	key := cleanKey(name)
+	if _, ok := b.files[key]; ok || key == "" || b.dirs[key] || b.hasChildren(key) {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	}
+	b.dirs[key] = true
+	return nil
+}
+
+func (b *MemoryBackend) Stat(name string) (*ObjectInfo, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	key := cleanKey(name)
+	if file, ok := b.files[key]; ok {
+		return &ObjectInfo{Name: key, Size: int64(len(file.data)), ModTime: file.modTime}, nil
+	}
+	if key == "" || b.dirs[key] || b.hasChildren(key) {
+		return &ObjectInfo{Name: key, IsDir: true}, nil
+	}
+	return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+}
+
+func (b *MemoryBackend) List(dir string) ([]ObjectInfo, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	prefix := cleanKey(dir)
+	if prefix != "" {
+		if _, ok := b.files[prefix]; ok || !b.dirs[prefix] && !b.hasChildren(prefix) {
+			return nil, &os.PathError{Op: "list", Path: dir, Err: os.ErrNotExist}
+		}
+		prefix += "/"
+	}
+
+	seen := make(map[string]bool)
+	var infos []ObjectInfo
+	for key, file := range b.files {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		rest := key[len(prefix):]
+		if i := strings.Index(rest, "/"); i >= 0 {
+			child := prefix + rest[:i]
+			if !seen[child] {
+				seen[child] = true
+				infos = append(infos, ObjectInfo{Name: child, IsDir: true})
+			}
+			continue
+		}
+		infos = append(infos, ObjectInfo{Name: key, Size: int64(len(file.data)), ModTime: file.modTime})
+	}
+	for key := range b.dirs {
+		if strings.HasPrefix(key, prefix) && !strings.Contains(key[len(prefix):], "/") && !seen[key] {
+			seen[key] = true
+			infos = append(infos, ObjectInfo{Name: key, IsDir: true})
+		}
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos, nil
+}
+
+func (b *MemoryBackend) hasChildren(key string) bool {
+	prefix := key + "/"
+	for name := range b.files {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	for name := range b.dirs {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// walkBackend calls fn for dir and every entry below it, parents before
+// children. If fn returns filepath.SkipDir for a directory, its entries are
+// skipped.
+func walkBackend(b StorageBackend, dir string, fn func(info ObjectInfo) error) error {
+	info, err := b.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if err := fn(*info); err == filepath.SkipDir {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !info.IsDir {
+		return nil
+	}
+
+	entries, err := b.List(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := walkBackend(b, entry.Name, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// renamer is implemented by backends that can move an entry, along with
+// everything below it, in one step.
+type renamer interface {
+	Rename(oldName, newName string) error
+}
+
+func (b *LocalBackend) Rename(oldName, newName string) error {
+	if err := os.MkdirAll(filepath.Dir(b.path(newName)), 0755); err != nil {
+		return err
+	}
+	return os.Rename(b.path(oldName), b.path(newName))
+}
+
+// renameBackend moves oldName, a file or a directory, to newName. Backends
+// that cannot rename have every file copied over and then deleted.
+func renameBackend(b StorageBackend, oldName, newName string) error {
+	if r, ok := b.(renamer); ok {
+		return r.Rename(oldName, newName)
+	}
+
+	var dirs []string
+	err := walkBackend(b, oldName, func(info ObjectInfo) error {
+		target := path.Join(newName, strings.TrimPrefix(strings.TrimPrefix(info.Name, cleanKey(oldName)), "/"))
+		if info.IsDir {
+			dirs = append(dirs, info.Name)
+			if err := b.Mkdir(target); err != nil && !os.IsExist(err) {
+				return err
+			}
+			return nil
+		}
+
+		r, err := openBackendReader(b, info.Name)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		w, err := createBackendWriter(b, target)
+		if err != nil {
+			return err
+		}
+		if _, err := copyAndClose(w, r); err != nil {
+			return err
+		}
+		return b.Delete(info.Name)
+	})
+	if err != nil {
+		return err
+	}
+
+	// Children were visited after their parents, so remove them first.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := b.Delete(dirs[i]); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// copier is implemented by backends that can copy a file without reading
+// and writing all of it.
+type copier interface {
+	Copy(src, dst string) error
+}
+
+// Copy hard-links dst to src where the disk allows it. Writes replace files
+// by renaming over them, so changing either file later never changes the
+// other.
+func (b *LocalBackend) Copy(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(b.path(dst)), 0755); err != nil {
+		return err
+	}
+	if err := os.Link(b.path(src), b.path(dst)); err == nil {
+		return nil
+	}
+
+	r, err := b.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := b.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = copyAndClose(w, r)
+	return err
+}
+
+// copyBackend copies the file src to dst.
+func copyBackend(b StorageBackend, src, dst string) error {
+	if c, ok := b.(copier); ok {
+		return c.Copy(src, dst)
+	}
+
+	r, err := openBackendReader(b, src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := createBackendWriter(b, dst)
+	if err != nil {
+		return err
+	}
+	_, err = copyAndClose(w, r)
+	return err
+}
+
+// cleanKey normalizes a backend key: slash-separated, no leading slash and
+// "" for the root.
+func cleanKey(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(name)), "/")
+}
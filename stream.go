@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// StreamingBackend is implemented by backends that can read and write file
+// contents without holding them in memory. Backends that don't implement it
+// are adapted by openBackendReader and createBackendWriter.
+type StreamingBackend interface {
+	// Open returns a reader for the contents of name.
+	Open(name string) (io.ReadCloser, error)
+
+	// Create returns a writer that replaces the contents of name. The
+	// writer must be closed.
+	Create(name string) (io.WriteCloser, error)
+}
+
+func openBackendReader(b StorageBackend, name string) (io.ReadCloser, error) {
+	if sb, ok := b.(StreamingBackend); ok {
+		return sb.Open(name)
+	}
+
+	data, err := b.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func createBackendWriter(b StorageBackend, name string) (io.WriteCloser, error) {
+	if sb, ok := b.(StreamingBackend); ok {
+		return sb.Create(name)
+	}
+	return &bufferedWriter{flush: func(data []byte) error { return b.Put(name, data) }}, nil
+}
+
+// abortWriter is implemented by writers that can discard what was written
+// instead of committing it on Close.
+type abortWriter interface {
+	Abort() error
+}
+
+// abortWrite discards what was written to w if it can, and closes it
+// otherwise.
+func abortWrite(w io.WriteCloser) {
+	if aw, ok := w.(abortWriter); ok {
+		aw.Abort()
+	} else {
+		w.Close()
+	}
+}
+
+// copyAndClose copies r into w and closes w. If the copy fails, w is
+// aborted so nothing partial is committed.
+func copyAndClose(w io.WriteCloser, r io.Reader) (int64, error) {
+	n, err := io.Copy(w, r)
+	if err != nil {
+		abortWrite(w)
+		return n, err
+	}
+	return n, w.Close()
+}
+
+// bufferedWriter collects everything written to it and hands it to flush on
+// Close.
+type bufferedWriter struct {
+	buf   bytes.Buffer
+	flush func(data []byte) error
+}
+
+func (w *bufferedWriter) Write(p []byte) (int, error) {
+	return w.buf.Write(p)
+}
+
+func (w *bufferedWriter) Close() error {
+	return w.flush(w.buf.Bytes())
+}
+
+func (w *bufferedWriter) Abort() error {
+	w.buf.Reset()
+	return nil
+}
+
+// OpenReader opens a file for streaming reads.
+func (fs *FileSystem) OpenReader(name string) (io.ReadCloser, error) {
+	key, err := fs.Resolve("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if err := fs.access("read", name, key, permRead); err != nil {
+		return nil, err
+	}
+
+	unlock := fs.locks.RLock(key)
+	r, err := openBackendReader(fs.Backend, key)
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+	return &lockedReader{ReadCloser: r, unlock: unlock}, nil
+}
+
+// lockedReader holds a read lock until it is closed.
+type lockedReader struct {
+	io.ReadCloser
+	unlock func()
+}
+
+func (r *lockedReader) Close() error {
+	err := r.ReadCloser.Close()
+	if r.unlock != nil {
+		r.unlock()
+		r.unlock = nil
+	}
+	return err
+}
+
+// OpenWriter opens a file for streaming writes, creating it if needed. The
+// new version, and the owner of a new file, are recorded when the writer is
+// closed. The file stays locked for writing until then. After a failed
+// Write, Close discards everything instead.
+func (fs *FileSystem) OpenWriter(name string) (io.WriteCloser, error) {
+	key, err := fs.Resolve("create", name)
+	if err != nil {
+		return nil, err
+	}
+
+	unlock := fs.locks.Lock(key)
+
+	if err := fs.accessWrite("create", name, key); err != nil {
+		unlock()
+		return nil, err
+	}
+	allowance, err := fs.writeAllowance("create", name, key)
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+	before, err := fs.Backend.Stat(key)
+	if os.IsNotExist(err) {
+		before = nil
+	} else if err != nil {
+		unlock()
+		return nil, err
+	}
+
+	baseVersion, err := fs.Versioning.GetLatestVersion(key)
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+
+	// The contents are not known up front, so the intent only says that
+	// key is being written; Recover versions whatever ends up in storage.
+	intent := &Intent{Op: intentWrite, Key: key, BaseVersion: baseVersion, Streamed: true}
+	if err := fs.intents.Begin(intent); err != nil {
+		unlock()
+		return nil, err
+	}
+
+	w, err := createBackendWriter(fs.Backend, key)
+	if err != nil {
+		fs.intents.Done(intent)
+		unlock()
+		return nil, err
+	}
+	vw := &versionedWriter{fs: fs, name: name, key: key, w: w, intent: intent, unlock: unlock, before: before, allowance: allowance}
+	return vw, nil
+}
+
+type versionedWriter struct {
+	fs     *FileSystem
+	name   string
+	key    string
+	w      io.WriteCloser
+	intent *Intent
+	unlock func()
+	before *ObjectInfo // what key held before, nil if it did not exist
+
+	// allowance is how much may be written before the quota is exceeded,
+	// or -1 for no limit.
+	allowance int64
+	written   int64
+
+	// err is the first error Write returned.
+	err error
+}
+
+func (vw *versionedWriter) Write(p []byte) (int, error) {
+	if vw.err != nil {
+		return 0, vw.err
+	}
+	if vw.allowance >= 0 && vw.written+int64(len(p)) > vw.allowance {
+		owner, _ := vw.fs.quotaOwner(vw.key)
+		vw.err = &QuotaError{Op: "write", Path: vw.name, User: owner, Resource: "bytes left", Used: vw.written + int64(len(p)), Limit: vw.allowance}
+		return 0, vw.err
+	}
+	n, err := vw.w.Write(p)
+	vw.written += int64(n)
+	vw.err = err
+	return n, err
+}
+
+func (vw *versionedWriter) Close() error {
+	if vw.err != nil {
+		// Partial contents are never versioned.
+		vw.Abort()
+		return vw.err
+	}
+	defer vw.unlock()
+
+	if err := vw.w.Close(); err != nil {
+		vw.fs.intents.Done(vw.intent)
+		return err
+	}
+
+	r, err := openBackendReader(vw.fs.Backend, vw.key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if err := vw.fs.addVersionFrom(vw.key, r, vw.before); err != nil {
+		return err
+	}
+	if err := vw.fs.intents.Done(vw.intent); err != nil {
+		return err
+	}
+	if vw.before == nil {
+		return vw.fs.setOwner(vw.key, 0644)
+	}
+	return nil
+}
+
+func (vw *versionedWriter) Abort() error {
+	defer vw.unlock()
+
+	abortWrite(vw.w)
+	return vw.fs.intents.Done(vw.intent)
+}
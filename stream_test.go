@@ -0,0 +1,63 @@
+package main
+
+import "testing"
+
+func TestStreamedWriteOverQuota(t *testing.T) {
+	fs := newTestFileSystem(t)
+	if err := fs.SetQuota("al", Quota{MaxBytes: 10}); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := fs.OpenWriter("big.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("12345")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("678901234")); err == nil {
+		t.Fatal("write over the quota succeeded")
+	}
+	if err := w.Close(); err == nil {
+		t.Fatal("close after a failed write succeeded")
+	}
+
+	// Nothing of the partial write is left.
+	if _, err := fs.Backend.Stat("al/big.txt"); err == nil {
+		t.Error("partial contents were stored")
+	}
+	if versions, err := fs.Versioning.GetAllVersions("al/big.txt"); err != nil || len(versions) != 0 {
+		t.Errorf("partial contents were versioned: %d versions, %v", len(versions), err)
+	}
+	var perm Permissions
+	if err := fs.Versioning.store.GetRecord(permissionRecords, "al/big.txt", &perm); err != ErrNotFound {
+		t.Errorf("permissions recorded for a file that does not exist: %v", err)
+	}
+
+	// The file is unlocked again.
+	if err := fs.CreateFile("big.txt", []byte("small")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStreamedWriteRecordsOwner(t *testing.T) {
+	fs := newTestFileSystem(t)
+
+	w, err := fs.OpenWriter("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var perm Permissions
+	if err := fs.Versioning.store.GetRecord(permissionRecords, "al/a.txt", &perm); err != ErrNotFound {
+		t.Errorf("permissions recorded before anything was written: %v", err)
+	}
+	if _, err := w.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Versioning.store.GetRecord(permissionRecords, "al/a.txt", &perm); err != nil || perm.Owner != "al" {
+		t.Errorf("owner %q, %v", perm.Owner, err)
+	}
+}
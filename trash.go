@@ -0,0 +1,314 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Deleted files and directories are moved to a trash directory per user,
+// along with their history, until they are restored or purged.
+const (
+	trashPrefix  = ".trash"
+	trashRecords = "trash" // "<owner>/<id>" -> TrashItem
+)
+
+// DefaultTrashRetention is how long deleted items are kept before they are
+// purged, unless FileSystem.TrashRetention says otherwise.
+const DefaultTrashRetention = 30 * 24 * time.Hour
+
+// TrashPurgeInterval is how often a running program purges what has been
+// in the trash longer than the retention period.
+const TrashPurgeInterval = time.Hour
+
+// TrashItem is a deleted file or directory.
+type TrashItem struct {
+	ID      string    `bson:"id"`
+	Owner   string    `bson:"owner"` // whose home directory it was deleted from
+	Path    string    `bson:"path"`  // key it was deleted from
+	IsDir   bool      `bson:"is_dir"`
+	Deleted time.Time `bson:"deleted"`
+}
+
+// Name returns where the item was deleted from, relative to its owner's
+// home directory.
+func (item *TrashItem) Name() string {
+	return strings.TrimPrefix(item.Path, item.Owner+"/")
+}
+
+func (item *TrashItem) key() string {
+	return path.Join(trashPrefix, item.Owner, item.ID)
+}
+
+func (item *TrashItem) recordKey() string {
+	return item.Owner + "/" + item.ID
+}
+
+// newTrashItem records that key is about to be moved to the trash.
+func (fs *FileSystem) newTrashItem(key string, isDir bool) (*TrashItem, error) {
+	suffix := make([]byte, 3)
+	if _, err := rand.Read(suffix); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	item := &TrashItem{
+		// IDs sort in the order the items were deleted.
+		ID:      now.Format("20060102-150405") + "-" + hex.EncodeToString(suffix),
+		Owner:   strings.SplitN(key, "/", 2)[0],
+		Path:    key,
+		IsDir:   isDir,
+		Deleted: now,
+	}
+	if err := mkdirAllBackend(fs.Backend, path.Dir(item.key())); err != nil {
+		return nil, err
+	}
+	return item, fs.Versioning.store.PutRecord(trashRecords, item.recordKey(), item)
+}
+
+// trash moves key, and everything below it, to the trash.
+func (fs *FileSystem) trash(key string) error {
+	info, err := fs.Backend.Stat(key)
+	if err != nil {
+		return err
+	}
+
+	item, err := fs.newTrashItem(key, info.IsDir)
+	if err != nil {
+		return err
+	}
+	if err := fs.moveKey(key, item.key()); err != nil {
+		if _, statErr := fs.Backend.Stat(key); statErr == nil {
+			// Nothing was moved.
+			fs.Versioning.store.DeleteRecord(trashRecords, item.recordKey())
+		}
+		return err
+	}
+	return nil
+}
+
+// TrashItems returns the trash of the home directory: what was deleted from
+// it, by its owner or by others it is shared with, oldest first. Files a
+// user deletes from a directory shared with them go to the trash of its
+// owner. Without a home directory every item is returned.
+func (fs *FileSystem) TrashItems() ([]*TrashItem, error) {
+	if fs.home == "" {
+		return fs.trashItems("")
+	}
+	owner := strings.SplitN(fs.home, "/", 2)[0]
+	return fs.trashItems(owner + "/")
+}
+
+func (fs *FileSystem) trashItems(prefix string) ([]*TrashItem, error) {
+	ids, err := fs.Versioning.store.ListRecords(trashRecords, prefix)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(ids)
+
+	items := make([]*TrashItem, 0, len(ids))
+	for _, id := range ids {
+		var item TrashItem
+		if err := fs.Versioning.store.GetRecord(trashRecords, id, &item); err != nil {
+			return nil, err
+		}
+		items = append(items, &item)
+	}
+	return items, nil
+}
+
+// findTrashItem returns the item of the current user with the given ID,
+// or the one most recently deleted from the given name.
+func (fs *FileSystem) findTrashItem(ref string) (*TrashItem, error) {
+	items, err := fs.TrashItems()
+	if err != nil {
+		return nil, err
+	}
+	name := strings.TrimPrefix(path.Clean("/"+ref), "/")
+	for i := len(items) - 1; i >= 0; i-- {
+		if items[i].ID == ref || items[i].Name() == name {
+			return items[i], nil
+		}
+	}
+	return nil, &os.PathError{Op: "restore", Path: ref, Err: fmt.Errorf("not in the trash")}
+}
+
+// Restore moves an item of the trash back to where it was deleted from,
+// recreating the directories above it if needed. ref is the item's ID or
+// the name it was deleted from.
+func (fs *FileSystem) Restore(ref string) (*TrashItem, error) {
+	item, err := fs.findTrashItem(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := fs.accessParent("restore", item.Name(), item.Path); err != nil {
+		return nil, err
+	}
+	if _, err := fs.Backend.Stat(item.Path); err == nil {
+		return nil, &os.PathError{Op: "restore", Path: item.Name(), Err: os.ErrExist}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	for _, dir := range missingDirs(fs.Backend, path.Dir(item.Path)) {
+		if err := fs.Backend.Mkdir(dir); err != nil {
+			return nil, err
+		}
+		if err := fs.setOwner(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := fs.moveKey(item.key(), item.Path); err != nil {
+		return nil, err
+	}
+	return item, fs.Versioning.store.DeleteRecord(trashRecords, item.recordKey())
+}
+
+// EmptyTrash permanently removes every item of the current user's trash,
+// and returns how many there were.
+func (fs *FileSystem) EmptyTrash() (int, error) {
+	items, err := fs.TrashItems()
+	if err != nil {
+		return 0, err
+	}
+	for i, item := range items {
+		if err := fs.purge(item); err != nil {
+			return i, err
+		}
+	}
+	return len(items), nil
+}
+
+// PurgeTrash permanently removes every item, of every user, deleted more
+// than the retention period ago, and returns how many there were.
+func (fs *FileSystem) PurgeTrash() (int, error) {
+	retention := fs.TrashRetention
+	if retention <= 0 {
+		retention = DefaultTrashRetention
+	}
+	cutoff := time.Now().Add(-retention)
+
+	items, err := fs.trashItems("")
+	if err != nil {
+		return 0, err
+	}
+	purged := 0
+	for _, item := range items {
+		if item.Deleted.After(cutoff) {
+			continue
+		}
+		if err := fs.purge(item); err != nil {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// purge removes an item of the trash, its history and everything kept
+// about it. The record goes last, so an interrupted purge is finished by
+// the next one.
+func (fs *FileSystem) purge(item *TrashItem) error {
+	if err := fs.removeKey(item.key()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return fs.Versioning.store.DeleteRecord(trashRecords, item.recordKey())
+}
+
+// removeKey permanently deletes key and everything below it.
+func (fs *FileSystem) removeKey(key string) error {
+	var entries []ObjectInfo
+	err := walkBackend(fs.Backend, key, func(info ObjectInfo) error {
+		entries = append(entries, info)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	keys := make([]string, len(entries))
+	for i, info := range entries {
+		keys[i] = info.Name
+	}
+	unlock := fs.locks.LockAll(keys)
+	defer unlock()
+
+	owner, err := fs.quotaOwner(key)
+	if err != nil {
+		return err
+	}
+
+	// Children before their parents.
+	for i := len(entries) - 1; i >= 0; i-- {
+		info := entries[i]
+		var usage Usage
+		if !info.IsDir {
+			if ok, err := fs.unlink(info.Name); err != nil {
+				return err
+			} else if ok {
+				continue
+			}
+			if usage, err = fs.fileUsage(info.Name); err != nil {
+				return err
+			}
+		}
+		if err := fs.Backend.Delete(info.Name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := fs.forget(info.Name); err != nil {
+			return err
+		}
+		if err := fs.addUsage(owner, usage.negate()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// forget removes everything kept about key besides its contents: its
+// history, metadata, permissions, ACL and search index entries.
+func (fs *FileSystem) forget(key string) error {
+	if err := fs.Versioning.DeleteHistory(key); err != nil {
+		return err
+	}
+	if err := fs.unindexKey(key); err != nil {
+		return err
+	}
+	if err := fs.db.DeleteFileMetadata(key); err != nil {
+		return err
+	}
+	if err := fs.Versioning.store.DeleteRecord(permissionRecords, key); err != nil {
+		return err
+	}
+	return fs.dropACL(key)
+}
+
+// missingDirs returns the directories from the top down to dir that do not
+// exist yet.
+func missingDirs(b StorageBackend, dir string) []string {
+	var missing []string
+	for ; dir != "." && dir != ""; dir = path.Dir(dir) {
+		if _, err := b.Stat(dir); err == nil {
+			break
+		}
+		missing = append([]string{dir}, missing...)
+	}
+	return missing
+}
+
+// mkdirAllBackend creates dir along with any directories above it.
+func mkdirAllBackend(b StorageBackend, dir string) error {
+	for _, missing := range missingDirs(b, dir) {
+		if err := b.Mkdir(missing); err != nil && !os.IsExist(err) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+)
+
+// Tx is a set of file changes that are committed together: either every
+// file and its version history is updated, or none is.
+type Tx struct {
+	fs   *FileSystem
+	keys []string         // staged keys, in the order first staged
+	ops  map[string]*txOp // latest staged change per key
+	done bool
+}
+
+type txOp struct {
+	op   string
+	name string
+	data []byte
+}
+
+// Begin starts a transaction. Changes made through it are only visible
+// once Commit returns.
+func (fs *FileSystem) Begin() *Tx {
+	return &Tx{fs: fs, ops: make(map[string]*txOp)}
+}
+
+// CreateFile stages the creation of a file.
+func (tx *Tx) CreateFile(name string, data []byte) error {
+	return tx.stage("create", intentWrite, name, data)
+}
+
+// UpdateFile stages new contents for a file.
+func (tx *Tx) UpdateFile(name string, data []byte) error {
+	return tx.stage("update", intentWrite, name, data)
+}
+
+// DeleteFile stages the deletion of a file.
+func (tx *Tx) DeleteFile(name string) error {
+	return tx.stage("delete", intentDelete, name, nil)
+}
+
+// stage records a change, replacing any earlier change to the same file.
+func (tx *Tx) stage(op, kind, name string, data []byte) error {
+	if tx.done {
+		return fmt.Errorf("transaction already finished")
+	}
+
+	var key string
+	var err error
+	if kind == intentDelete {
+		// Deleting a link only removes the link, which a transaction
+		// cannot stage.
+		if key, err = tx.fs.lresolve(op, name); err != nil {
+			return err
+		}
+		if key, err = tx.fs.contentKey(key); err != nil {
+			return err
+		}
+		if _, ok, err := tx.fs.readlinkKey(key); err != nil {
+			return err
+		} else if ok || isReservedKey(key) {
+			return &os.PathError{Op: op, Path: name, Err: fmt.Errorf("cannot delete a link in a transaction")}
+		}
+		if err := tx.fs.accessParent(op, name, key); err != nil {
+			return err
+		}
+	} else if key, err = tx.fs.Resolve(op, name); err != nil {
+		return err
+	} else if err := tx.fs.accessWrite(op, name, key); err != nil {
+		return err
+	}
+
+	if _, ok := tx.ops[key]; !ok {
+		tx.keys = append(tx.keys, key)
+	}
+	tx.ops[key] = &txOp{op: kind, name: name, data: append([]byte(nil), data...)}
+	return nil
+}
+
+// Rollback discards every staged change.
+func (tx *Tx) Rollback() {
+	tx.done = true
+	tx.keys = nil
+	tx.ops = nil
+}
+
+// txChange is a staged change being committed, along with what is needed
+// to undo it.
+type txChange struct {
+	key     string
+	op      *txOp
+	version *Version
+	trash   *TrashItem // where a deleted file goes
+	existed bool
+	old     []byte
+}
+
+// Commit applies every staged change. All the files are locked for writing
+// until it returns, so nobody can read a file in between. New contents go
+// into the blob store first and a single intent naming all of them is
+// recorded; from then on the transaction is committed and Recover will
+// finish it if the process dies. If storage rejects a change, the ones
+// already applied are undone.
+func (tx *Tx) Commit() error {
+	if tx.done {
+		return fmt.Errorf("transaction already finished")
+	}
+	tx.done = true
+
+	fs := tx.fs
+	unlock := fs.locks.LockAll(tx.keys)
+	defer unlock()
+
+	if err := tx.checkQuotas(); err != nil {
+		return err
+	}
+
+	changes := make([]*txChange, 0, len(tx.keys))
+	abort := func() {
+		for _, change := range changes {
+			if change.version != nil {
+				fs.Versioning.AbortVersion(change.version)
+			}
+			if change.trash != nil {
+				fs.Versioning.store.DeleteRecord(trashRecords, change.trash.recordKey())
+			}
+		}
+	}
+
+	intent := &Intent{Op: intentTransaction}
+	for _, key := range tx.keys {
+		op := tx.ops[key]
+		change := &txChange{key: key, op: op}
+		changes = append(changes, change)
+
+		old, err := fs.Backend.Get(key)
+		if err == nil {
+			change.existed = true
+			change.old = old
+		} else if !os.IsNotExist(err) {
+			abort()
+			return err
+		} else if op.op == intentDelete {
+			abort()
+			return fmt.Errorf("failed to delete '%s': %v", op.name, err)
+		}
+
+		baseVersion, err := fs.Versioning.GetLatestVersion(key)
+		if err != nil {
+			abort()
+			return err
+		}
+
+		sub := Intent{Op: op.op, Key: key, BaseVersion: baseVersion}
+		if op.op == intentWrite {
+			change.version, err = fs.Versioning.PrepareVersion(bytes.NewReader(op.data))
+			if err != nil {
+				abort()
+				return err
+			}
+			sub.Chunks = change.version.Chunks
+			sub.Size = change.version.Size
+		} else {
+			// Deleted files go to the trash, which is a rename.
+			change.trash, err = fs.newTrashItem(key, false)
+			if err != nil {
+				abort()
+				return err
+			}
+			sub.Op = intentRename
+			sub.Target = change.trash.key()
+			sub.Files = []string{""}
+		}
+		intent.Ops = append(intent.Ops, sub)
+	}
+
+	if err := fs.intents.Begin(intent); err != nil {
+		abort()
+		return err
+	}
+
+	for i, change := range changes {
+		var err error
+		if change.trash != nil {
+			err = renameBackend(fs.Backend, change.key, change.trash.key())
+		} else {
+			err = fs.Backend.Put(change.key, change.op.data)
+		}
+		if err != nil {
+			tx.undo(changes[:i])
+			abort()
+			fs.intents.Done(intent)
+			return fmt.Errorf("failed to commit '%s': %v", change.op.name, err)
+		}
+	}
+
+	// Storage is updated; as with a single write, the intent stays until
+	// history has caught up.
+	for i, change := range changes {
+		if change.trash != nil {
+			if err := fs.moveHistories(&intent.Ops[i]); err != nil {
+				return fmt.Errorf("transaction written but history of '%s' not moved: %v", change.op.name, err)
+			}
+			continue
+		}
+		var before *ObjectInfo
+		if change.existed {
+			before = &ObjectInfo{Name: change.key, Size: int64(len(change.old))}
+		}
+		if err := fs.commitVersion(change.key, change.version, before); err != nil {
+			return fmt.Errorf("transaction written but version of '%s' not recorded: %v", change.op.name, err)
+		}
+	}
+	if err := fs.intents.Done(intent); err != nil {
+		return err
+	}
+
+	// As with a single write, new files get an owner once the intent is
+	// done.
+	for _, change := range changes {
+		if change.trash == nil && !change.existed {
+			if err := fs.setOwner(change.key, 0644); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkQuotas checks the quota of every user whose files the transaction
+// changes, counting all its changes together.
+func (tx *Tx) checkQuotas() error {
+	fs := tx.fs
+	deltas := make(map[string]Usage)
+	names := make(map[string]string)
+	for _, key := range tx.keys {
+		op := tx.ops[key]
+		owner, err := fs.quotaOwner(key)
+		if err != nil {
+			return err
+		}
+
+		var delta Usage
+		if op.op == intentWrite {
+			if delta, err = fs.writeUsage(key, int64(len(op.data))); err != nil {
+				return err
+			}
+		} else if info, err := fs.Backend.Stat(key); err == nil {
+			delta = Usage{Bytes: -info.Size, Files: -1}
+		}
+
+		sum := deltas[owner]
+		sum.Bytes += delta.Bytes
+		sum.HistoryBytes += delta.HistoryBytes
+		sum.Files += delta.Files
+		deltas[owner] = sum
+		names[owner] = op.name
+	}
+
+	for owner, delta := range deltas {
+		if err := fs.checkQuota("commit", names[owner], owner, delta); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// undo puts back what storage held before changes were applied.
+func (tx *Tx) undo(changes []*txChange) {
+	for _, change := range changes {
+		if change.trash != nil {
+			renameBackend(tx.fs.Backend, change.trash.key(), change.key)
+		} else if change.existed {
+			tx.fs.Backend.Put(change.key, change.old)
+		} else {
+			tx.fs.Backend.Delete(change.key)
+		}
+	}
+}
@@ -1,25 +1,68 @@
 package main
 
 import (
-	"context"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"time"
-
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
-	"go.mongodb.org/mongo-driver/mongo/readpref"
 )
 
+// Version is one entry in a file's history. Its contents are the
+// concatenation of Chunks, each stored in the blob store. Older versions
+// refer to a single whole-file blob in Blob, and versions recorded before
+// the blob store existed carry their contents inline in Content.
 type Version struct {
 	Version      int       `bson:"version"`
-	Content      string    `bson:"content"`
+	Content      []byte    `bson:"content,omitempty"`
+	Blob         string    `bson:"blob,omitempty"`
+	Chunks       []Chunk   `bson:"chunks,omitempty"`
+	Size         int64     `bson:"size"`
+	Checksum     string    `bson:"checksum,omitempty"` // hex SHA-256 of the contents
 	CreatedTime  time.Time `bson:"created_time"`
 	ModifiedTime time.Time `bson:"modified_time"`
+
+	// Tags and Attributes are those the file had when the version was
+	// recorded.
+	Tags       []string          `bson:"tags,omitempty"`
+	Attributes map[string]string `bson:"attributes,omitempty"`
+}
+
+// Chunk is a reference to one content-defined chunk of a version.
+type Chunk struct {
+	Hash string `bson:"hash"`
+	Size int64  `bson:"size"`
+}
+
+// Len returns the size of the version's contents.
+func (v *Version) Len() int64 {
+	if v.Blob == "" && v.Chunks == nil {
+		return int64(len(v.Content))
+	}
+	return v.Size
+}
+
+// blobHashes returns every blob the version holds a reference to.
+func (v *Version) blobHashes() []string {
+	if v.Blob != "" {
+		return []string{v.Blob}
+	}
+	hashes := make([]string, len(v.Chunks))
+	for i, chunk := range v.Chunks {
+		hashes[i] = chunk.Hash
+	}
+	return hashes
 }
 
+// versionCounters is the record collection holding the last version number
+// handed out per file.
+const versionCounters = "version_counters"
+
 type Versioning struct {
-	client     *mongo.Client
-	collection *mongo.Collection
+	store MetadataStore
+	blobs *BlobStore
 }
 
 type VFileMetadata struct {
@@ -29,174 +72,488 @@ type VFileMetadata struct {
 	UpdatedAt time.Time `bson:"updated_at"`
 }
 
-func NewVersioning() (*Versioning, error) {
-	client, err := mongo.NewClient(options.Client().ApplyURI("mongodb://localhost:27017"))
+func NewVersioning(store MetadataStore, blobs *BlobStore) *Versioning {
+	return &Versioning{store: store, blobs: blobs}
+}
+
+func (v *Versioning) GetAllVersions(filename string) ([]Version, error) {
+	return v.store.GetVersions(filename)
+}
+
+// ListHistories returns every file below dir, or every file if dir is
+// empty, that has a version.
+func (v *Versioning) ListHistories(dir string) ([]string, error) {
+	if dir != "" {
+		dir += "/"
+	}
+	return v.store.ListHistories(dir)
+}
+
+func (v *Versioning) GetLatestVersion(filename string) (int, error) {
+	return v.store.LatestVersion(filename)
+}
+
+func (v *Versioning) CreateVersion(filename string, content string) error {
+	chunks, size, checksum, err := v.storeChunks(bytes.NewReader([]byte(content)))
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+	number, err := v.nextVersion(filename)
+	if err != nil {
+		v.releaseChunks(chunks)
+		return err
+	}
+
+	newVersion := Version{
+		Version:      number,
+		Chunks:       chunks,
+		Size:         size,
+		Checksum:     checksum,
+		CreatedTime:  time.Now().UTC(),
+		ModifiedTime: time.Now().UTC(),
+	}
+
+	if err := v.store.AppendVersion(filename, newVersion); err != nil {
+		v.releaseChunks(chunks)
+		return err
+	}
+	return nil
+}
+
+func (v *Versioning) AddVersion(filename string, content []byte) error {
+	return v.AddVersionFrom(filename, bytes.NewReader(content))
+}
 
-	err = client.Connect(ctx)
+// AddVersionFrom adds a new version with the contents read from r.
+func (v *Versioning) AddVersionFrom(filename string, r io.Reader) error {
+	version, err := v.PrepareVersion(r)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	err = client.Ping(ctx, readpref.Primary())
+	if err := v.CommitVersion(filename, version); err != nil {
+		v.AbortVersion(version)
+		return err
+	}
+	return nil
+}
+
+// PrepareVersion stores the contents read from r and returns a version
+// referring to them that is not part of any history yet. It must be passed
+// to either CommitVersion or AbortVersion.
+func (v *Versioning) PrepareVersion(r io.Reader) (*Version, error) {
+	chunks, size, checksum, err := v.storeChunks(r)
 	if err != nil {
 		return nil, err
 	}
 
-	collection := client.Database("myfilesdb").Collection("files")
-
-	return &Versioning{
-		client:     client,
-		collection: collection,
+	return &Version{
+		Chunks:       chunks,
+		Size:         size,
+		Checksum:     checksum,
+		CreatedTime:  time.Now().UTC(),
+		ModifiedTime: time.Now().UTC(),
 	}, nil
 }
 
-func (v *Versioning) Close() {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+// CommitVersion numbers a prepared version and appends it to the history
+// of filename. If it fails, the version is still prepared.
+func (v *Versioning) CommitVersion(filename string, version *Version) error {
+	number, err := v.nextVersion(filename)
+	if err != nil {
+		return err
+	}
 
-	v.client.Disconnect(ctx)
+	version.Version = number
+	return v.store.AppendVersion(filename, *version)
 }
 
-func (v *Versioning) GetAllVersions(filename string) ([]Version, error) {
-	filter := bson.M{"filename": filename}
-	opts := options.Find().SetSort(bson.M{"versions.version": 1})
-	cursor, err := v.collection.Find(context.Background(), filter, opts)
+// nextVersion allocates a version number for filename. Numbers come from a
+// per-file counter incremented atomically in the metadata store, so two
+// writers can never be handed the same one.
+func (v *Versioning) nextVersion(filename string) (int, error) {
+	number, err := v.store.Increment(versionCounters, filename, 1)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
-	defer cursor.Close(context.Background())
 
-	var versions []Version
-	for cursor.Next(context.Background()) {
-		var fileMetadata VFileMetadata
-		err := cursor.Decode(&fileMetadata)
+	latest, err := v.GetLatestVersion(filename)
+	if err != nil {
+		return 0, err
+	}
+	if number <= int64(latest) {
+		// The history predates the counter; move the counter past it.
+		number, err = v.store.Increment(versionCounters, filename, int64(latest)-number+1)
 		if err != nil {
-			return nil, err
+			return 0, err
 		}
-		versions = append(versions, fileMetadata.Versions...)
 	}
+	return int(number), nil
+}
 
-	if err := cursor.Err(); err != nil {
-		return nil, err
+// ShareVersion prepares a version with the same contents as the latest
+// version of filename, taking new references to its blobs instead of
+// storing them again. It also returns the number of the version shared. If
+// filename has no history, or its contents are inline, it returns nil.
+func (v *Versioning) ShareVersion(filename string) (*Version, int, error) {
+	versions, err := v.GetAllVersions(filename)
+	if err != nil || len(versions) == 0 {
+		return nil, 0, err
+	}
+	latest := versions[len(versions)-1]
+	if latest.Blob == "" && latest.Chunks == nil {
+		return nil, 0, nil
+	}
+
+	hashes := latest.blobHashes()
+	for i, hash := range hashes {
+		if err := v.blobs.Retain(hash); err != nil {
+			for _, retained := range hashes[:i] {
+				v.blobs.Release(retained)
+			}
+			return nil, 0, err
+		}
+	}
+
+	chunks := latest.Chunks
+	if latest.Blob != "" {
+		// A whole-file blob is just one big chunk.
+		chunks = []Chunk{{Hash: latest.Blob, Size: latest.Size}}
 	}
 
-	return versions, nil
+	return &Version{
+		Chunks:       chunks,
+		Size:         latest.Size,
+		Checksum:     latest.Checksum,
+		CreatedTime:  time.Now().UTC(),
+		ModifiedTime: time.Now().UTC(),
+	}, latest.Version, nil
 }
 
-func (v *Versioning) GetLatestVersion(filename string) (int, error) {
-	// Create a filter to match the desired filename
-	filter := bson.M{"filename": filename}
+// AbortVersion releases the contents of a prepared version.
+func (v *Versioning) AbortVersion(version *Version) {
+	v.releaseChunks(version.Chunks)
+}
 
-	// Define the projection to retrieve only the latest version
-	projection := bson.M{"versions": bson.M{"$slice": -1}}
+// storeChunks splits r into chunks and stores each of them, returning
+// references the caller owns along with the size and checksum of the
+// whole.
+func (v *Versioning) storeChunks(r io.Reader) ([]Chunk, int64, string, error) {
+	chunks := []Chunk{}
+	var size int64
+
+	sum := sha256.New()
+	chunker := NewChunker(io.TeeReader(r, sum))
+	for {
+		data, err := chunker.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			v.releaseChunks(chunks)
+			return nil, 0, "", err
+		}
 
-	// Execute the query and retrieve the single result
-	result := v.collection.FindOne(context.Background(), filter, options.FindOne().SetProjection(projection).SetSort(bson.M{"versions.version": -1}))
-	if result.Err() == mongo.ErrNoDocuments {
-		return 0, nil // No documents found for the filename
-	} else if result.Err() != nil {
-		return 0, result.Err() // Error occurred during the query
+		hash, err := v.blobs.Put(data)
+		if err != nil {
+			v.releaseChunks(chunks)
+			return nil, 0, "", err
+		}
+		chunks = append(chunks, Chunk{Hash: hash, Size: int64(len(data))})
+		size += int64(len(data))
 	}
 
-	// Decode the result into a structure that includes the version field
-	var fileMetadata struct {
-		Versions []struct {
-			Version int `bson:"version"`
-		} `bson:"versions"`
+	return chunks, size, hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+// checksum returns the hex SHA-256 of data, as recorded in Version and
+// FileMetadata.
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func (v *Versioning) releaseChunks(chunks []Chunk) {
+	for _, chunk := range chunks {
+		v.blobs.Release(chunk.Hash)
 	}
-	err := result.Decode(&fileMetadata)
+}
+
+// ReadVersion returns the contents of a version.
+func (v *Versioning) ReadVersion(version *Version) ([]byte, error) {
+	r, err := v.OpenVersion(version)
 	if err != nil {
-		return 0, err // Error occurred during result decoding
+		return nil, err
 	}
+	defer r.Close()
 
-	if len(fileMetadata.Versions) > 0 {
-		latestVersion := fileMetadata.Versions[0].Version
-		return latestVersion, nil
+	return io.ReadAll(r)
+}
+
+// OpenVersion returns a reader for the contents of a version. Chunks are
+// fetched one at a time as the reader reaches them.
+func (v *Versioning) OpenVersion(version *Version) (io.ReadCloser, error) {
+	if version.Blob != "" {
+		return v.blobs.Open(version.Blob)
+	}
+	if version.Chunks != nil {
+		return &chunkReader{blobs: v.blobs, chunks: version.Chunks}, nil
 	}
+	return ioutil.NopCloser(bytes.NewReader(version.Content)), nil
+}
 
-	return 0, nil // No versions found for the filename
+type chunkReader struct {
+	blobs   *BlobStore
+	chunks  []Chunk
+	current io.ReadCloser
 }
 
-func (v *Versioning) CreateVersion(filename string, content string) error {
-	fileMetadata := &VFileMetadata{
-		Filename:  filename,
-		Versions:  []Version{},
-		CreatedAt: time.Now().UTC(),
-		UpdatedAt: time.Now().UTC(),
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if len(r.chunks) == 0 {
+				return 0, io.EOF
+			}
+			current, err := r.blobs.Open(r.chunks[0].Hash)
+			if err != nil {
+				return 0, err
+			}
+			r.current = current
+			r.chunks = r.chunks[1:]
+		}
+
+		n, err := r.current.Read(p)
+		if err == io.EOF {
+			r.current.Close()
+			r.current = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
 	}
+}
 
-	newVersion := Version{
-		Version:      1,
-		Content:      content,
-		CreatedTime:  time.Now().UTC(),
-		ModifiedTime: time.Now().UTC(),
+func (r *chunkReader) Close() error {
+	if r.current != nil {
+		return r.current.Close()
+	}
+	return nil
+}
+
+// DeleteVersion removes one version of a file and releases its contents.
+func (v *Versioning) DeleteVersion(filename string, number int) error {
+	versions, err := v.GetAllVersions(filename)
+	if err != nil {
+		return err
+	}
+
+	for _, version := range versions {
+		if version.Version != number {
+			continue
+		}
+		if err := v.store.RemoveVersion(filename, number); err != nil {
+			return err
+		}
+		for _, hash := range version.blobHashes() {
+			if err := v.blobs.Release(hash); err != nil {
+				return err
+			}
+		}
+		return nil
 	}
 
-	fileMetadata.Versions = append(fileMetadata.Versions, newVersion)
+	return fmt.Errorf("version %d of '%s' not found", number, filename)
+}
 
-	_, err := v.collection.InsertOne(context.Background(), fileMetadata)
+// DeleteHistory removes every version of a file, and the events and
+// version counter recorded for it.
+func (v *Versioning) DeleteHistory(filename string) error {
+	versions, err := v.GetAllVersions(filename)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	for _, version := range versions {
+		if err := v.DeleteVersion(filename, version.Version); err != nil {
+			return err
+		}
+	}
+	if err := v.store.DeleteRecord(historyEvents, filename); err != nil {
+		return err
+	}
+	return v.store.DeleteRecord(versionCounters, filename)
 }
 
-func (v *Versioning) AddVersion(filename string, content []byte) error {
-	latestVersion, err := v.GetLatestVersion(filename)
+// historyEvents is the record collection holding, per file, the events in
+// its history that are not versions of its own.
+const historyEvents = "history_events"
+
+// HistoryEvent records something that happened to a file besides a new
+// version, such as being renamed or copied from another file. Version is
+// the file's latest version at the time.
+type HistoryEvent struct {
+	Op      string    `bson:"op"`
+	From    string    `bson:"from"`
+	To      string    `bson:"to"`
+	Version int       `bson:"version"`
+	Time    time.Time `bson:"time"`
+
+	// FromVersion is the version of From a copy was made of.
+	FromVersion int `bson:"from_version,omitempty"`
+}
+
+// GetEvents returns the events in the history of a file, oldest first.
+func (v *Versioning) GetEvents(filename string) ([]HistoryEvent, error) {
+	var events []HistoryEvent
+	err := v.store.GetRecord(historyEvents, filename, &events)
+	if err == ErrNotFound {
+		return nil, nil
+	}
+	return events, err
+}
+
+// RecordEvent adds an event to the history of a file.
+func (v *Versioning) RecordEvent(filename string, event HistoryEvent) error {
+	events, err := v.GetEvents(filename)
 	if err != nil {
 		return err
 	}
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	return v.store.PutRecord(historyEvents, filename, append(events, event))
+}
 
-	newVersion := latestVersion + 1
+// RekeyHistory moves the versions and events of oldName to newName, which
+// must have none, without recording anything.
+func (v *Versioning) RekeyHistory(oldName, newName string) error {
+	if err := v.store.RenameHistory(oldName, newName); err != nil {
+		return err
+	}
+	if err := v.store.DeleteRecord(versionCounters, oldName); err != nil {
+		return err
+	}
+	return v.moveEvents(oldName, newName)
+}
 
-	if latestVersion == 0 {
-		// If no previous versions exist, use InsertOne
-		newDocument := bson.M{
-			"filename": filename,
-			"versions": []bson.M{
-				{
-					"version":       newVersion,
-					"content":       content,
-					"created_time":  time.Now().UTC(),
-					"modified_time": time.Now().UTC(),
-				},
-			},
-			"updated_at": time.Now().UTC(),
-		}
+// MoveHistory moves the versions and events of oldName over to newName and
+// records the rename. If newName already has a history, the moved versions
+// are appended to it with new numbers.
+func (v *Versioning) MoveHistory(oldName, newName string) error {
+	versions, err := v.GetAllVersions(oldName)
+	if err != nil {
+		return err
+	}
+	existing, err := v.GetLatestVersion(newName)
+	if err != nil {
+		return err
+	}
 
-		_, err = v.collection.InsertOne(context.Background(), newDocument)
-		if err != nil {
+	if existing == 0 {
+		if err := v.store.RenameHistory(oldName, newName); err != nil {
 			return err
 		}
 	} else {
-		// If previous versions exist, use UpdateOne
-		filter := bson.M{"filename": filename}
-		update := bson.M{
-			"$push": bson.M{"versions": bson.M{
-				"version":       newVersion,
-				"content":       content,
-				"created_time":  time.Now().UTC(),
-				"modified_time": time.Now().UTC(),
-			}},
-			"$set": bson.M{
-				"updated_at": time.Now().UTC(),
-			},
+		for _, version := range versions {
+			old := version.Version
+			if version.Version, err = v.nextVersion(newName); err != nil {
+				return err
+			}
+			// The version's blob references move along with it.
+			if err := v.store.AppendVersion(newName, version); err != nil {
+				return err
+			}
+			if err := v.store.RemoveVersion(oldName, old); err != nil {
+				return err
+			}
 		}
+	}
+	if err := v.store.DeleteRecord(versionCounters, oldName); err != nil {
+		return err
+	}
 
-		_, err = v.collection.UpdateOne(context.Background(), filter, update)
-		if err != nil {
-			return err
+	latest, err := v.GetLatestVersion(newName)
+	if err != nil {
+		return err
+	}
+	return v.moveEvents(oldName, newName, HistoryEvent{
+		Op:      "rename",
+		From:    oldName,
+		To:      newName,
+		Version: latest,
+		Time:    time.Now().UTC(),
+	})
+}
+
+// moveEvents appends the events of oldName, followed by added, to those of
+// newName.
+func (v *Versioning) moveEvents(oldName, newName string, added ...HistoryEvent) error {
+	events, err := v.GetEvents(oldName)
+	if err != nil {
+		return err
+	}
+	if events == nil && added == nil {
+		return nil
+	}
+	moved, err := v.GetEvents(newName)
+	if err != nil {
+		return err
+	}
+
+	events = append(append(moved, events...), added...)
+	if err := v.store.PutRecord(historyEvents, newName, events); err != nil {
+		return err
+	}
+	return v.store.DeleteRecord(historyEvents, oldName)
+}
+
+// VersionStats describes how much of a version is new and how much it
+// shares with earlier versions of the same file.
+type VersionStats struct {
+	Version     int
+	Size        int64
+	Chunks      int
+	NewBytes    int64
+	SharedBytes int64
+}
+
+// GetVersionStats returns the storage breakdown for every version of a
+// file, oldest first.
+func (v *Versioning) GetVersionStats(filename string) ([]VersionStats, error) {
+	versions, err := v.GetAllVersions(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var stats []VersionStats
+	for _, version := range versions {
+		stat := VersionStats{Version: version.Version, Size: version.Len()}
+
+		chunks := version.Chunks
+		if version.Blob != "" {
+			chunks = []Chunk{{Hash: version.Blob, Size: version.Size}}
+		}
+		if chunks == nil {
+			// Inline contents are never shared.
+			stat.NewBytes = stat.Size
 		}
+
+		for _, chunk := range chunks {
+			stat.Chunks++
+			if seen[chunk.Hash] {
+				stat.SharedBytes += chunk.Size
+			} else {
+				seen[chunk.Hash] = true
+				stat.NewBytes += chunk.Size
+			}
+		}
+		stats = append(stats, stat)
 	}
 
-	return nil
+	return stats, nil
 }
 
 /*